@@ -18,13 +18,16 @@ type Ansible interface {
 	setupDiscovery() error
 	setProtocolAndHandel()
 
-	setLeader(peerID peer.ID)
-	getLeader() peer.ID
+	SetQuota(quota Quota) // Limit what each leader may create on this follower
+
+	getLeaders() *leaders
 	getPluginMetadata() hainish.Plugin
 	getRuntime() *runtime.Runtime
 
-	initWorkflowListener(workflowID int) (chan any, chan error, chan hainish.Edge)
+	initWorkflowListener(workflowID int, owner workflowOwner) *workflowListener
+	setWorkflowListener(wl *workflowListener)
 	getWorkflowListener(workflowID int) *workflowListener
+	removeWorkflowListener(workflowID int)
 	getPeerManager() *peerManager
 }
 
@@ -32,12 +35,13 @@ type ImplAnsible struct {
 	h         host.Host
 	peerStore *peerManager
 
-	leaderID peer.ID
+	leaders *leaders // The leaders served, and their workflows
 
 	pluginMetadata hainish.Plugin
 	r              *runtime.Runtime
 
-	wfListener map[int]workflowListener
+	wfListener   map[int]workflowListener
+	wfListenerMu sync.Mutex // The stream handlers run workflows and look up their listeners at once
 }
 
 func (asb *ImplAnsible) host() host.Host {
@@ -66,6 +70,7 @@ func Init(pluginMetadata hainish.Plugin, runtime *runtime.Runtime) (*Ansible, er
 
 	ansible.pluginMetadata = pluginMetadata
 	ansible.r = runtime
+	ansible.leaders = newLeaders()
 
 	// Initialize libp2p host
 	h, err := initLibp2p()
@@ -73,6 +78,7 @@ func Init(pluginMetadata hainish.Plugin, runtime *runtime.Runtime) (*Ansible, er
 		return nil, err
 	}
 	ansible.h = h
+	runtime.SetLocalPeer(h.ID())
 
 	// Initialize peer manager
 	ansible.peerStore = &peerManager{
@@ -80,6 +86,11 @@ func Init(pluginMetadata hainish.Plugin, runtime *runtime.Runtime) (*Ansible, er
 		mu:      sync.Mutex{},
 		ansible: &ansible,
 	}
+	// Report to the leader when a workflow completes on this follower
+	runtime.SetCompletionHandler(ansible.peerStore.handelCompletion)
+	// And when it becomes active by passing data between its nodes here
+	runtime.SetActivityHandler(ansible.peerStore.handelLocalActivity)
+
 	// Add self to peer store
 	ansible.peerStore.peers[h.ID()] = ansiblePeer{
 		addr:      peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()},
@@ -95,7 +106,8 @@ func Init(pluginMetadata hainish.Plugin, runtime *runtime.Runtime) (*Ansible, er
 	//Set protocol and handle
 	ansible.setProtocolAndHandel()
 
-	return nil, err
+	var asb Ansible = &ansible
+	return &asb, nil
 }
 
 func initLibp2p() (host.Host, error) {
@@ -119,20 +131,52 @@ func (asb *ImplAnsible) setProtocolAndHandel() {
 	asb.h.SetStreamHandler(createNodeProtocol, asb.peerStore.handelCreateNodeProtocol)
 	// Create edge protocol
 	asb.h.SetStreamHandler(createEdgeProtocol, asb.peerStore.handelCreateEdgeProtocol)
-	// Passing data protocol
+	// Run workflow protocol
 	asb.h.SetStreamHandler(runWorkflowProtocol, asb.peerStore.handelRunWorkflow)
+	// Force run workflow protocol
+	asb.h.SetStreamHandler(forceRunWorkflowProtocol, asb.peerStore.handelForceRunWorkflow)
+	// Validate workflow protocol
+	asb.h.SetStreamHandler(validateWorkflowProtocol, asb.peerStore.handelValidateWorkflow)
 	// Delete workflow protocol
 	asb.h.SetStreamHandler(deleteWorkflow, asb.peerStore.handelDeleteWorkflow)
 	// Delete node protocol
 	asb.h.SetStreamHandler(deleteNodeProtocol, asb.peerStore.handelDeleteNodeProtocol)
 	// Set param protocol
 	asb.h.SetStreamHandler(setParamProtocol, asb.peerStore.handelSetParamProtocol)
+	// Set output mode protocol
+	asb.h.SetStreamHandler(setOutputModeProtocol, asb.peerStore.handelSetOutputModeProtocol)
+	// Set trigger protocol
+	asb.h.SetStreamHandler(setTriggerProtocol, asb.peerStore.handelSetTriggerProtocol)
+	// Set error policy protocol
+	asb.h.SetStreamHandler(setErrorPolicyProtocol, asb.peerStore.handelSetErrorPolicyProtocol)
+	// Set restart policy protocol
+	asb.h.SetStreamHandler(setRestartPolicyProtocol, asb.peerStore.handelSetRestartPolicyProtocol)
+	// Set timeout protocol
+	asb.h.SetStreamHandler(setTimeoutProtocol, asb.peerStore.handelSetTimeoutProtocol)
+	// Set concurrency protocol
+	asb.h.SetStreamHandler(setConcurrencyProtocol, asb.peerStore.handelSetConcurrencyProtocol)
 	// Delete edge protocol
 	asb.h.SetStreamHandler(deleteEdgeProtocol, asb.peerStore.handelDeleteEdgeProtocol)
 	// Stop workflow protocol
 	asb.h.SetStreamHandler(stopWorkflowProtocol, asb.peerStore.handelStopWorkflow)
+	// Drain workflow protocol
+	asb.h.SetStreamHandler(drainWorkflowProtocol, asb.peerStore.handelDrainWorkflow)
+	// Pause workflow protocol
+	asb.h.SetStreamHandler(pauseWorkflowProtocol, asb.peerStore.handelPauseWorkflow)
+	// Resume workflow protocol
+	asb.h.SetStreamHandler(resumeWorkflowProtocol, asb.peerStore.handelResumeWorkflow)
+	// Query workflow state protocol
+	asb.h.SetStreamHandler(queryStateProtocol, asb.peerStore.handelQueryState)
+	// Trigger workflow protocol
+	asb.h.SetStreamHandler(triggerWorkflowProtocol, asb.peerStore.handelTriggerWorkflow)
+	// Deploy workflow protocol
+	asb.h.SetStreamHandler(deployWorkflowProtocol, asb.peerStore.handelDeployWorkflowProtocol)
+	// Query scheduler protocol
+	asb.h.SetStreamHandler(querySchedulerProtocol, asb.peerStore.handelQueryScheduler)
 	// passing data protocol
 	asb.h.SetStreamHandler(passingDataProtocol, asb.peerStore.handelPassingDataProtocol)
+	// Data acknowledgement protocol
+	asb.h.SetStreamHandler(dataAckProtocol, asb.peerStore.handelDataAckProtocol)
 }
 
 // Add link based on workflow as the scale
@@ -179,12 +223,14 @@ func (p *peerManager) subLink(peerID peer.ID) error {
 	return nil
 }
 
-func (asb *ImplAnsible) setLeader(peerID peer.ID) {
-	asb.leaderID = peerID
+// SetQuota limits what each leader may create on this follower.
+// What has been created is kept, even if it is over the quota.
+func (asb *ImplAnsible) SetQuota(quota Quota) {
+	asb.leaders.setQuota(quota)
 }
 
-func (asb *ImplAnsible) getLeader() peer.ID {
-	return asb.leaderID
+func (asb *ImplAnsible) getLeaders() *leaders {
+	return asb.leaders
 }
 
 func (asb *ImplAnsible) getPluginMetadata() hainish.Plugin {
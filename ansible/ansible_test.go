@@ -1,10 +1,16 @@
 package ansible
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/lvyonghuan/Ubik-Util/uerr"
 	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/runtime"
+	"github.com/lvyonghuan/mobiles/util"
 )
 
 // mockPlugin simulates plugin implementation
@@ -176,13 +182,38 @@ func TestProtocolConstants(t *testing.T) {
 		"createNode":     "/ansible/leader/node/create/1.0.0",
 		"deleteNode":     "/ansible/leader/node/delete/1.0.0",
 		"setParam":       "/ansible/leader/node/param/1.0.0",
+		"setOutputMode":  "/ansible/leader/node/output/1.0.0",
+		"setTrigger":     "/ansible/leader/node/trigger/1.0.0",
+		"setErrorPolicy": "/ansible/leader/node/error/1.0.0",
+		"setRestart":     "/ansible/leader/node/restart/1.0.0",
+		"setTimeout":     "/ansible/leader/node/timeout/1.0.0",
+		"setConcurrency": "/ansible/leader/node/concurrency/1.0.0",
 		"createEdge":     "/ansible/leader/edge/create/1.0.0",
 		"deleteEdge":     "/ansible/leader/edge/delete/1.0.0",
 		"runWorkflow":    "ansible/leader/workflow/run/1.0.0",
+		"forceRun":       "ansible/leader/workflow/run/force/1.0.0",
+		"validate":       "/ansible/leader/workflow/validate/1.0.0",
 		"stopWorkflow":   "ansible/leader/workflow/stop/1.0.0",
+		"drainWorkflow":  "/ansible/leader/workflow/drain/1.0.0",
+		"pauseWorkflow":  "/ansible/leader/workflow/pause/1.0.0",
+		"resumeWorkflow": "/ansible/leader/workflow/resume/1.0.0",
+		"queryState":     "/ansible/leader/workflow/state/1.0.0",
+		"trigger":        "/ansible/leader/workflow/trigger/1.0.0",
+		"queryScheduler": "/ansible/leader/scheduler/query/1.0.0",
+		"deployWorkflow": "/ansible/leader/workflow/deploy/1.0.0",
 		"logUpload":      "ansible/follower/log/1.0.0",
 		"resultUpload":   "ansible/follower/result/1.0.0",
+		"validation":     "ansible/follower/validation/1.0.0",
+		"stateReport":    "ansible/follower/state/1.0.0",
+		"completion":     "ansible/follower/completion/1.0.0",
+		"activity":       "ansible/follower/activity/1.0.0",
+		"errorDecision":  "ansible/follower/error/1.0.0",
+		"paramAck":       "ansible/follower/param/ack/1.0.0",
+		"deployReport":   "ansible/follower/deploy/1.0.0",
+		"createAck":      "ansible/follower/create/ack/1.0.0",
+		"scheduler":      "ansible/follower/scheduler/1.0.0",
 		"passingData":    "ansible/follower/data/1.0.0",
+		"dataAck":        "ansible/follower/data/ack/1.0.0",
 	}
 
 	actualProtocols := map[string]string{
@@ -193,13 +224,38 @@ func TestProtocolConstants(t *testing.T) {
 		"createNode":     createNodeProtocol,
 		"deleteNode":     deleteNodeProtocol,
 		"setParam":       setParamProtocol,
+		"setOutputMode":  setOutputModeProtocol,
+		"setTrigger":     setTriggerProtocol,
+		"setErrorPolicy": setErrorPolicyProtocol,
+		"setRestart":     setRestartPolicyProtocol,
+		"setTimeout":     setTimeoutProtocol,
+		"setConcurrency": setConcurrencyProtocol,
 		"createEdge":     createEdgeProtocol,
 		"deleteEdge":     deleteEdgeProtocol,
 		"runWorkflow":    runWorkflowProtocol,
+		"forceRun":       forceRunWorkflowProtocol,
+		"validate":       validateWorkflowProtocol,
 		"stopWorkflow":   stopWorkflowProtocol,
+		"drainWorkflow":  drainWorkflowProtocol,
+		"pauseWorkflow":  pauseWorkflowProtocol,
+		"resumeWorkflow": resumeWorkflowProtocol,
+		"queryState":     queryStateProtocol,
+		"trigger":        triggerWorkflowProtocol,
+		"queryScheduler": querySchedulerProtocol,
+		"deployWorkflow": deployWorkflowProtocol,
 		"logUpload":      logUploadProtocol,
 		"resultUpload":   resultUploadProtocol,
+		"validation":     validationProtocol,
+		"stateReport":    stateReportProtocol,
+		"completion":     completionProtocol,
+		"activity":       activityProtocol,
+		"errorDecision":  errorDecisionProtocol,
+		"paramAck":       paramAckProtocol,
+		"deployReport":   deployReportProtocol,
+		"createAck":      createAckProtocol,
+		"scheduler":      schedulerReportProtocol,
 		"passingData":    passingDataProtocol,
+		"dataAck":        dataAckProtocol,
 	}
 
 	for name, expected := range expectedProtocols {
@@ -236,22 +292,414 @@ func TestWorkflowListenerInterface(t *testing.T) {
 func TestInitWorkflowListener(t *testing.T) {
 	ansible := &ImplAnsible{}
 
-	resultChan, errChan, processChan := ansible.initWorkflowListener(1)
+	wl := ansible.initWorkflowListener(1, workflowOwner{leader: "leader", workflowID: 1})
 
-	if resultChan == nil {
+	if wl.resultChan == nil {
 		t.Error("Expected resultChan to be initialized")
 	}
 
-	if errChan == nil {
+	if wl.errChan == nil {
 		t.Error("Expected errChan to be initialized")
 	}
 
-	if processChan == nil {
+	if wl.processChan == nil {
 		t.Error("Expected processChan to be initialized")
 	}
 
 	// Check channel capacities
-	if cap(resultChan) < 1 {
+	if cap(wl.resultChan) < 1 {
 		t.Error("Expected resultChan to have capacity")
 	}
+
+	// The listener of the running workflow is kept until the new run starts
+	if ansible.getWorkflowListener(1) != nil {
+		t.Error("Expected the listener not registered before the workflow runs")
+	}
+	ansible.setWorkflowListener(wl)
+	if registered := ansible.getWorkflowListener(1); registered == nil || registered.termination != wl.termination {
+		t.Error("Expected the listener registered")
+	}
+}
+
+// stringCodec encodes strings as they are
+type stringCodec struct{}
+
+func (stringCodec) Name() string { return "string" }
+
+func (stringCodec) Encode(v any) ([]byte, error) { return []byte(v.(string)), nil }
+
+func (stringCodec) Decode(data []byte, v any) error {
+	*v.(*string) = string(data)
+	return nil
+}
+
+// TestNewResultMessage tests putting a result into the message uploaded to the leader
+func TestNewResultMessage(t *testing.T) {
+	result := runtime.Result{
+		WorkflowID: 1,
+		NodeID:     2,
+		NodeName:   "testNode",
+		RunID:      "run1",
+		Timestamp:  time.UnixMilli(1700000000000),
+		Duration:   1500 * time.Microsecond,
+		Value:      map[string]int{"a": 1},
+	}
+
+	message, err := newResultMessage(result)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if message.WorkflowID != 1 || message.NodeID != 2 || message.NodeName != "testNode" || message.RunID != "run1" {
+		t.Errorf("Unexpected message header %+v", message)
+	}
+	if message.Timestamp != 1700000000000 || message.Duration != 1500 {
+		t.Errorf("Expected timestamp 1700000000000 and duration 1500, got %d and %d", message.Timestamp, message.Duration)
+	}
+	if message.Codec != "json" || string(message.Value) != `{"a":1}` {
+		t.Errorf("Expected the value encoded as JSON, got %s %q", message.Codec, message.Value)
+	}
+
+	// A named result is encoded with its port's codec
+	result.Name = "text"
+	result.Value = "hello"
+	result.Codec = stringCodec{}
+	message, err = newResultMessage(result)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if message.Name != "text" || message.Codec != "string" || string(message.Value) != "hello" {
+		t.Errorf("Expected the value encoded by the string codec, got %+v", message)
+	}
+}
+
+func TestNewErrorDecisionMessage(t *testing.T) {
+	runErr := &runtime.RunError{
+		WorkflowID: 1,
+		NodeID:     2,
+		RunID:      "run1",
+		Attempt:    3,
+		Decision:   runtime.ErrorDeadLetter,
+		Inputs:     map[string]any{"input1": 1},
+		Err:        errors.New("failed"),
+	}
+
+	message := newErrorDecisionMessage(runErr)
+	if message.WorkflowID != 1 || message.NodeID != 2 || message.RunID != "run1" || message.Attempt != 3 {
+		t.Errorf("Unexpected message header %+v", message)
+	}
+	if message.Decision != "dead_letter" || message.Error != "failed" || string(message.Inputs) != `{"input1":1}` {
+		t.Errorf("Unexpected decision %+v", message)
+	}
+
+	// The decision is still reported when the input can't be encoded
+	runErr.Inputs = map[string]any{"input1": make(chan int)}
+	message = newErrorDecisionMessage(runErr)
+	if message.Inputs != nil || message.Decision != "dead_letter" {
+		t.Errorf("Expected the decision without the input, got %+v", message)
+	}
+}
+
+func TestNewPluginInfoMessage(t *testing.T) {
+	maxRetries := 10.0
+	node := hainish.NewNode("node1", "Node 1", true, nil,
+		map[string]hainish.Port{"output1": hainish.NewPort("output1", "Output 1", "string")},
+		map[string]hainish.Port{
+			"retries": hainish.NewParamPort("retries", hainish.ParamSchema{Type: hainish.ParamInt, Default: 3, Max: &maxRetries}),
+			"label":   hainish.NewPort("label", "Label", "string"),
+		}, nil)
+	plugin := &mockPlugin{name: "plugin1", version: "1.0.0", nodes: map[string]hainish.Node{"node1": node}}
+
+	message := newPluginInfoMessage(plugin)
+	if message.Name != "plugin1" || message.Version != "1.0.0" {
+		t.Errorf("Unexpected plugin info %+v", message)
+	}
+	info := message.Nodes["node1"]
+	if !info.IsBegin || info.Outputs["output1"] != "string" {
+		t.Errorf("Unexpected node info %+v", info)
+	}
+	retries := info.Params["retries"]
+	if retries.Type != hainish.ParamInt || retries.Default != 3 || retries.Max == nil || *retries.Max != maxRetries {
+		t.Errorf("Unexpected schema of retries %+v", retries)
+	}
+	// A port without a schema is described by its type
+	if label := info.Params["label"]; label.Type != hainish.ParamString || label.Description != "Label" {
+		t.Errorf("Unexpected schema of label %+v", label)
+	}
+}
+
+// fakeActivity records what a termination detector reports
+type fakeActivity struct {
+	quiet    bool
+	counter  uint64
+	acks     []peer.ID
+	reported []bool
+}
+
+func newFakeTermination(leader peer.ID) (*termination, *fakeActivity) {
+	f := &fakeActivity{quiet: true}
+	t := newTermination(1, leader,
+		func() (bool, uint64) { return f.quiet, f.counter },
+		func(to peer.ID) error { f.acks = append(f.acks, to); return nil },
+		func(idle bool) error { f.reported = append(f.reported, idle); return nil },
+	)
+	return t, f
+}
+
+// TestTerminationIdle tests that a follower run by the leader reports idle
+// only after it stays quiet and its data has been acknowledged
+func TestTerminationIdle(t *testing.T) {
+	term, f := newFakeTermination("leader")
+
+	// Busy, then quiet for one check only
+	f.quiet = false
+	term.check()
+	f.quiet = true
+	term.check()
+	if len(f.reported) != 0 {
+		t.Fatalf("Expected no report yet, got %v", f.reported)
+	}
+
+	// Data on the way keeps it engaged
+	term.sent()
+	term.check()
+	term.check()
+	if len(f.reported) != 0 {
+		t.Fatalf("Expected no report while data is unacknowledged, got %v", f.reported)
+	}
+
+	term.acked()
+	term.check()
+	term.check()
+	if len(f.reported) != 1 || !f.reported[0] {
+		t.Fatalf("Expected one idle report, got %v", f.reported)
+	}
+
+	// Work done between two checks is noticed
+	term.activate()
+	term.check()
+	f.counter++
+	term.check()
+	if len(f.reported) != 2 || f.reported[1] {
+		t.Fatalf("Expected an active report only, got %v", f.reported)
+	}
+	term.check()
+	if len(f.reported) != 3 || !f.reported[2] {
+		t.Fatalf("Expected idle reported again, got %v", f.reported)
+	}
+}
+
+// TestTerminationReceive tests that data engaging a follower is acknowledged when it goes idle,
+// and any other data at once
+func TestTerminationReceive(t *testing.T) {
+	term, f := newFakeTermination("leader")
+	term.check()
+	term.check()
+	if len(f.reported) != 1 {
+		t.Fatalf("Expected an idle report, got %v", f.reported)
+	}
+
+	delivered := 0
+	if ack := term.receive("peer1", func() { delivered++ }); ack {
+		t.Error("Expected the data engaging the follower to be acknowledged later")
+	}
+	if ack := term.receive("peer2", func() { delivered++ }); !ack {
+		t.Error("Expected the data to an engaged follower to be acknowledged at once")
+	}
+	if delivered != 2 {
+		t.Errorf("Expected 2 values delivered, got %d", delivered)
+	}
+
+	term.check()
+	term.check()
+	if len(f.acks) != 1 || f.acks[0] != "peer1" {
+		t.Errorf("Expected the parent acknowledged, got %v", f.acks)
+	}
+	if len(f.reported) != 1 {
+		t.Errorf("Expected no report to the leader, got %v", f.reported)
+	}
+}
+
+// TestLocalActivity tests that data passed between the nodes of a workflow on this follower
+// engages it with the leader again
+func TestLocalActivity(t *testing.T) {
+	asb := &ImplAnsible{}
+	p := &peerManager{ansible: asb}
+	wl := asb.initWorkflowListener(1, workflowOwner{leader: "leader", workflowID: 1})
+	term, f := newFakeTermination("leader")
+	wl.termination = term
+	asb.setWorkflowListener(wl)
+
+	term.check()
+	term.check()
+	if len(f.reported) != 1 || !f.reported[0] {
+		t.Fatalf("Expected an idle report, got %v", f.reported)
+	}
+
+	p.handelLocalActivity(1)
+	if len(f.reported) != 2 || f.reported[1] {
+		t.Fatalf("Expected an active report, got %v", f.reported)
+	}
+	p.handelLocalActivity(2) // Not running here
+	if len(f.reported) != 2 {
+		t.Errorf("Expected no more report, got %v", f.reported)
+	}
+}
+
+// TestCreateWorkflowMessage tests that the workflow ID is accepted alone, or with an idempotency key
+func TestCreateWorkflowMessage(t *testing.T) {
+	tests := map[string]createWorkflowMessage{
+		`7`:                            {WorkflowID: 7},
+		`{"WorkflowID":7,"Key":"abc"}`: {WorkflowID: 7, Key: "abc"},
+	}
+	for data, expected := range tests {
+		var message createWorkflowMessage
+		if err := json.Unmarshal([]byte(data), &message); err != nil {
+			t.Fatalf("Unexpected error decoding %s: %v", data, err)
+		}
+		if message != expected {
+			t.Errorf("Expected %+v decoding %s, got %+v", expected, data, message)
+		}
+	}
+
+	var message createWorkflowMessage
+	if err := json.Unmarshal([]byte(`"7"`), &message); err == nil {
+		t.Error("Expected an error decoding a string")
+	}
+}
+
+// newLeaderPeerManager is a peer manager without a host, serving leaders with a runtime of one begin node
+func newLeaderPeerManager() *peerManager {
+	node := hainish.NewNode("node1", "Node 1", true, nil,
+		map[string]hainish.Port{"output1": hainish.NewPort("output1", "Output 1", "string")}, nil, nil)
+	ansible := &ImplAnsible{
+		r:       runtime.InitRuntime(map[string]hainish.Node{"node1": node}),
+		leaders: newLeaders(),
+	}
+	p := &peerManager{peers: make(map[peer.ID]ansiblePeer), ansible: ansible}
+	ansible.peerStore = p
+	return p
+}
+
+// TestLeaderNamespaces tests that the workflows of two leaders with the same ID are kept apart
+func TestLeaderNamespaces(t *testing.T) {
+	p := newLeaderPeerManager()
+	l := p.ansible.getLeaders()
+
+	for _, leader := range []peer.ID{"leader1", "leader2"} {
+		if err := p.createWorkflow(leader, createWorkflowMessage{WorkflowID: 1}); err != nil {
+			t.Fatalf("Unexpected error creating workflow of %s: %v", leader, err)
+		}
+		if err := p.createNode(leader, createNodeMessage{NodeName: "node1", NodeID: 1, WorkflowID: 1}); err != nil {
+			t.Fatalf("Unexpected error creating node of %s: %v", leader, err)
+		}
+	}
+
+	id1, err1 := l.lookup("leader1", 1)
+	id2, err2 := l.lookup("leader2", 1)
+	if err1 != nil || err2 != nil || id1 == id2 {
+		t.Fatalf("Expected two runtime workflows, got %d (%v) and %d (%v)", id1, err1, id2, err2)
+	}
+	if owner, _ := l.owner(id2); owner.leader != "leader2" || owner.workflowID != 1 {
+		t.Errorf("Expected workflow %d owned by leader2's workflow 1, got %+v", id2, owner)
+	}
+	if _, err := l.lookup("leader3", 1); !errors.Is(err.(uerr.UbikError).MetaError(), util.ErrWorkflowNotFound) {
+		t.Errorf("Expected a workflow not found error for another leader, got %v", err)
+	}
+
+	// A leader's workflow is created again as a conflict, and deleted only for it
+	err := p.createWorkflow("leader1", createWorkflowMessage{WorkflowID: 1})
+	var conflictErr *runtime.ConflictError
+	if ubikErr, ok := err.(uerr.UbikError); !ok || !errors.As(ubikErr.MetaError(), &conflictErr) {
+		t.Errorf("Expected a conflict creating the workflow again, got %v", err)
+	}
+	owner1, _ := l.owner(id1)
+	p.ansible.setWorkflowListener(p.ansible.initWorkflowListener(id1, owner1))
+	if err := p.deleteWorkflow("leader1", 1); err != nil {
+		t.Fatalf("Unexpected error deleting workflow: %v", err)
+	}
+	if _, err := l.lookup("leader1", 1); err == nil {
+		t.Error("Expected leader1's workflow forgotten")
+	}
+	if p.ansible.getWorkflowListener(id1) != nil {
+		t.Error("Expected the listener of leader1's workflow forgotten")
+	}
+	if nodeIDs, err := p.ansible.getRuntime().NodeIDs(id2); err != nil || len(nodeIDs) != 1 {
+		t.Errorf("Expected leader2's workflow kept, got %v (%v)", nodeIDs, err)
+	}
+}
+
+// TestLeaderQuota tests that each leader creates within its quota
+func TestLeaderQuota(t *testing.T) {
+	p := newLeaderPeerManager()
+	p.ansible.SetQuota(Quota{MaxWorkflows: 2, MaxNodes: 2})
+
+	isQuotaError := func(err error) bool {
+		ubikErr, ok := err.(uerr.UbikError)
+		return ok && errors.Is(ubikErr.MetaError(), util.ErrQuotaExceeded)
+	}
+
+	for workflowID := 1; workflowID <= 2; workflowID++ {
+		if err := p.createWorkflow("leader1", createWorkflowMessage{WorkflowID: workflowID}); err != nil {
+			t.Fatalf("Unexpected error creating workflow %d: %v", workflowID, err)
+		}
+	}
+	if err := p.createWorkflow("leader1", createWorkflowMessage{WorkflowID: 3}); !isQuotaError(err) {
+		t.Errorf("Expected a quota error creating a third workflow, got %v", err)
+	}
+	if err := p.createWorkflow("leader2", createWorkflowMessage{WorkflowID: 3}); err != nil {
+		t.Errorf("Expected another leader to have its own quota, got %v", err)
+	}
+
+	// The nodes are counted in all the workflows of the leader
+	p.createNode("leader1", createNodeMessage{NodeName: "node1", NodeID: 1, WorkflowID: 1})
+	message := createNodeMessage{NodeName: "node1", NodeID: 1, WorkflowID: 2, Key: "n1"}
+	if err := p.createNode("leader1", message); err != nil {
+		t.Fatalf("Unexpected error creating node: %v", err)
+	}
+	if err := p.createNode("leader1", createNodeMessage{NodeName: "node1", NodeID: 2, WorkflowID: 2}); !isQuotaError(err) {
+		t.Errorf("Expected a quota error creating a third node, got %v", err)
+	}
+	if err := p.createNode("leader1", message); err != nil {
+		t.Errorf("Expected a retry not to count, got %v", err)
+	}
+
+	d := runtime.Deployment{WorkflowID: 2, Nodes: []runtime.NodeSpec{{NodeID: 1, NodeName: "node1"}, {NodeID: 2, NodeName: "node1"}}}
+	if _, err := p.deployWorkflow("leader1", d); !isQuotaError(err) {
+		t.Errorf("Expected a quota error deploying a third node, got %v", err)
+	}
+	d.WorkflowID = 4
+	if _, err := p.deployWorkflow("leader2", d); err != nil {
+		t.Errorf("Unexpected error deploying for another leader: %v", err)
+	}
+
+	// A workflow deployed over the quota is not kept
+	d.WorkflowID = 5
+	if _, err := p.deployWorkflow("leader2", d); !isQuotaError(err) {
+		t.Errorf("Expected a quota error deploying a third workflow, got %v", err)
+	}
+	if _, err := p.ansible.getLeaders().lookup("leader2", 5); err == nil {
+		t.Error("Expected the workflow over the quota forgotten")
+	}
+}
+
+// TestDataMessage tests that the data passed between followers carries the leader of its workflow
+func TestDataMessage(t *testing.T) {
+	leader, err := peer.Decode("12D3KooWD3eckifWpRn9wQpMG9R9hX3sD158z7EqHWmweQAJU5SA")
+	if err != nil {
+		t.Fatalf("Unexpected error decoding peer ID: %v", err)
+	}
+	edge := hainish.NewEdge(leader, 7, 2, "input1")
+	edge.Value = "value"
+	data, err := json.Marshal(dataMessage{Edge: *edge, Leader: leader})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+
+	var message dataMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatalf("Unexpected error decoding: %v", err)
+	}
+	if message.Leader != leader || message.TargetWorkflowID != 7 || message.TargetPort != "input1" || message.Value != "value" {
+		t.Errorf("Unexpected message %+v", message)
+	}
 }
@@ -1,8 +1,12 @@
 package ansible
 
 import (
+	"errors"
+	"time"
+
 	"github.com/libp2p/go-libp2p/core/network"
-	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/runtime"
 )
 
 func (p *peerManager) handelHeartbeat(s network.Stream) {
@@ -25,13 +29,11 @@ func (p *peerManager) handelHeartbeat(s network.Stream) {
 // The leader's first message to the follower
 // So it identity who is the leader, and we can get the leader's addr
 // The follower should show the leader its identity (the plugin info) in the response
+// A follower may serve several leaders, each with its own workflows
 func (p *peerManager) handelIdentityConfirmation(s network.Stream) {
 	defer s.Close()
 	remotePeer := s.Conn().RemotePeer()
 
-	// This peer is the leader. It's a rule.
-	p.ansible.setLeader(remotePeer)
-
 	// Add a link count for the leader
 	err := p.addLink(remotePeer)
 	if err != nil {
@@ -52,15 +54,22 @@ func (p *peerManager) handelIdentityConfirmation(s network.Stream) {
 func (p *peerManager) handelCreateWorkflow(s network.Stream) {
 	defer s.Close()
 
-	var workflowID int
-	err := readFromStream(s, &workflowID)
+	var message createWorkflowMessage
+	err := readFromStream(s, &message)
 	if err != nil {
 		//TODO log
 		return
 	}
 
-	// Create a workflow
-	p.ansible.getRuntime().InitWorkflow(workflowID)
+	// Create a workflow, a retry with the same key is acknowledged again
+	leader := s.Conn().RemotePeer()
+	createErr := p.createWorkflow(leader, message)
+	ack := createAckMessage{Kind: "workflow", WorkflowID: message.WorkflowID, ID: message.WorkflowID, Key: message.Key}
+	err = p.sendCreateAckToLeader(leader, ack, createErr)
+	if err != nil {
+		//TODO log
+		return
+	}
 }
 
 func (p *peerManager) handelDeleteWorkflow(s network.Stream) {
@@ -74,7 +83,7 @@ func (p *peerManager) handelDeleteWorkflow(s network.Stream) {
 	}
 
 	// Delete a workflow
-	err = p.ansible.getRuntime().DeleteWorkflow(workflowID)
+	err = p.deleteWorkflow(s.Conn().RemotePeer(), workflowID)
 	if err != nil {
 		//TODO log
 		return
@@ -93,8 +102,11 @@ func (p *peerManager) handelCreateNodeProtocol(s network.Stream) {
 		return
 	}
 
-	// Create a node
-	err = p.ansible.getRuntime().CreateRuntimeNode(message.NodeName, message.NodeID, message.WorkflowID)
+	// Create a node, a retry with the same key is acknowledged again
+	leader := s.Conn().RemotePeer()
+	createErr := p.createNode(leader, message)
+	ack := createAckMessage{Kind: "node", WorkflowID: message.WorkflowID, ID: message.NodeID, Key: message.Key}
+	err = p.sendCreateAckToLeader(leader, ack, createErr)
 	if err != nil {
 		//TODO log
 		return
@@ -111,8 +123,14 @@ func (p *peerManager) handelDeleteNodeProtocol(s network.Stream) {
 		return
 	}
 
+	workflowID, err := p.runtimeWorkflowID(s, message.WorkflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
 	// Delete a node
-	err = p.ansible.getRuntime().DeleteNode(message.WorkflowID, message.NodeID)
+	err = p.ansible.getRuntime().DeleteNode(workflowID, message.NodeID)
 	if err != nil {
 		//TODO log
 		return
@@ -131,8 +149,56 @@ func (p *peerManager) handelSetParamProtocol(s network.Stream) {
 		return
 	}
 
-	// Set the param
-	err = p.ansible.getRuntime().SetParam(message.WorkflowID, message.NodeID, message.ParamName, message.ParamValue)
+	// Set the param, the running workflow takes it from the next firing
+	workflowID, setErr := p.runtimeWorkflowID(s, message.WorkflowID)
+	if setErr == nil {
+		setErr = p.ansible.getRuntime().SetParam(workflowID, message.NodeID, message.ParamName, message.ParamValue)
+	}
+	err = p.sendParamAckToLeader(s.Conn().RemotePeer(), message, setErr)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelDeployWorkflowProtocol(s network.Stream) {
+	defer s.Close()
+
+	var deployment runtime.Deployment
+	err := readFromStream(s, &deployment)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Deploy the graph, all of it or nothing
+	leader := s.Conn().RemotePeer()
+	result, deployErr := p.deployWorkflow(leader, deployment)
+	err = p.sendDeployReportToLeader(leader, result, deployErr)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelSetOutputModeProtocol(s network.Stream) {
+	defer s.Close()
+
+	var message setOutputModeMessage
+	err := readFromStream(s, &message)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	workflowID, err := p.runtimeWorkflowID(s, message.WorkflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Set the output mode
+	err = p.ansible.getRuntime().SetOutputMode(workflowID, message.NodeID, message.PortName, runtime.OutputMode(message.Mode))
 	if err != nil {
 		//TODO log
 		return
@@ -141,6 +207,126 @@ func (p *peerManager) handelSetParamProtocol(s network.Stream) {
 	return
 }
 
+func (p *peerManager) handelSetTriggerProtocol(s network.Stream) {
+	defer s.Close()
+
+	var message setTriggerMessage
+	err := readFromStream(s, &message)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	workflowID, err := p.runtimeWorkflowID(s, message.WorkflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Set the trigger
+	err = p.ansible.getRuntime().SetTrigger(workflowID, message.NodeID, message.Trigger)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelSetErrorPolicyProtocol(s network.Stream) {
+	defer s.Close()
+
+	var message setErrorPolicyMessage
+	err := readFromStream(s, &message)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	workflowID, err := p.runtimeWorkflowID(s, message.WorkflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Set the error policy
+	err = p.ansible.getRuntime().SetErrorPolicy(workflowID, message.NodeID, message.Policy)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelSetRestartPolicyProtocol(s network.Stream) {
+	defer s.Close()
+
+	var message setRestartPolicyMessage
+	err := readFromStream(s, &message)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	workflowID, err := p.runtimeWorkflowID(s, message.WorkflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Set the restart policy
+	err = p.ansible.getRuntime().SetRestartPolicy(workflowID, message.NodeID, message.Policy)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelSetTimeoutProtocol(s network.Stream) {
+	defer s.Close()
+
+	var message setTimeoutMessage
+	err := readFromStream(s, &message)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	workflowID, err := p.runtimeWorkflowID(s, message.WorkflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Set the timeout
+	err = p.ansible.getRuntime().SetTimeout(workflowID, message.NodeID, time.Duration(message.Timeout)*time.Millisecond)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelSetConcurrencyProtocol(s network.Stream) {
+	defer s.Close()
+
+	var message setConcurrencyMessage
+	err := readFromStream(s, &message)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	workflowID, err := p.runtimeWorkflowID(s, message.WorkflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Set the concurrency
+	err = p.ansible.getRuntime().SetConcurrency(workflowID, message.NodeID, message.Replicas, message.Ordered)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
 func (p *peerManager) handelCreateEdgeProtocol(s network.Stream) {
 	defer s.Close()
 
@@ -151,8 +337,13 @@ func (p *peerManager) handelCreateEdgeProtocol(s network.Stream) {
 		return
 	}
 
-	// Create an edge
-	err = p.ansible.getRuntime().CreateEdge(message.EdgeID, message.Destination, message.WorkflowID, message.ProducerNodeID, message.ProducerPortName, message.ConsumerNodeID, message.ConsumerPortName)
+	// Create an edge, a retry with the same key is acknowledged again
+	workflowID, createErr := p.runtimeWorkflowID(s, message.WorkflowID)
+	if createErr == nil {
+		createErr = p.ansible.getRuntime().CreateEdgeWithKey(message.Key, message.EdgeID, message.Destination, workflowID, message.ProducerNodeID, message.ProducerPortName, message.ConsumerNodeID, message.ConsumerPortName)
+	}
+	ack := createAckMessage{Kind: "edge", WorkflowID: message.WorkflowID, ID: message.EdgeID, Key: message.Key}
+	err = p.sendCreateAckToLeader(s.Conn().RemotePeer(), ack, createErr)
 	if err != nil {
 		//TODO log
 		return
@@ -169,8 +360,14 @@ func (p *peerManager) handelDeleteEdgeProtocol(s network.Stream) {
 		return
 	}
 
-	// Delete an edge
-	err = p.ansible.getRuntime().DeleteEdge(message.WorkflowID, message.EdgeID)
+	workflowID, err := p.runtimeWorkflowID(s, message.WorkflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Delete an edge, it may be removed from a running workflow
+	err = p.ansible.getRuntime().RemoveEdge(workflowID, message.EdgeID, runtime.EdgeRemoval(message.Removal))
 	if err != nil {
 		//TODO log
 		return
@@ -180,6 +377,14 @@ func (p *peerManager) handelDeleteEdgeProtocol(s network.Stream) {
 }
 
 func (p *peerManager) handelRunWorkflow(s network.Stream) {
+	p.runWorkflow(s, false)
+}
+
+func (p *peerManager) handelForceRunWorkflow(s network.Stream) {
+	p.runWorkflow(s, true)
+}
+
+func (p *peerManager) runWorkflow(s network.Stream, force bool) {
 	defer s.Close()
 
 	var workflowID int
@@ -189,26 +394,74 @@ func (p *peerManager) handelRunWorkflow(s network.Stream) {
 		return
 	}
 
+	owner := workflowOwner{leader: s.Conn().RemotePeer(), workflowID: workflowID}
+	runtimeID, err := p.runtimeWorkflowID(s, workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
 	// Init listener
-	resultChan, errorChan, processChan := p.ansible.initWorkflowListener(workflowID)
+	wl := p.ansible.initWorkflowListener(runtimeID, owner)
 
 	// Run the workflow
-	ctx, err := p.ansible.getRuntime().RunWorkflow(workflowID, resultChan, errorChan, processChan)
+	run := p.ansible.getRuntime().RunWorkflow
+	if force {
+		run = p.ansible.getRuntime().ForceRunWorkflow
+	}
+	ctx, err := run(runtimeID, wl.resultChan, wl.errChan, wl.processChan)
 	if err != nil {
+		// Tell the leader why the workflow can't run
+		var validationErr *runtime.ValidationError
+		if ubikErr, ok := err.(uerr.UbikError); ok && errors.As(ubikErr.MetaError(), &validationErr) {
+			er := p.sendValidationToLeader(owner.leader, workflowID, validationErr.Problems)
+			if er != nil {
+				//TODO log
+			}
+		}
 		//TODO log
 		return
 	}
 
-	// Set the stop context
-	wl := p.ansible.getWorkflowListener(workflowID)
-	if wl == nil {
-		// TODO log
-		return
-	}
+	// Set the stop context, and register the listener of the run
 	wl.setStopContext(ctx)
+	p.ansible.setWorkflowListener(wl)
 
 	// Run the listener
 	go wl.run()
+	// Tell the leader when the workflow goes idle here
+	go wl.termination.run(ctx)
+}
+
+func (p *peerManager) handelValidateWorkflow(s network.Stream) {
+	defer s.Close()
+
+	var workflowID int
+	err := readFromStream(s, &workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	runtimeID, err := p.runtimeWorkflowID(s, workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Validate the workflow
+	problems, err := p.ansible.getRuntime().ValidateWorkflow(runtimeID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Report the problems, even if there is none
+	err = p.sendValidationToLeader(s.Conn().RemotePeer(), workflowID, problems)
+	if err != nil {
+		//TODO log
+		return
+	}
 }
 
 func (p *peerManager) handelStopWorkflow(s network.Stream) {
@@ -221,8 +474,14 @@ func (p *peerManager) handelStopWorkflow(s network.Stream) {
 		return
 	}
 
+	runtimeID, err := p.runtimeWorkflowID(s, workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
 	// Stop the workflow
-	err = p.ansible.getRuntime().StopWorkflow(workflowID)
+	err = p.ansible.getRuntime().StopWorkflow(runtimeID)
 	if err != nil {
 		//TODO log
 		return
@@ -231,20 +490,200 @@ func (p *peerManager) handelStopWorkflow(s network.Stream) {
 	return
 }
 
+func (p *peerManager) handelDrainWorkflow(s network.Stream) {
+	defer s.Close()
+
+	var message drainWorkflowMessage
+	err := readFromStream(s, &message)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	workflowID, err := p.runtimeWorkflowID(s, message.WorkflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Drain the workflow
+	err = p.ansible.getRuntime().DrainWorkflow(workflowID, time.Duration(message.Timeout)*time.Millisecond)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelPauseWorkflow(s network.Stream) {
+	defer s.Close()
+
+	var workflowID int
+	err := readFromStream(s, &workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	runtimeID, err := p.runtimeWorkflowID(s, workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Pause the workflow
+	err = p.ansible.getRuntime().PauseWorkflow(runtimeID)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelResumeWorkflow(s network.Stream) {
+	defer s.Close()
+
+	var workflowID int
+	err := readFromStream(s, &workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	runtimeID, err := p.runtimeWorkflowID(s, workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Resume the workflow
+	err = p.ansible.getRuntime().ResumeWorkflow(runtimeID)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelTriggerWorkflow(s network.Stream) {
+	defer s.Close()
+
+	var workflowID int
+	err := readFromStream(s, &workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	runtimeID, err := p.runtimeWorkflowID(s, workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Fire the manually triggered begin nodes
+	err = p.ansible.getRuntime().TriggerWorkflow(runtimeID)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelQueryState(s network.Stream) {
+	defer s.Close()
+
+	var workflowID int
+	err := readFromStream(s, &workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	runtimeID, err := p.runtimeWorkflowID(s, workflowID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// Query the state
+	state, err := p.ansible.getRuntime().WorkflowState(runtimeID)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	err = p.sendStateToLeader(s.Conn().RemotePeer(), workflowID, state)
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
+func (p *peerManager) handelQueryScheduler(s network.Stream) {
+	defer s.Close()
+
+	err := p.sendSchedulerStatsToLeader(s.Conn().RemotePeer(), p.ansible.getRuntime().SchedulerStats())
+	if err != nil {
+		//TODO log
+		return
+	}
+}
+
 func (p *peerManager) handelPassingDataProtocol(s network.Stream) {
 	defer s.Close()
 
-	var data hainish.Edge
-	err := readFromStream(s, &data)
+	var message dataMessage
+	err := readFromStream(s, &message)
+	if err != nil {
+		//TODO log
+		return
+	}
+
+	// The data is numbered by the leader of the workflow
+	owner := workflowOwner{leader: message.Leader, workflowID: message.TargetWorkflowID}
+	data := message.Edge
+	data.TargetWorkflowID, err = p.ansible.getLeaders().lookup(owner.leader, owner.workflowID)
+
+	// Pass the data to the runtime, and acknowledge it for termination detection
+	from := s.Conn().RemotePeer()
+	deliver := func() {
+		if err == nil {
+			err = p.ansible.getRuntime().PassingProcessDataToRuntimeNode(data)
+		}
+	}
+	ack := true
+	wl := p.ansible.getWorkflowListener(data.TargetWorkflowID)
+	if err == nil && wl != nil && wl.termination != nil {
+		ack = wl.termination.receive(from, deliver)
+	} else {
+		deliver() // Not running here, nothing to wait for
+	}
+	if ack {
+		er := p.sendDataAck(from, owner)
+		if er != nil {
+			//TODO log
+		}
+	}
 	if err != nil {
 		//TODO log
 		return
 	}
+}
 
-	//TODO Passing the data to the runtime
-	err = p.ansible.getRuntime().PassingProcessDataToRuntimeNode(data)
+func (p *peerManager) handelDataAckProtocol(s network.Stream) {
+	defer s.Close()
+
+	var message dataAckMessage
+	err := readFromStream(s, &message)
 	if err != nil {
 		//TODO log
 		return
 	}
+
+	workflowID, err := p.ansible.getLeaders().lookup(message.Leader, message.WorkflowID)
+	if err != nil {
+		return
+	}
+	wl := p.ansible.getWorkflowListener(workflowID)
+	if wl == nil || wl.termination == nil {
+		return
+	}
+	wl.termination.acked()
 }
@@ -0,0 +1,237 @@
+package ansible
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/runtime"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// Quota limits what each leader may create on this follower. 0 means no limit.
+type Quota struct {
+	MaxWorkflows int `json:"MaxWorkflows"`
+	MaxNodes     int `json:"MaxNodes"` // In all the workflows of the leader
+}
+
+// The leader of a workflow, and the workflow's ID given by it
+type workflowOwner struct {
+	leader     peer.ID
+	workflowID int
+}
+
+// leaders lets a follower serve several leaders at once.
+//
+// Each leader numbers its workflows itself, so two leaders may both have a workflow 1.
+// The runtime knows nothing about leaders, so each leader's workflow is given an ID
+// of the runtime, unique on this follower. The commands of a leader are translated
+// to the runtime's IDs, and what is reported about a workflow goes back to its owner
+// with the owner's ID.
+type leaders struct {
+	mu        sync.Mutex
+	workflows map[workflowOwner]int // To the runtime's workflow ID
+	owners    map[int]workflowOwner // From the runtime's workflow ID
+	lastID    int
+	quota     Quota
+
+	createMu sync.Mutex // Held while checking the quota and creating, so two creates don't both fit
+}
+
+func newLeaders() *leaders {
+	return &leaders{
+		workflows: make(map[workflowOwner]int),
+		owners:    make(map[int]workflowOwner),
+	}
+}
+
+func (l *leaders) setQuota(quota Quota) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.quota = quota
+}
+
+// Get the runtime's ID of the leader's workflow
+func (l *leaders) lookup(leader peer.ID, workflowID int) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id, exist := l.workflows[workflowOwner{leader: leader, workflowID: workflowID}]
+	if !exist {
+		return 0, uerr.NewError(fmt.Errorf("%w: workflow %d of leader %s", util.ErrWorkflowNotFound, workflowID, leader))
+	}
+	return id, nil
+}
+
+// Get the runtime's ID for a workflow the leader creates.
+// A new ID is given within the leader's quota, assigned tells whether it is new.
+func (l *leaders) assign(leader peer.ID, workflowID int) (id int, assigned bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owner := workflowOwner{leader: leader, workflowID: workflowID}
+	if id, exist := l.workflows[owner]; exist {
+		return id, false, nil // The runtime tells whether it's a conflict
+	}
+
+	if l.quota.MaxWorkflows > 0 && len(l.workflowsOf(leader)) >= l.quota.MaxWorkflows {
+		return 0, false, uerr.NewError(fmt.Errorf("%w: %d workflows", util.ErrQuotaExceeded, l.quota.MaxWorkflows))
+	}
+
+	l.lastID++
+	l.workflows[owner] = l.lastID
+	l.owners[l.lastID] = owner
+	return l.lastID, true, nil
+}
+
+// Forget a workflow deleted from the runtime
+func (l *leaders) release(id int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owner, exist := l.owners[id]
+	if !exist {
+		return
+	}
+	delete(l.owners, id)
+	delete(l.workflows, owner)
+}
+
+// Get the owner of the runtime's workflow
+func (l *leaders) owner(id int) (workflowOwner, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owner, exist := l.owners[id]
+	return owner, exist
+}
+
+// Get the runtime's IDs of the leader's workflows, the caller holds the lock
+func (l *leaders) workflowsOf(leader peer.ID) []int {
+	var ids []int
+	for owner, id := range l.workflows {
+		if owner.leader == leader {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Check whether the leader may have the nodes in the workflow, with those of its other workflows.
+// nodeCount counts the nodes of a workflow of the runtime. The caller holds createMu.
+func (l *leaders) checkNodes(leader peer.ID, id int, nodes int, nodeCount func(id int) int) error {
+	l.mu.Lock()
+	quota := l.quota
+	ids := l.workflowsOf(leader)
+	l.mu.Unlock()
+	if quota.MaxNodes <= 0 {
+		return nil
+	}
+
+	total := nodes
+	for _, other := range ids {
+		if other != id {
+			total += nodeCount(other)
+		}
+	}
+	if total > quota.MaxNodes {
+		return uerr.NewError(fmt.Errorf("%w: %d nodes", util.ErrQuotaExceeded, quota.MaxNodes))
+	}
+	return nil
+}
+
+// Get the runtime's ID of the workflow, numbered by the leader sending the command
+func (p *peerManager) runtimeWorkflowID(s network.Stream, workflowID int) (int, error) {
+	return p.ansible.getLeaders().lookup(s.Conn().RemotePeer(), workflowID)
+}
+
+func (p *peerManager) nodeCount(id int) int {
+	nodeIDs, _ := p.ansible.getRuntime().NodeIDs(id)
+	return len(nodeIDs)
+}
+
+// Create the leader's workflow within its quota
+func (p *peerManager) createWorkflow(leader peer.ID, message createWorkflowMessage) error {
+	l := p.ansible.getLeaders()
+	id, assigned, err := l.assign(leader, message.WorkflowID)
+	if err != nil {
+		return err
+	}
+
+	err = p.ansible.getRuntime().InitWorkflowWithKey(message.Key, id)
+	if err != nil && assigned {
+		l.release(id)
+	}
+	return err
+}
+
+// Create a node in the leader's workflow within its quota.
+// A node which exists is left to the runtime, it may be a retry.
+func (p *peerManager) createNode(leader peer.ID, message createNodeMessage) error {
+	l := p.ansible.getLeaders()
+	id, err := l.lookup(leader, message.WorkflowID)
+	if err != nil {
+		return err
+	}
+
+	l.createMu.Lock()
+	defer l.createMu.Unlock()
+
+	nodeIDs, err := p.ansible.getRuntime().NodeIDs(id)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(nodeIDs, message.NodeID) {
+		err = l.checkNodes(leader, id, len(nodeIDs)+1, p.nodeCount)
+		if err != nil {
+			return err
+		}
+	}
+	return p.ansible.getRuntime().CreateRuntimeNodeWithKey(message.Key, message.NodeName, message.NodeID, id)
+}
+
+// Deploy the leader's workflow within its quota.
+// The result is numbered by the leader.
+func (p *peerManager) deployWorkflow(leader peer.ID, d runtime.Deployment) (runtime.DeployResult, error) {
+	l := p.ansible.getLeaders()
+	l.createMu.Lock()
+	defer l.createMu.Unlock()
+
+	workflowID := d.WorkflowID
+	id, assigned, err := l.assign(leader, workflowID)
+	if err != nil {
+		return runtime.DeployResult{WorkflowID: workflowID}, err
+	}
+
+	var result runtime.DeployResult
+	err = l.checkNodes(leader, id, len(d.Nodes), p.nodeCount)
+	if err == nil {
+		d.WorkflowID = id
+		result, err = p.ansible.getRuntime().DeployWorkflow(d)
+	}
+	if err != nil && assigned {
+		l.release(id) // The runtime has deleted the workflow it created
+	}
+	result.WorkflowID = workflowID
+	return result, err
+}
+
+// Delete the leader's workflow, and forget it
+func (p *peerManager) deleteWorkflow(leader peer.ID, workflowID int) error {
+	l := p.ansible.getLeaders()
+	id, err := l.lookup(leader, workflowID)
+	if err != nil {
+		return err
+	}
+
+	err = p.ansible.getRuntime().DeleteWorkflow(id)
+	if err != nil {
+		return err
+	}
+	l.release(id)
+	p.ansible.removeWorkflowListener(id)
+	return nil
+}
@@ -1,9 +1,12 @@
 package ansible
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/lvyonghuan/Ubik-Util/uerr"
 )
 
@@ -17,3 +20,28 @@ func readFromStream(s network.Stream, v any) error {
 
 	return nil
 }
+
+// open a stream to the peer and send a message as JSON
+func (p *peerManager) sendMessage(peerID peer.ID, protocol protocol.ID, v any) error {
+	stream, err := p.ansible.host().NewStream(context.Background(), peerID, protocol)
+	if err != nil {
+		if stream != nil {
+			stream.Close()
+		}
+		return uerr.NewError(err)
+	}
+	defer stream.Close()
+
+	// Encode the message to JSON
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		return uerr.NewError(err)
+	}
+	//Send the message
+	_, err = stream.Write(jsonData)
+	if err != nil {
+		return uerr.NewError(err)
+	}
+
+	return nil
+}
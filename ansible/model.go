@@ -1,11 +1,55 @@
 package ansible
 
-import "github.com/libp2p/go-libp2p/core/peer"
+import (
+	"encoding/json"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/runtime"
+)
+
+// The identity of the follower, sent back when the leader confirms itself.
+// The param schemas let the leader render forms for the params.
+type pluginInfoMessage struct {
+	Name        string              `json:"Name"`
+	Description string              `json:"Description"`
+	Version     string              `json:"Version"`
+	Author      string              `json:"Author"`
+	License     string              `json:"License"`
+	Nodes       map[string]nodeInfo `json:"Nodes"` // The key is the node name
+}
+
+type nodeInfo struct {
+	Description string                         `json:"Description"`
+	IsBegin     bool                           `json:"IsBegin"`
+	IsEnd       bool                           `json:"IsEnd"`
+	Inputs      map[string]string              `json:"Inputs"`  // The port name to its type
+	Outputs     map[string]string              `json:"Outputs"` // The port name to its type
+	Params      map[string]hainish.ParamSchema `json:"Params"`
+}
+
+// The leader may send the workflow ID alone, without an idempotency key
+type createWorkflowMessage struct {
+	WorkflowID int    `json:"WorkflowID"`
+	Key        string `json:"Key"` // Lets the leader retry the command, empty if none
+}
+
+func (m *createWorkflowMessage) UnmarshalJSON(data []byte) error {
+	var workflowID int
+	if json.Unmarshal(data, &workflowID) == nil {
+		*m = createWorkflowMessage{WorkflowID: workflowID}
+		return nil
+	}
+
+	type message createWorkflowMessage // Without the method
+	return json.Unmarshal(data, (*message)(m))
+}
 
 type createNodeMessage struct {
 	NodeName   string `json:"NodeName"`
 	NodeID     int    `json:"NodeID"`
 	WorkflowID int    `json:"WorkflowID"`
+	Key        string `json:"Key"` // Lets the leader retry the command, empty if none
 }
 
 type createEdgeMessage struct {
@@ -16,10 +60,23 @@ type createEdgeMessage struct {
 	ProducerPortName string  `json:"producerPortName"`
 	ConsumerNodeID   int     `json:"consumerNodeID"`
 	ConsumerPortName string  `json:"consumerPortName"`
+	Key              string  `json:"Key"` // Lets the leader retry the command, empty if none
+}
+
+// Whether a workflow, node or edge has been created, or why not.
+// A retried command is acknowledged again.
+type createAckMessage struct {
+	Kind       string `json:"Kind"` // "workflow", "node" or "edge"
+	WorkflowID int    `json:"WorkflowID"`
+	ID         int    `json:"ID"`
+	Key        string `json:"Key"`
+	Error      string `json:"Error"`
+	Conflict   bool   `json:"Conflict"` // The ID already exists
 }
 
 type logMessage struct {
 	Level   int    `json:"level"`
+	RunID   string `json:"runID"` // Empty if the log is not about a run
 	Message string `json:"message"`
 }
 
@@ -35,7 +92,121 @@ type setParamMessage struct {
 	ParamValue any    `json:"ParamValue"`
 }
 
+// Sent after a param set, Error is empty if it has been applied
+type paramAckMessage struct {
+	WorkflowID int    `json:"WorkflowID"`
+	NodeID     int    `json:"NodeID"`
+	ParamName  string `json:"ParamName"`
+	ParamValue any    `json:"ParamValue"`
+	Error      string `json:"Error"`
+}
+
+// What a deployment has changed, or why nothing has
+type deployReportMessage struct {
+	WorkflowID int                  `json:"WorkflowID"`
+	Result     runtime.DeployResult `json:"Result"`
+	Error      string               `json:"Error"`
+}
+
+type setOutputModeMessage struct {
+	WorkflowID int    `json:"WorkflowID"`
+	NodeID     int    `json:"NodeID"`
+	PortName   string `json:"PortName"`
+	Mode       int    `json:"Mode"` // 0: broadcast, 1: round-robin
+}
+
 type deleteEdgeMessage struct {
 	WorkflowID int `json:"WorkflowID"`
 	EdgeID     int `json:"EdgeID"`
+	Removal    int `json:"Removal"` // 0: send the values on the way, 1: drop them
+}
+
+type validationMessage struct {
+	WorkflowID int               `json:"WorkflowID"`
+	Problems   []runtime.Problem `json:"Problems"`
+}
+
+// Data passed to a follower, for the workflow of the leader
+type dataMessage struct {
+	hainish.Edge
+	Leader peer.ID `json:"Leader"`
+}
+
+// Acknowledges data passed for the workflow of the leader
+type dataAckMessage struct {
+	Leader     peer.ID `json:"Leader"`
+	WorkflowID int     `json:"WorkflowID"`
+}
+
+// The result of a node's execution, uploaded to the leader
+type resultMessage struct {
+	WorkflowID int    `json:"WorkflowID"`
+	NodeID     int    `json:"NodeID"`
+	NodeName   string `json:"NodeName"`
+	RunID      string `json:"RunID"`
+	Name       string `json:"Name"`      // Empty unless the node emits named results
+	Timestamp  int64  `json:"Timestamp"` // Unix milliseconds
+	Duration   int64  `json:"Duration"`  // In microseconds
+	Codec      string `json:"Codec"`     // How Value is encoded
+	Value      []byte `json:"Value"`
+}
+
+// Sent by a follower when it leaves the activity of a workflow (Idle),
+// or joins it again by itself. The workflow is idle when every follower
+// the leader has run it on, or has heard active from, has reported idle.
+type activityMessage struct {
+	WorkflowID int  `json:"WorkflowID"`
+	Idle       bool `json:"Idle"`
+}
+
+type setTriggerMessage struct {
+	WorkflowID int             `json:"WorkflowID"`
+	NodeID     int             `json:"NodeID"`
+	Trigger    hainish.Trigger `json:"Trigger"`
+}
+
+type setErrorPolicyMessage struct {
+	WorkflowID int                 `json:"WorkflowID"`
+	NodeID     int                 `json:"NodeID"`
+	Policy     runtime.ErrorPolicy `json:"Policy"`
+}
+
+// Sent for every error a node's action returns, with what the runtime does next
+type errorDecisionMessage struct {
+	WorkflowID int             `json:"WorkflowID"`
+	NodeID     int             `json:"NodeID"`
+	RunID      string          `json:"RunID"`
+	Attempt    int             `json:"Attempt"`
+	Decision   string          `json:"Decision"` // Empty when the input is skipped
+	Error      string          `json:"Error"`
+	Inputs     json.RawMessage `json:"Inputs"` // The dead-lettered input, encoded in JSON if it can be
+}
+
+type setRestartPolicyMessage struct {
+	WorkflowID int                   `json:"WorkflowID"`
+	NodeID     int                   `json:"NodeID"`
+	Policy     runtime.RestartPolicy `json:"Policy"`
+}
+
+type setTimeoutMessage struct {
+	WorkflowID int `json:"WorkflowID"`
+	NodeID     int `json:"NodeID"`
+	Timeout    int `json:"Timeout"` // In milliseconds, 0 means no limit
+}
+
+type setConcurrencyMessage struct {
+	WorkflowID int  `json:"WorkflowID"`
+	NodeID     int  `json:"NodeID"`
+	Replicas   int  `json:"Replicas"`
+	Ordered    bool `json:"Ordered"` // Keep the outputs in the order of the runs
+}
+
+type drainWorkflowMessage struct {
+	WorkflowID int `json:"WorkflowID"`
+	Timeout    int `json:"Timeout"` // In milliseconds, must be positive
+}
+
+type workflowStateMessage struct {
+	WorkflowID int    `json:"WorkflowID"`
+	State      string `json:"State"`
 }
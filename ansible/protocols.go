@@ -3,19 +3,44 @@ package ansible
 const (
 	heartbeatProtocol = "/ansible/heartbeat/1.0.0" //heartbeat protocol
 
-	identityConfirmationProtocol = "/ansible/leader/identity/1.0.0"        // Leader's first message to followers. Leader -> Followers
-	createWorkflow               = "/ansible/leader/workflow/create/1.0.0" // Create a workflow. Leader -> Followers
-	deleteWorkflow               = "/ansible/leader/workflow/delete/1.0.0" // Delete a workflow. Leader -> Followers
-	createNodeProtocol           = "/ansible/leader/node/create/1.0.0"     // Create a node. Leader -> Followers
-	deleteNodeProtocol           = "/ansible/leader/node/delete/1.0.0"     // Delete a node. Leader -> Followers
-	setParamProtocol             = "/ansible/leader/node/param/1.0.0"      // Set a node's parameter. Leader -> Followers
-	createEdgeProtocol           = "/ansible/leader/edge/create/1.0.0"     // Create an edge. Leader -> Followers
-	deleteEdgeProtocol           = "/ansible/leader/edge/delete/1.0.0"     // Delete an edge. Leader -> Followers
-	runWorkflowProtocol          = "ansible/leader/workflow/run/1.0.0"     // Run a workflow. Leader -> Followers
-	stopWorkflowProtocol         = "ansible/leader/workflow/stop/1.0.0"    // Stop a workflow. Leader -> Followers
+	identityConfirmationProtocol = "/ansible/leader/identity/1.0.0"          // Leader's first message to followers. Leader -> Followers
+	createWorkflow               = "/ansible/leader/workflow/create/1.0.0"   // Create a workflow. Leader -> Followers
+	deleteWorkflow               = "/ansible/leader/workflow/delete/1.0.0"   // Delete a workflow. Leader -> Followers
+	createNodeProtocol           = "/ansible/leader/node/create/1.0.0"       // Create a node. Leader -> Followers
+	deleteNodeProtocol           = "/ansible/leader/node/delete/1.0.0"       // Delete a node. Leader -> Followers
+	setParamProtocol             = "/ansible/leader/node/param/1.0.0"        // Set a node's parameter. Leader -> Followers
+	setOutputModeProtocol        = "/ansible/leader/node/output/1.0.0"       // Set an output port's fan-out mode. Leader -> Followers
+	setTriggerProtocol           = "/ansible/leader/node/trigger/1.0.0"      // Set a begin node's trigger. Leader -> Followers
+	setErrorPolicyProtocol       = "/ansible/leader/node/error/1.0.0"        // Set what a node does when its action fails. Leader -> Followers
+	setRestartPolicyProtocol     = "/ansible/leader/node/restart/1.0.0"      // Set what a node does when it panics. Leader -> Followers
+	setTimeoutProtocol           = "/ansible/leader/node/timeout/1.0.0"      // Set how long a node's action may take. Leader -> Followers
+	setConcurrencyProtocol       = "/ansible/leader/node/concurrency/1.0.0"  // Set how many executions of a node run at the same time. Leader -> Followers
+	createEdgeProtocol           = "/ansible/leader/edge/create/1.0.0"       // Create an edge. Leader -> Followers
+	deleteEdgeProtocol           = "/ansible/leader/edge/delete/1.0.0"       // Delete an edge. Leader -> Followers
+	runWorkflowProtocol          = "ansible/leader/workflow/run/1.0.0"       // Run a workflow. Leader -> Followers
+	forceRunWorkflowProtocol     = "ansible/leader/workflow/run/force/1.0.0" // Run a workflow without validating it. Leader -> Followers
+	validateWorkflowProtocol     = "/ansible/leader/workflow/validate/1.0.0" // Validate a workflow. Leader -> Followers
+	stopWorkflowProtocol         = "ansible/leader/workflow/stop/1.0.0"      // Stop a workflow. Leader -> Followers
+	drainWorkflowProtocol        = "/ansible/leader/workflow/drain/1.0.0"    // Stop a workflow after the data in it has flowed out. Leader -> Followers
+	pauseWorkflowProtocol        = "/ansible/leader/workflow/pause/1.0.0"    // Pause a workflow. Leader -> Followers
+	resumeWorkflowProtocol       = "/ansible/leader/workflow/resume/1.0.0"   // Resume a paused workflow. Leader -> Followers
+	queryStateProtocol           = "/ansible/leader/workflow/state/1.0.0"    // Query a workflow's state. Leader -> Followers
+	triggerWorkflowProtocol      = "/ansible/leader/workflow/trigger/1.0.0"  // Fire the manually triggered begin nodes. Leader -> Followers
+	querySchedulerProtocol       = "/ansible/leader/scheduler/query/1.0.0"   // Query a follower's scheduling statistics. Leader -> Followers
+	deployWorkflowProtocol       = "/ansible/leader/workflow/deploy/1.0.0"   // Deploy a workflow's whole graph at once. Leader -> Followers
 
-	logUploadProtocol    = "ansible/follower/log/1.0.0"    // Followers upload logs to Leader. Followers -> Leader
-	resultUploadProtocol = "ansible/follower/result/1.0.0" // Followers upload results to Leader. Followers -> Leader
+	logUploadProtocol       = "ansible/follower/log/1.0.0"        // Followers upload logs to Leader. Followers -> Leader
+	resultUploadProtocol    = "ansible/follower/result/1.0.0"     // Followers upload results to Leader. Followers -> Leader
+	validationProtocol      = "ansible/follower/validation/1.0.0" // Followers report workflow problems to Leader. Followers -> Leader
+	stateReportProtocol     = "ansible/follower/state/1.0.0"      // Followers report a workflow's state to Leader. Followers -> Leader
+	completionProtocol      = "ansible/follower/completion/1.0.0" // Followers report a workflow completed with its statistics. Followers -> Leader
+	activityProtocol        = "ansible/follower/activity/1.0.0"   // Followers report leaving or joining a workflow's activity. Followers -> Leader
+	schedulerReportProtocol = "ansible/follower/scheduler/1.0.0"  // Followers report their scheduling statistics to Leader. Followers -> Leader
+	errorDecisionProtocol   = "ansible/follower/error/1.0.0"      // Followers report a node's error and what its error policy decided. Followers -> Leader
+	paramAckProtocol        = "ansible/follower/param/ack/1.0.0"  // Followers acknowledge a param set, or tell why it was rejected. Followers -> Leader
+	deployReportProtocol    = "ansible/follower/deploy/1.0.0"     // Followers report what a deployment changed, or why it was rolled back. Followers -> Leader
+	createAckProtocol       = "ansible/follower/create/ack/1.0.0" // Followers acknowledge a workflow, node or edge created, or tell why not. Followers -> Leader
 
-	passingDataProtocol = "ansible/follower/data/1.0.0" // Followers pass data to each other. Followers -> Followers
+	passingDataProtocol = "ansible/follower/data/1.0.0"     // Followers pass data to each other. Followers -> Followers
+	dataAckProtocol     = "ansible/follower/data/ack/1.0.0" // Followers acknowledge the data for termination detection. Followers -> Followers
 )
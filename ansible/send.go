@@ -3,10 +3,12 @@ package ansible
 import (
 	"context"
 	"encoding/json"
+	"errors"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/lvyonghuan/Ubik-Util/uerr"
 	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/runtime"
 )
 
 func (p *peerManager) sendHeartbeat(peerID peer.ID) error {
@@ -38,7 +40,7 @@ func (p *peerManager) sendPluginInfoToLeader(leaderID peer.ID) error {
 	defer stream.Close()
 
 	// Encode the plugin metadata to JSON and send it
-	jsonData, err := json.Marshal(p.ansible)
+	jsonData, err := json.Marshal(newPluginInfoMessage(p.ansible.getPluginMetadata()))
 	if err != nil {
 		return uerr.NewError(err)
 	}
@@ -52,7 +54,44 @@ func (p *peerManager) sendPluginInfoToLeader(leaderID peer.ID) error {
 	return nil
 }
 
-func (p *peerManager) sendProcessDataToFollower(data hainish.Edge) error {
+func newPluginInfoMessage(plugin hainish.Plugin) pluginInfoMessage {
+	message := pluginInfoMessage{
+		Name:        plugin.Name(),
+		Description: plugin.Description(),
+		Version:     plugin.Version(),
+		Author:      plugin.Author(),
+		License:     plugin.License(),
+		Nodes:       make(map[string]nodeInfo),
+	}
+
+	portTypes := func(ports map[string]hainish.Port) map[string]string {
+		types := make(map[string]string)
+		for name, port := range ports {
+			types[name] = port.Type()
+		}
+		return types
+	}
+	for name, node := range plugin.Nodes() {
+		info := nodeInfo{
+			Description: node.Description(),
+			IsBegin:     node.IsBegin(),
+			IsEnd:       hainish.NodeIsEnd(node),
+			Inputs:      portTypes(node.Inputs()),
+			Outputs:     portTypes(node.Outputs()),
+			Params:      make(map[string]hainish.ParamSchema),
+		}
+		for portName, port := range node.Params() {
+			info.Params[portName] = hainish.PortSchema(port)
+		}
+		message.Nodes[name] = info
+	}
+	return message
+}
+
+// The runtime numbers the workflow in the data by its own ID,
+// the follower receiving it knows the workflow by its owner
+func (p *peerManager) sendProcessDataToFollower(owner workflowOwner, data hainish.Edge) error {
+	data.TargetWorkflowID = owner.workflowID
 	stream, err := p.ansible.host().NewStream(context.Background(), data.Destination, passingDataProtocol)
 	if err != nil {
 		if stream != nil {
@@ -63,7 +102,7 @@ func (p *peerManager) sendProcessDataToFollower(data hainish.Edge) error {
 
 	defer stream.Close()
 	// Encode the data to JSON
-	jsonData, err := json.Marshal(data)
+	jsonData, err := json.Marshal(dataMessage{Edge: data, Leader: owner.leader})
 	if err != nil {
 		return uerr.NewError(err)
 	}
@@ -76,8 +115,8 @@ func (p *peerManager) sendProcessDataToFollower(data hainish.Edge) error {
 	return nil
 }
 
-func (p *peerManager) sendLogToLeader(level int, message string) error {
-	stream, err := p.ansible.host().NewStream(context.Background(), p.ansible.getLeader(), logUploadProtocol)
+func (p *peerManager) sendLogToLeader(leader peer.ID, level int, runID string, message string) error {
+	stream, err := p.ansible.host().NewStream(context.Background(), leader, logUploadProtocol)
 	if err != nil {
 		if stream != nil {
 			stream.Close()
@@ -88,6 +127,7 @@ func (p *peerManager) sendLogToLeader(level int, message string) error {
 	defer stream.Close()
 	logMsg := logMessage{
 		Level:   level,
+		RunID:   runID,
 		Message: message,
 	}
 
@@ -105,26 +145,132 @@ func (p *peerManager) sendLogToLeader(level int, message string) error {
 	return nil
 }
 
-func (p *peerManager) sendResultToLeader(result any) error {
-	stream, err := p.ansible.host().NewStream(context.Background(), p.ansible.getLeader(), resultUploadProtocol)
+func (p *peerManager) sendResultToLeader(leader peer.ID, result runtime.Result) error {
+	message, err := newResultMessage(result)
 	if err != nil {
-		if stream != nil {
-			stream.Close()
-		}
-		return uerr.NewError(err)
+		return err
 	}
 
-	defer stream.Close()
-	// Encode the data to JSON
-	jsonData, err := json.Marshal(result)
+	return p.sendMessage(leader, resultUploadProtocol, message)
+}
+
+// Put the result into the message, with its value encoded by the codec
+func newResultMessage(result runtime.Result) (resultMessage, error) {
+	codec := result.Codec
+	if codec == nil {
+		codec = hainish.JSONCodec{}
+	}
+
+	value, err := codec.Encode(result.Value)
 	if err != nil {
-		return uerr.NewError(err)
+		return resultMessage{}, uerr.NewError(err)
+	}
+
+	return resultMessage{
+		WorkflowID: result.WorkflowID,
+		NodeID:     result.NodeID,
+		NodeName:   result.NodeName,
+		RunID:      result.RunID,
+		Name:       result.Name,
+		Timestamp:  result.Timestamp.UnixMilli(),
+		Duration:   result.Duration.Microseconds(),
+		Codec:      codec.Name(),
+		Value:      value,
+	}, nil
+}
+
+func (p *peerManager) sendValidationToLeader(leader peer.ID, workflowID int, problems []runtime.Problem) error {
+	return p.sendMessage(leader, validationProtocol, validationMessage{
+		WorkflowID: workflowID,
+		Problems:   problems,
+	})
+}
+
+func (p *peerManager) sendStateToLeader(leader peer.ID, workflowID int, state runtime.WorkflowState) error {
+	return p.sendMessage(leader, stateReportProtocol, workflowStateMessage{
+		WorkflowID: workflowID,
+		State:      state.String(),
+	})
+}
+
+func (p *peerManager) sendSchedulerStatsToLeader(leader peer.ID, stats runtime.SchedulerStats) error {
+	return p.sendMessage(leader, schedulerReportProtocol, stats)
+}
+
+func (p *peerManager) sendParamAckToLeader(leader peer.ID, message setParamMessage, err error) error {
+	ack := paramAckMessage{
+		WorkflowID: message.WorkflowID,
+		NodeID:     message.NodeID,
+		ParamName:  message.ParamName,
+		ParamValue: message.ParamValue,
 	}
-	//Send the data
-	_, err = stream.Write(jsonData)
 	if err != nil {
-		return uerr.NewError(err)
+		ack.Error = err.Error()
 	}
+	return p.sendMessage(leader, paramAckProtocol, ack)
+}
 
-	return nil
+func (p *peerManager) sendCreateAckToLeader(leader peer.ID, ack createAckMessage, err error) error {
+	if err != nil {
+		ack.Error = err.Error()
+		var conflictErr *runtime.ConflictError
+		if ubikErr, ok := err.(uerr.UbikError); ok && errors.As(ubikErr.MetaError(), &conflictErr) {
+			ack.Conflict = true
+		}
+	}
+	return p.sendMessage(leader, createAckProtocol, ack)
+}
+
+func (p *peerManager) sendDeployReportToLeader(leader peer.ID, result runtime.DeployResult, err error) error {
+	report := deployReportMessage{
+		WorkflowID: result.WorkflowID,
+		Result:     result,
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return p.sendMessage(leader, deployReportProtocol, report)
+}
+
+func (p *peerManager) sendCompletionToLeader(leader peer.ID, summary runtime.CompletionSummary) error {
+	return p.sendMessage(leader, completionProtocol, summary)
+}
+
+func (p *peerManager) sendDataAck(peerID peer.ID, owner workflowOwner) error {
+	return p.sendMessage(peerID, dataAckProtocol, dataAckMessage{
+		Leader:     owner.leader,
+		WorkflowID: owner.workflowID,
+	})
+}
+
+func (p *peerManager) sendActivityToLeader(owner workflowOwner, idle bool) error {
+	return p.sendMessage(owner.leader, activityProtocol, activityMessage{
+		WorkflowID: owner.workflowID,
+		Idle:       idle,
+	})
+}
+
+func (p *peerManager) sendErrorDecisionToLeader(owner workflowOwner, runErr *runtime.RunError) error {
+	message := newErrorDecisionMessage(runErr)
+	message.WorkflowID = owner.workflowID
+	return p.sendMessage(owner.leader, errorDecisionProtocol, message)
+}
+
+// The decision is reported even if the dead-lettered input can't be encoded
+func newErrorDecisionMessage(runErr *runtime.RunError) errorDecisionMessage {
+	message := errorDecisionMessage{
+		WorkflowID: runErr.WorkflowID,
+		NodeID:     runErr.NodeID,
+		RunID:      runErr.RunID,
+		Attempt:    runErr.Attempt,
+		Decision:   string(runErr.Decision),
+		Error:      runErr.Err.Error(),
+	}
+	if runErr.Inputs != nil {
+		inputs, err := json.Marshal(runErr.Inputs)
+		if err == nil {
+			message.Inputs = inputs
+		}
+	}
+	return message
 }
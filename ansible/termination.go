@@ -0,0 +1,162 @@
+package ansible
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// How often an engaged follower checks whether it has gone idle
+const idleCheckInterval = 10 * time.Millisecond
+
+// termination detects when a workflow goes idle across followers,
+// in the style of Dijkstra–Scholten, with the leader as the root.
+//
+// A follower is engaged when the leader runs the workflow on it, or when it
+// receives data while not engaged. The peer that engaged it is its parent.
+// Every other data message is acknowledged at once. An engaged follower which is
+// quiet, and whose data sent has all been acknowledged, leaves the engagement by
+// acknowledging its parent. When the parent is the leader, the acknowledgement
+// is an idle report.
+//
+// A follower which becomes active by itself, e.g. a begin node's timer firing,
+// engages with the leader as its parent and reports itself active. So the leader
+// knows the workflow is idle when every follower engaged with it has reported idle.
+type termination struct {
+	workflowID int
+	leader     peer.ID
+
+	mu        sync.Mutex
+	engaged   bool
+	parent    peer.ID
+	deficit   int // Data sent and not acknowledged yet
+	receiving int // Data being delivered to the runtime
+
+	// Only used by the checker
+	wasQuiet    bool
+	lastCounter uint64
+
+	stopContext context.Context
+
+	activity     func() (quiet bool, counter uint64) // The local activity of the workflow
+	sendAck      func(to peer.ID) error              // Acknowledge data to a follower
+	sendActivity func(idle bool) error               // Report to the leader
+}
+
+func newTermination(workflowID int, leader peer.ID, activity func() (bool, uint64), sendAck func(peer.ID) error, sendActivity func(bool) error) *termination {
+	return &termination{
+		workflowID:   workflowID,
+		leader:       leader,
+		engaged:      true, // The leader runs the workflow
+		parent:       leader,
+		stopContext:  context.Background(),
+		activity:     activity,
+		sendAck:      sendAck,
+		sendActivity: sendActivity,
+	}
+}
+
+// Check whether the follower is idle until the workflow stops
+func (t *termination) run(stopContext context.Context) {
+	t.mu.Lock()
+	t.stopContext = stopContext
+	t.mu.Unlock()
+
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.check()
+		case <-stopContext.Done():
+			return
+		}
+	}
+}
+
+// Leave the engagement if nothing has happened since the last check
+func (t *termination) check() {
+	t.mu.Lock()
+	if !t.engaged || t.deficit > 0 || t.receiving > 0 {
+		t.wasQuiet = false
+		t.mu.Unlock()
+		return
+	}
+
+	quiet, counter := t.activity()
+	if !quiet || !t.wasQuiet || counter != t.lastCounter {
+		t.wasQuiet, t.lastCounter = quiet, counter
+		t.mu.Unlock()
+		return
+	}
+
+	t.engaged, t.wasQuiet = false, false
+	parent := t.parent
+	t.mu.Unlock()
+
+	var err error
+	if parent == t.leader {
+		err = t.sendActivity(true)
+	} else {
+		err = t.sendAck(parent)
+	}
+	if err != nil {
+		// TODO: 处理错误
+	}
+}
+
+// Called before the follower sends anything out of the workflow.
+// A follower not engaged has become active by itself.
+func (t *termination) activate() {
+	t.mu.Lock()
+	if t.engaged {
+		t.mu.Unlock()
+		return
+	}
+	t.engaged, t.parent = true, t.leader
+	t.mu.Unlock()
+
+	err := t.sendActivity(false)
+	if err != nil {
+		// TODO: 处理错误
+	}
+}
+
+// Called before data is sent to a follower
+func (t *termination) sent() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.deficit++
+}
+
+// Called when a follower acknowledges data, or the data failed to be sent
+func (t *termination) acked() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.deficit > 0 {
+		t.deficit--
+	}
+}
+
+// Deliver data from a follower to the runtime.
+// Return true if the data should be acknowledged at once.
+func (t *termination) receive(from peer.ID, deliver func()) bool {
+	t.mu.Lock()
+	t.receiving++
+	t.mu.Unlock()
+
+	deliver()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.receiving--
+
+	// A stopped workflow won't report, so the sender shouldn't wait for it
+	if t.stopContext.Err() != nil || t.engaged {
+		return true
+	}
+	t.engaged, t.parent = true, from
+	return false
+}
@@ -2,15 +2,19 @@ package ansible
 
 import (
 	"context"
+	"errors"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/lvyonghuan/Ubik-Util/ulog"
 	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/runtime"
 )
 
 // Handel workflow
 
 type workflowListener struct {
-	workflowID int
+	workflowID int           // The runtime's
+	owner      workflowOwner // Where the results and logs go
 
 	resultChan  chan any
 	errChan     chan error
@@ -18,24 +22,51 @@ type workflowListener struct {
 
 	stopContext context.Context
 
+	termination *termination
+
 	ansible Ansible
 }
 
-func (asb *ImplAnsible) initWorkflowListener(workflowID int) (chan any, chan error, chan hainish.Edge) {
+// Create the listener of a run of the workflow, it's registered once the workflow runs
+func (asb *ImplAnsible) initWorkflowListener(workflowID int, owner workflowOwner) *workflowListener {
 	var wl workflowListener
 	wl.workflowID = workflowID
+	wl.owner = owner
 	wl.ansible = asb
 
 	wl.resultChan = make(chan any, 1)
 	wl.errChan = make(chan error, 1)
 	wl.processChan = make(chan hainish.Edge, 1)
 
-	wl.ansible = asb
+	// The workflow is engaged with the leader when it runs
+	p := asb.getPeerManager()
+	wl.termination = newTermination(workflowID, owner.leader,
+		func() (bool, uint64) {
+			quiet, counter, err := asb.getRuntime().Activity(workflowID)
+			return quiet && err == nil, counter
+		},
+		func(to peer.ID) error { return p.sendDataAck(to, owner) },
+		func(idle bool) error { return p.sendActivityToLeader(owner, idle) },
+	)
+
+	return &wl
+}
 
-	return wl.resultChan, wl.errChan, wl.processChan
+// Replace the listener of the last run.
+// A run which failed to start must not replace the listener of the running one,
+// whose termination detector takes the data and its acknowledgements.
+func (asb *ImplAnsible) setWorkflowListener(wl *workflowListener) {
+	asb.wfListenerMu.Lock()
+	defer asb.wfListenerMu.Unlock()
+	if asb.wfListener == nil {
+		asb.wfListener = make(map[int]workflowListener)
+	}
+	asb.wfListener[wl.workflowID] = *wl
 }
 
 func (asb *ImplAnsible) getWorkflowListener(workflowID int) *workflowListener {
+	asb.wfListenerMu.Lock()
+	defer asb.wfListenerMu.Unlock()
 	wl, exist := asb.wfListener[workflowID]
 	if !exist {
 		return nil
@@ -43,31 +74,90 @@ func (asb *ImplAnsible) getWorkflowListener(workflowID int) *workflowListener {
 	return &wl
 }
 
+// Forget the listener of a deleted workflow
+func (asb *ImplAnsible) removeWorkflowListener(workflowID int) {
+	asb.wfListenerMu.Lock()
+	defer asb.wfListenerMu.Unlock()
+	delete(asb.wfListener, workflowID)
+}
+
 func (workflowListener *workflowListener) setStopContext(c context.Context) {
 	workflowListener.stopContext = c
 }
 
 func (workflowListener *workflowListener) run() {
+	r := workflowListener.ansible.getRuntime()
+
 	// Listen result and error
 	for {
 		select {
 		case processData := <-workflowListener.processChan:
-			err := workflowListener.ansible.getPeerManager().sendProcessDataToFollower(processData)
+			workflowListener.termination.activate()
+			workflowListener.termination.sent()
+			err := workflowListener.ansible.getPeerManager().sendProcessDataToFollower(workflowListener.owner, processData)
 			if err != nil {
+				workflowListener.termination.acked() // Never arrives
 				// TODO: 处理错误
 			}
 		case err := <-workflowListener.errChan:
-			er := workflowListener.ansible.getPeerManager().sendLogToLeader(ulog.Error, err.Error())
+			workflowListener.termination.activate()
+			// Tell the leader which run the error happened in
+			var runID string
+			var runErr *runtime.RunError
+			if errors.As(err, &runErr) {
+				runID = runErr.RunID
+			}
+			er := workflowListener.ansible.getPeerManager().sendLogToLeader(workflowListener.owner.leader, ulog.Error, runID, err.Error())
 			if er != nil {
 				// TODO: 处理这个错误
 			}
+			// Tell the leader what the node's error policy decided
+			if runErr != nil {
+				er = workflowListener.ansible.getPeerManager().sendErrorDecisionToLeader(workflowListener.owner, runErr)
+				if er != nil {
+					// TODO: 处理这个错误
+				}
+			}
 		case result := <-workflowListener.resultChan:
-			err := workflowListener.ansible.getPeerManager().sendResultToLeader(result)
+			workflowListener.termination.activate()
+			// The runtime always wraps the results, a bare value is sent as it is
+			r, ok := result.(runtime.Result)
+			if !ok {
+				r = runtime.Result{Value: result}
+			}
+			r.WorkflowID = workflowListener.owner.workflowID
+			err := workflowListener.ansible.getPeerManager().sendResultToLeader(workflowListener.owner.leader, r)
 			if err != nil {
 				// TODO: 处理错误
 			}
 		case <-workflowListener.stopContext.Done():
 			return
 		}
+
+		// Tell the runtime the value is handled, so a draining workflow knows when it's quiet
+		r.AckOutput(workflowListener.workflowID)
+	}
+}
+
+// A workflow passing data between its nodes on this follower is active,
+// like one sending data out of it
+func (p *peerManager) handelLocalActivity(workflowID int) {
+	wl := p.ansible.getWorkflowListener(workflowID)
+	if wl == nil || wl.termination == nil {
+		return
+	}
+	wl.termination.activate()
+}
+
+// Report a workflow completed on this follower to its leader
+func (p *peerManager) handelCompletion(summary runtime.CompletionSummary) {
+	owner, exist := p.ansible.getLeaders().owner(summary.WorkflowID)
+	if !exist {
+		return // Deleted
+	}
+	summary.WorkflowID = owner.workflowID
+	err := p.sendCompletionToLeader(owner.leader, summary)
+	if err != nil {
+		// TODO: 处理错误
 	}
 }
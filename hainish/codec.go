@@ -0,0 +1,45 @@
+package hainish
+
+import "encoding/json"
+
+// Codec encodes the values of a port when they leave the follower.
+type Codec interface {
+	Name() string
+	Encode(v any) ([]byte, error)
+	Decode(data []byte, v any) error
+}
+
+// CodecPort is a Port which declares its codec.
+// A port without a codec uses JSONCodec.
+type CodecPort interface {
+	Port
+
+	Codec() Codec
+}
+
+// JSONCodec is the default codec.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Encode(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// PortCodec returns the codec of the port.
+func PortCodec(port Port) Codec {
+	if codecPort, ok := port.(CodecPort); ok && codecPort.Codec() != nil {
+		return codecPort.Codec()
+	}
+	return JSONCodec{}
+}
+
+// Results lets a node emit several named results in one execution.
+// A result named after an output port is encoded with that port's codec.
+type Results map[string]any
@@ -0,0 +1,63 @@
+package hainish
+
+import (
+	"context"
+	"time"
+)
+
+// ContextNode is a Node whose action also receives a context.
+// The context carries the run ID of the firing, and is cancelled when the workflow stops.
+type ContextNode interface {
+	Node
+
+	ActionContext(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error)
+}
+
+// TimeoutNode is a Node which declares how long an execution of its action may take.
+// When the time is up, the context of ActionContext is cancelled and the execution
+// is recorded as failed. The leader may override the timeout.
+type TimeoutNode interface {
+	Node
+
+	Timeout() time.Duration // 0 means no limit
+}
+
+// SerialNode is a Node which declares whether its action is unsafe to run concurrently,
+// e.g. because it keeps state between firings. Such a node always runs a single replica.
+type SerialNode interface {
+	Node
+
+	Serial() bool
+}
+
+// StreamingNode is a Node which declares whether its action streams its outputs,
+// e.g. because it runs for long and writes as it goes. The values are sent on as they
+// are written, rather than when the action returns. So what a failed execution wrote
+// has been sent already, and the outputs of concurrent firings are not kept in order.
+type StreamingNode interface {
+	Node
+
+	Streaming() bool
+}
+
+// ParamNode is a Node which is told when one of its params is set.
+// The hook is called by whoever sets the param, so it may run while the action executes.
+// The new value is taken by the next firing either way.
+type ParamNode interface {
+	Node
+
+	ParamChanged(name string, value any)
+}
+
+type runIDKey struct{}
+
+// WithRunID returns a copy of the context carrying the run ID.
+func WithRunID(c context.Context, runID string) context.Context {
+	return context.WithValue(c, runIDKey{}, runID)
+}
+
+// RunID returns the run ID carried by the context, or "" if there is none.
+func RunID(c context.Context) string {
+	runID, _ := c.Value(runIDKey{}).(string)
+	return runID
+}
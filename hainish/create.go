@@ -1,5 +1,10 @@
 package hainish
 
+import (
+	"context"
+	"time"
+)
+
 type ImplPlugin struct {
 	PluginName        string `json:"name"`
 	PluginDescription string `json:"description"`
@@ -46,14 +51,24 @@ func (i ImplPlugin) Nodes() map[string]Node {
 }
 
 type ImplNode struct {
-	NodeName        string `json:"name"`
-	NodeDescription string `json:"description"`
-	IsBeginNode     bool   `json:"is_begin"`
+	NodeName        string  `json:"name"`
+	NodeDescription string  `json:"description"`
+	IsBeginNode     bool    `json:"is_begin"`
+	IsEndNode       bool    `json:"is_end"`
+	NodeTrigger     Trigger `json:"trigger"`
+
+	NodeTimeout time.Duration `json:"timeout"`   // How long an execution may take, 0 means no limit
+	IsSerial    bool          `json:"serial"`    // The action must not run concurrently
+	IsStreaming bool          `json:"streaming"` // The outputs are sent on as they are written
 
 	InputMap   map[string]Port `json:"input"`  //The key is the port name.
 	OutputMap  map[string]Port `json:"output"` //The key is the port name.
 	ParamMap   map[string]Port `json:"param"`  //The key is the port name. Ansible use a maker to set.
 	NodeAction func(inputs map[string]any, output map[string]chan any) (result any, err error)
+
+	NodeActionContext func(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error) // Used instead of NodeAction if set
+
+	NodeParamChanged func(name string, value any) // Called when a param is set, if not nil
 }
 
 func NewNode(name, description string, isBegin bool, inputs, outputs, params map[string]Port, action func(inputs map[string]any, output map[string]chan any) (result any, err error)) ImplNode {
@@ -68,6 +83,27 @@ func NewNode(name, description string, isBegin bool, inputs, outputs, params map
 	}
 }
 
+// NewContextNode creates a node whose action receives a context carrying the run ID.
+func NewContextNode(name, description string, isBegin bool, inputs, outputs, params map[string]Port, action func(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error)) ImplNode {
+	node := NewNode(name, description, isBegin, inputs, outputs, params, nil)
+	node.NodeActionContext = action
+	return node
+}
+
+// NewEndNode creates an end node, which has no output ports.
+func NewEndNode(name, description string, inputs, params map[string]Port, action func(inputs map[string]any, output map[string]chan any) (result any, err error)) ImplNode {
+	node := NewNode(name, description, false, inputs, map[string]Port{}, params, action)
+	node.IsEndNode = true
+	return node
+}
+
+// NewBeginNode creates a begin node which fires according to the trigger.
+func NewBeginNode(name, description string, trigger Trigger, inputs, outputs, params map[string]Port, action func(inputs map[string]any, output map[string]chan any) (result any, err error)) ImplNode {
+	node := NewNode(name, description, true, inputs, outputs, params, action)
+	node.NodeTrigger = trigger
+	return node
+}
+
 func (i ImplNode) Name() string {
 	return i.NodeName
 }
@@ -80,6 +116,26 @@ func (i ImplNode) IsBegin() bool {
 	return i.IsBeginNode
 }
 
+func (i ImplNode) IsEnd() bool {
+	return i.IsEndNode
+}
+
+func (i ImplNode) Trigger() Trigger {
+	return i.NodeTrigger
+}
+
+func (i ImplNode) Timeout() time.Duration {
+	return i.NodeTimeout
+}
+
+func (i ImplNode) Serial() bool {
+	return i.IsSerial
+}
+
+func (i ImplNode) Streaming() bool {
+	return i.IsStreaming
+}
+
 func (i ImplNode) Inputs() map[string]Port {
 	return i.InputMap
 }
@@ -93,14 +149,34 @@ func (i ImplNode) Params() map[string]Port {
 }
 
 func (i ImplNode) Action(inputs map[string]any, output map[string]chan any) (result any, err error) {
+	if i.NodeAction == nil && i.NodeActionContext != nil {
+		return i.NodeActionContext(context.Background(), inputs, output)
+	}
 	return i.NodeAction(inputs, output)
 }
 
+func (i ImplNode) ActionContext(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error) {
+	if i.NodeActionContext != nil {
+		return i.NodeActionContext(c, inputs, output)
+	}
+	return i.NodeAction(inputs, output)
+}
+
+func (i ImplNode) ParamChanged(name string, value any) {
+	if i.NodeParamChanged != nil {
+		i.NodeParamChanged(name, value)
+	}
+}
+
 type ImplPort struct {
-	PortName        string `json:"name"`
-	PortDescription string `json:"description"`
-	PortType        string `json:"type"`
+	PortName        string    `json:"name"`
+	PortDescription string    `json:"description"`
+	PortType        string    `json:"type"`
+	PortMerge       MergeMode `json:"merge"`
+	PortCodec       Codec     `json:"-"` // JSONCodec if nil
 	PortChan        chan any
+
+	PortSchema *ParamSchema `json:"schema"` // Only meaningful for param ports. Built from the type and description if nil
 }
 
 func NewPort(name, description, portType string) ImplPort {
@@ -112,6 +188,20 @@ func NewPort(name, description, portType string) ImplPort {
 	}
 }
 
+// NewMergePort creates an input port which accepts multiple incoming edges.
+func NewMergePort(name, description, portType string, merge MergeMode) ImplPort {
+	port := NewPort(name, description, portType)
+	port.PortMerge = merge
+	return port
+}
+
+// NewParamPort creates a param port checked against the schema when it is set.
+func NewParamPort(name string, schema ParamSchema) ImplPort {
+	port := NewPort(name, schema.Description, string(schema.Type))
+	port.PortSchema = &schema
+	return port
+}
+
 func (i ImplPort) Name() string {
 	return i.PortName
 }
@@ -124,6 +214,24 @@ func (i ImplPort) Type() string {
 	return i.PortType
 }
 
+func (i ImplPort) Merge() MergeMode {
+	return i.PortMerge
+}
+
+func (i ImplPort) Codec() Codec {
+	if i.PortCodec == nil {
+		return JSONCodec{}
+	}
+	return i.PortCodec
+}
+
+func (i ImplPort) Schema() ParamSchema {
+	if i.PortSchema == nil {
+		return ParamSchema{Type: ParamType(i.PortType), Description: i.PortDescription}
+	}
+	return *i.PortSchema
+}
+
 func (i ImplPort) Chan() chan any {
 	return i.PortChan
 }
@@ -1,7 +1,10 @@
 package hainish
 
 import (
+	"context"
+	"reflect"
 	"testing"
+	"time"
 )
 
 // TestNewPort tests port creation
@@ -180,3 +183,219 @@ func TestEdgeCreation(t *testing.T) {
 		t.Errorf("Expected Value 'test_data', got '%v'", edge.Value)
 	}
 }
+
+// TestNewMergePort tests merging input port creation
+func TestNewMergePort(t *testing.T) {
+	port := NewMergePort("input1", "Input port 1", "string", MergeTagged)
+
+	if port.Merge() != MergeTagged {
+		t.Errorf("Expected merge mode %d, got %d", MergeTagged, port.Merge())
+	}
+
+	if NewPort("input2", "Input port 2", "string").Merge() != MergeSingle {
+		t.Error("Expected a plain port to accept a single edge")
+	}
+
+	if PortMerge(port) != MergeTagged {
+		t.Errorf("Expected merge mode %d, got %d", MergeTagged, PortMerge(port))
+	}
+	if PortMerge(plainPort{}) != MergeSingle {
+		t.Error("Expected a port without a merge mode to accept a single edge")
+	}
+}
+
+// plainPort only implements Port, like a port of a plugin not built on ImplPort
+type plainPort struct{}
+
+func (plainPort) Name() string        { return "plain" }
+func (plainPort) Description() string { return "Plain port" }
+func (plainPort) Type() string        { return "string" }
+func (plainPort) Chan() chan any      { return nil }
+
+func TestNewBeginNode(t *testing.T) {
+	trigger := Trigger{Kind: TriggerInterval, Interval: time.Minute}
+	node := NewBeginNode("node1", "Begin node 1", trigger, nil, nil, nil, nil)
+
+	if !node.IsBegin() {
+		t.Error("Expected a begin node")
+	}
+	if node.Trigger() != trigger {
+		t.Errorf("Expected trigger %+v, got %+v", trigger, node.Trigger())
+	}
+
+	if NewNode("node2", "Node 2", true, nil, nil, nil, nil).Trigger().Kind != TriggerLoop {
+		t.Error("Expected a plain begin node to loop")
+	}
+
+	if NodeTrigger(node) != trigger {
+		t.Errorf("Expected trigger %+v, got %+v", trigger, NodeTrigger(node))
+	}
+	if NodeTrigger(plainNode{}).Kind != TriggerLoop {
+		t.Error("Expected a begin node without a trigger to loop")
+	}
+}
+
+// plainNode only implements Node, like a node of a plugin not built on ImplNode
+type plainNode struct{}
+
+func (plainNode) Name() string             { return "plain" }
+func (plainNode) Description() string      { return "Plain node" }
+func (plainNode) IsBegin() bool            { return true }
+func (plainNode) Inputs() map[string]Port  { return nil }
+func (plainNode) Outputs() map[string]Port { return nil }
+func (plainNode) Params() map[string]Port  { return nil }
+func (plainNode) Action(inputs map[string]any, output map[string]chan any) (result any, err error) {
+	return nil, nil
+}
+
+func TestNewContextNode(t *testing.T) {
+	node := NewContextNode("node1", "Context node 1", false, nil, nil, nil,
+		func(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error) {
+			return RunID(c), nil
+		})
+
+	result, err := node.ActionContext(WithRunID(context.Background(), "run1"), nil, nil)
+	if err != nil || result != "run1" {
+		t.Errorf("Expected run ID %q, got %v (%v)", "run1", result, err)
+	}
+
+	// Without a context the action sees no run
+	result, err = node.Action(nil, nil)
+	if err != nil || result != "" {
+		t.Errorf("Expected no run ID, got %v (%v)", result, err)
+	}
+}
+
+func TestPortCodec(t *testing.T) {
+	port := NewPort("output1", "Output port 1", "string")
+	if PortCodec(port).Name() != "json" {
+		t.Errorf("Expected the json codec by default, got %s", PortCodec(port).Name())
+	}
+
+	data, err := PortCodec(port).Encode(map[string]int{"a": 1})
+	if err != nil || string(data) != `{"a":1}` {
+		t.Errorf("Expected %q, got %q (%v)", `{"a":1}`, data, err)
+	}
+}
+
+func TestNewEndNode(t *testing.T) {
+	node := NewEndNode("node1", "End node 1", nil, nil, nil)
+
+	if !node.IsEnd() || node.IsBegin() {
+		t.Error("Expected an end node")
+	}
+	if len(node.Outputs()) != 0 {
+		t.Errorf("Expected no output ports, got %d", len(node.Outputs()))
+	}
+
+	if !NodeIsEnd(node) || NodeIsEnd(plainNode{}) {
+		t.Error("Expected only the node declaring it to be an end node")
+	}
+}
+
+func TestNodeTimeout(t *testing.T) {
+	node := NewNode("node1", "Node 1", false, nil, nil, nil, nil)
+	node.NodeTimeout = time.Second
+
+	var timeoutNode TimeoutNode = node
+	if timeoutNode.Timeout() != time.Second {
+		t.Errorf("Expected timeout %v, got %v", time.Second, timeoutNode.Timeout())
+	}
+}
+
+func TestNodeSerial(t *testing.T) {
+	node := NewNode("node1", "Node 1", false, nil, nil, nil, nil)
+
+	var serialNode SerialNode = node
+	if serialNode.Serial() {
+		t.Error("Expected a node to be safe to run concurrently by default")
+	}
+	node.IsSerial = true
+	if serialNode = node; !serialNode.Serial() {
+		t.Error("Expected the node to be serial")
+	}
+}
+
+func TestNodeStreaming(t *testing.T) {
+	node := NewNode("node1", "Node 1", false, nil, nil, nil, nil)
+
+	var streamingNode StreamingNode = node
+	if streamingNode.Streaming() {
+		t.Error("Expected a node to hold its outputs by default")
+	}
+	node.IsStreaming = true
+	if streamingNode = node; !streamingNode.Streaming() {
+		t.Error("Expected the node to stream its outputs")
+	}
+}
+
+func TestNodeParamChanged(t *testing.T) {
+	node := NewNode("node1", "Node 1", false, nil, nil, nil, nil)
+
+	var paramNode ParamNode = node
+	paramNode.ParamChanged("threshold", 1) // No hook set
+
+	var name string
+	var value any
+	node.NodeParamChanged = func(n string, v any) { name, value = n, v }
+	paramNode = node
+	paramNode.ParamChanged("threshold", 2)
+	if name != "threshold" || value != 2 {
+		t.Errorf("Expected the hook to be told threshold = 2, got %s = %v", name, value)
+	}
+}
+
+func TestParamSchemaValidate(t *testing.T) {
+	low, high := 1.0, 10.0
+	tests := []struct {
+		name   string
+		schema ParamSchema
+		value  any
+		want   any
+		ok     bool
+	}{
+		{"any", ParamSchema{}, []int{1}, []int{1}, true},
+		{"string", ParamSchema{Type: ParamString}, "a", "a", true},
+		{"not a string", ParamSchema{Type: ParamString}, 1, nil, false},
+		{"bool", ParamSchema{Type: ParamBool}, true, true, true},
+		{"int", ParamSchema{Type: ParamInt}, 3, 3, true},
+		{"whole float as int", ParamSchema{Type: ParamInt}, 3.0, 3, true},
+		{"fraction as int", ParamSchema{Type: ParamInt}, 3.5, nil, false},
+		{"int as float", ParamSchema{Type: ParamFloat}, 3, 3.0, true},
+		{"in range", ParamSchema{Type: ParamInt, Min: &low, Max: &high}, 10, 10, true},
+		{"below range", ParamSchema{Type: ParamInt, Min: &low}, 0, nil, false},
+		{"above range", ParamSchema{Type: ParamFloat, Max: &high}, 10.5, nil, false},
+		{"in enum", ParamSchema{Type: ParamInt, Enum: []any{1.0, 2.0}}, 2, 2, true},
+		{"not in enum", ParamSchema{Type: ParamString, Enum: []any{"a", "b"}}, "c", nil, false},
+		{"matches pattern", ParamSchema{Type: ParamString, Pattern: "^[a-z]+$"}, "abc", "abc", true},
+		{"does not match pattern", ParamSchema{Type: ParamString, Pattern: "^[a-z]+$"}, "ABC", nil, false},
+		{"invalid pattern", ParamSchema{Type: ParamString, Pattern: "["}, "a", nil, false},
+	}
+
+	for _, test := range tests {
+		got, err := test.schema.Validate(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok %v, got error %v", test.name, test.ok, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v (%T), got %v (%T)", test.name, test.want, test.want, got, got)
+		}
+	}
+}
+
+func TestNewParamPort(t *testing.T) {
+	port := NewParamPort("retries", ParamSchema{Type: ParamInt, Description: "Retries", Default: 3})
+	if port.Type() != "int" || port.Description() != "Retries" {
+		t.Errorf("Expected the port to be described by its schema, got %+v", port)
+	}
+	if schema := PortSchema(port); schema.Default != 3 {
+		t.Errorf("Expected the default 3, got %v", schema.Default)
+	}
+
+	// A port without a schema accepts any value of its type
+	schema := PortSchema(NewPort("label", "Label", "string"))
+	if schema.Type != ParamString || schema.Description != "Label" || schema.Required {
+		t.Errorf("Unexpected schema %+v", schema)
+	}
+}
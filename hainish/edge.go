@@ -8,7 +8,17 @@ type Edge struct {
 	TargetWorkflowID int     `json:"TargetWorkflowID"` // Which street
 	TargetNodeID     int     `json:"TargetNodeID"`     // Which building
 	TargetPort       string  `json:"TargetPort"`       // Which door
+	SourceEdgeID     int     `json:"SourceEdgeID"`     // Which road it came along
+	RunID            string  `json:"RunID"`            // Which trip it belongs to
 	Value            any     `json:"Value"`            // What to send
+	EndOfStream      bool    `json:"EndOfStream"`      // Nothing more comes along this road
+}
+
+// Tagged is a value received by a merging input port, tagged with the edge it came from.
+type Tagged struct {
+	EdgeID int    `json:"EdgeID"`
+	RunID  string `json:"RunID"`
+	Value  any    `json:"Value"`
 }
 
 func NewEdge(destination peer.ID, targetWorkflowID, targetNodeID int, targetPort string) *Edge {
@@ -0,0 +1,152 @@
+package hainish
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+)
+
+// ParamType is the type of the values a param accepts.
+type ParamType string
+
+const (
+	ParamAny    ParamType = ""       // Any value
+	ParamString ParamType = "string" // A string
+	ParamInt    ParamType = "int"    // A whole number, given to the node as an int
+	ParamFloat  ParamType = "float"  // A number, given to the node as a float64
+	ParamBool   ParamType = "bool"   // A bool
+)
+
+// ParamSchema declares the values a param accepts, so a param can be checked
+// when it is set, and the leader can render a form for it.
+type ParamSchema struct {
+	Type        ParamType `json:"type"`
+	Description string    `json:"description"`
+	Default     any       `json:"default"`  // The value of the param until it is set, nil means none
+	Required    bool      `json:"required"` // The workflow can't run until the param has a value
+	Min         *float64  `json:"min"`      // For numbers, nil means no bound
+	Max         *float64  `json:"max"`      // For numbers, nil means no bound
+	Enum        []any     `json:"enum"`     // The only values accepted, if not empty
+	Pattern     string    `json:"pattern"`  // A regular expression strings must match, if not empty
+}
+
+// SchemaPort is a param port which declares its schema.
+// A port without a schema accepts any value of its type.
+type SchemaPort interface {
+	Port
+
+	Schema() ParamSchema
+}
+
+// PortSchema returns the schema of the param port.
+func PortSchema(port Port) ParamSchema {
+	if schemaPort, ok := port.(SchemaPort); ok {
+		return schemaPort.Schema()
+	}
+	return ParamSchema{Type: ParamType(port.Type()), Description: port.Description()}
+}
+
+// Validate checks the value against the schema, and returns it as the node takes it.
+// Numbers decoded from JSON are float64, so an int param takes a whole float64 as an int.
+func (s ParamSchema) Validate(value any) (any, error) {
+	value, err := s.convert(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if number, ok := toFloat(value); ok && s.Type != ParamString && s.Type != ParamBool {
+		if s.Min != nil && number < *s.Min {
+			return nil, fmt.Errorf("%v is less than the minimum %v", value, *s.Min)
+		}
+		if s.Max != nil && number > *s.Max {
+			return nil, fmt.Errorf("%v is greater than the maximum %v", value, *s.Max)
+		}
+	}
+
+	if str, ok := value.(string); ok && s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+		if !pattern.MatchString(str) {
+			return nil, fmt.Errorf("%q does not match %q", str, s.Pattern)
+		}
+	}
+
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(v any) bool { return equalParams(v, value) }) {
+		return nil, fmt.Errorf("%v is not one of %v", value, s.Enum)
+	}
+	return value, nil
+}
+
+// Convert the value to the schema's type
+func (s ParamSchema) convert(value any) (any, error) {
+	switch s.Type {
+	case ParamString:
+		if str, ok := value.(string); ok {
+			return str, nil
+		}
+	case ParamBool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case ParamFloat:
+		if number, ok := toFloat(value); ok {
+			return number, nil
+		}
+	case ParamInt:
+		if i, ok := value.(int); ok {
+			return i, nil
+		}
+		// Whole floats up to 2^53 are exact
+		if number, ok := toFloat(value); ok && number == math.Trunc(number) && math.Abs(number) <= 1<<53 {
+			return int(number), nil
+		}
+	default:
+		return value, nil // Any value, or a type only the node knows
+	}
+	return nil, fmt.Errorf("%v (%T) is not a %s", value, value, s.Type)
+}
+
+// Numbers are compared by value, whatever their Go type
+func equalParams(a, b any) bool {
+	x, xOK := toFloat(a)
+	y, yOK := toFloat(b)
+	if xOK && yOK {
+		return x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
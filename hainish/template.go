@@ -1,5 +1,7 @@
 package hainish
 
+import "time"
+
 type Plugin interface {
 	Name() string
 	Description() string
@@ -30,3 +32,80 @@ type Port interface {
 
 	Chan() chan any
 }
+
+// EndNode is a node which declares whether it is an end node.
+// An end node is a sink, its values leave the workflow as results.
+type EndNode interface {
+	Node
+
+	IsEnd() bool
+}
+
+// NodeIsEnd reports whether the node is an end node.
+func NodeIsEnd(node Node) bool {
+	if endNode, ok := node.(EndNode); ok {
+		return endNode.IsEnd()
+	}
+	return false
+}
+
+// MergePort is an input port which declares how the values of its incoming edges are merged.
+// A port which doesn't declare it accepts a single edge.
+type MergePort interface {
+	Port
+
+	Merge() MergeMode
+}
+
+// PortMerge returns the merge mode of the input port.
+func PortMerge(port Port) MergeMode {
+	if mergePort, ok := port.(MergePort); ok {
+		return mergePort.Merge()
+	}
+	return MergeSingle
+}
+
+// MergeMode declares whether an input port accepts multiple incoming edges,
+// and how the values coming from them are merged.
+type MergeMode int
+
+const (
+	MergeSingle     MergeMode = iota // Only one incoming edge is accepted (default)
+	MergeInterleave                  // Values of all edges are delivered as they arrive
+	MergeTagged                      // Like MergeInterleave, but each value is a Tagged with its source edge
+	MergeBatch                       // All values arrived before a firing are collected into a []Tagged
+)
+
+// TriggerKind decides when a begin node fires.
+type TriggerKind int
+
+const (
+	TriggerLoop     TriggerKind = iota // Fire again as soon as the last firing is done (default)
+	TriggerOnce                        // Fire only once in a run
+	TriggerInterval                    // Fire at once, then every Interval
+	TriggerCron                        // Fire at the times of the Cron expression
+	TriggerManual                      // Fire each time the leader triggers the workflow
+)
+
+// Trigger is the firing policy of a begin node.
+type Trigger struct {
+	Kind     TriggerKind   `json:"kind"`
+	Interval time.Duration `json:"interval"` // For TriggerInterval
+	Cron     string        `json:"cron"`     // For TriggerCron, "minute hour day-of-month month day-of-week"
+}
+
+// TriggerNode is a begin node which declares when it fires.
+// A begin node which doesn't declare it loops.
+type TriggerNode interface {
+	Node
+
+	Trigger() Trigger
+}
+
+// NodeTrigger returns the trigger of the begin node.
+func NodeTrigger(node Node) Trigger {
+	if triggerNode, ok := node.(TriggerNode); ok {
+		return triggerNode.Trigger()
+	}
+	return Trigger{Kind: TriggerLoop}
+}
@@ -0,0 +1,233 @@
+package runtime
+
+import (
+	"maps"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/lvyonghuan/mobiles/hainish"
+)
+
+// NodeStats counts what a node did in a run.
+type NodeStats struct {
+	NodeID   int    `json:"NodeID"`
+	NodeName string `json:"NodeName"`
+	IsEnd    bool   `json:"IsEnd"`
+	Firings  uint64 `json:"Firings"` // Executions of the action
+	Errors   uint64 `json:"Errors"`  // Errors returned by the action
+	Results  uint64 `json:"Results"` // Results handed to Ansible
+	Outputs  uint64 `json:"Outputs"` // Values written to the output ports
+	Crashes  uint64 `json:"Crashes"` // Panics recovered by the supervisor
+}
+
+// CompletionSummary is reported when a workflow completes on this follower.
+type CompletionSummary struct {
+	WorkflowID int           `json:"WorkflowID"`
+	Started    time.Time     `json:"Started"`
+	Completed  time.Time     `json:"Completed"`
+	Duration   time.Duration `json:"Duration"`
+	Nodes      []NodeStats   `json:"Nodes"` // Ordered by node ID
+}
+
+type nodeStats struct {
+	firings atomic.Uint64
+	errors  atomic.Uint64
+	results atomic.Uint64
+	outputs atomic.Uint64
+	crashes atomic.Uint64
+}
+
+// Put into an input port after the last value of an edge
+type endOfStream int
+
+// SetCompletionHandler sets the function called when a workflow completes on this follower.
+// It is called after every result and log of the run has been handed to Ansible.
+func (r *Runtime) SetCompletionHandler(handler func(summary CompletionSummary)) {
+	r.onComplete = handler
+}
+
+// Watch the run of the workflow until its goroutines have exited.
+// The run completes when every node has run out of data, a drained run is cancelled
+// once it goes quiet, and a stopped run is marked stopped once its goroutines have exited.
+func (w *workflow) watchRun(started time.Time, drained <-chan struct{}, exited chan<- struct{}, onComplete func(CompletionSummary)) {
+	defer w.scheduler.watcherGoroutines.Add(-1)
+	defer close(exited)
+
+	w.watchCompletion(started, drained, onComplete)
+	select {
+	case <-drained:
+		w.waitQuiet(w.drainTimeout)
+		w.stop()
+	case <-w.c.Done():
+	}
+
+	// Nothing is started in a cancelled run, or drained in it, but either may be
+	// under way as it is cancelled
+	w.graphMu.Lock()
+	w.graphMu.Unlock()
+	<-w.goroutines.wait()
+	w.draining.Store(false)
+	_ = w.transition(Stopped, "stop") // The run may have completed or failed instead
+}
+
+// A workflow completes on this follower when every node has run out of data:
+// a begin node whose trigger won't fire again, or a node one of whose input ports
+// has received the end of every edge attached to it.
+// The end is passed on along the output edges, so the nodes downstream, local or
+// remote, complete after it. A cycle completes only if one of its ports ends from outside.
+func (w *workflow) watchCompletion(started time.Time, drained <-chan struct{}, onComplete func(CompletionSummary)) {
+	// A node or edge created while the run was checked is waited for in turn
+	for !w.complete() {
+		if !w.isRunning() || !w.waitCompletion(drained) {
+			return // Stopped meanwhile
+		}
+	}
+	summary := w.summary(started)
+	w.cancel() // Release the context of the run, and the node contexts derived from it
+
+	if onComplete != nil {
+		onComplete(summary)
+	}
+}
+
+// Wait until every node has run out of data, and what it sent has been handled.
+// Return false if the run has been stopped or drained.
+func (w *workflow) waitCompletion(drained <-chan struct{}) bool {
+	wait := func(c <-chan struct{}) bool {
+		select {
+		case <-c:
+			return true
+		case <-drained:
+		case <-w.c.Done():
+		}
+		return false
+	}
+
+	for rn := w.nextRunningNode(); rn != nil; rn = w.nextRunningNode() {
+		if !wait(rn.done) {
+			return false
+		}
+		if !rn.exhausted.Load() && !rn.removed.Load() {
+			return false // Stopped rather than exhausted
+		}
+	}
+
+	// The ends are sent, and Ansible has handled every value
+	if !wait(w.listeners.wait()) {
+		return false
+	}
+	ticker := w.clock.Ticker(quietCheckInterval)
+	defer ticker.Stop()
+	for w.activity.busy.Load() != 0 {
+		select {
+		case <-ticker.C:
+		case <-drained:
+			return false
+		case <-w.c.Done():
+			return false
+		}
+	}
+
+	// A paused workflow completes when it is resumed
+	return wait(w.resumed())
+}
+
+// Mark the run completed if nothing is left running in it.
+// The nodes and listeners are started under the graph lock, so none is started
+// in a completed run.
+func (w *workflow) complete() bool {
+	w.graphMu.Lock()
+	defer w.graphMu.Unlock()
+	if w.runningNode() != nil || w.listeners.len() > 0 || w.activity.busy.Load() != 0 {
+		return false
+	}
+	return w.transition(Completed, "complete") == nil
+}
+
+// Get a node which hasn't exited, or nil if all have
+func (w *workflow) nextRunningNode() *runtimeNode {
+	w.graphMu.RLock()
+	defer w.graphMu.RUnlock()
+	return w.runningNode()
+}
+
+// The caller holds the graph lock.
+func (w *workflow) runningNode() *runtimeNode {
+	for _, rn := range w.runtimeNodes {
+		select {
+		case <-rn.done:
+		default:
+			return rn
+		}
+	}
+	return nil
+}
+
+func (w *workflow) summary(started time.Time) CompletionSummary {
+	completed := w.clock.Now()
+	summary := CompletionSummary{
+		WorkflowID: w.id,
+		Started:    started,
+		Completed:  completed,
+		Duration:   completed.Sub(started),
+	}
+
+	w.graphMu.RLock()
+	defer w.graphMu.RUnlock()
+	for _, nodeID := range slices.Sorted(maps.Keys(w.runtimeNodes)) {
+		rn := w.runtimeNodes[nodeID]
+		summary.Nodes = append(summary.Nodes, NodeStats{
+			NodeID:   nodeID,
+			NodeName: (*rn.node).Name(),
+			IsEnd:    hainish.NodeIsEnd(*rn.node),
+			Firings:  rn.stats.firings.Load(),
+			Errors:   rn.stats.errors.Load(),
+			Results:  rn.stats.results.Load(),
+			Outputs:  rn.stats.outputs.Load(),
+			Crashes:  rn.stats.crashes.Load(),
+		})
+	}
+	return summary
+}
+
+// Record the end of an edge on the input port.
+// Return true if every edge of the port has ended.
+func (rn *runtimeNode) endEdge(portName string, edgeID int) bool {
+	ended, exist := rn.endedEdges[portName]
+	if !exist {
+		ended = make(map[int]bool)
+		rn.endedEdges[portName] = ended
+	}
+	ended[edgeID] = true
+	return rn.portEnded(portName)
+}
+
+// Check whether every edge of the input port has ended.
+// The edges removed meanwhile are not waited for.
+func (rn *runtimeNode) portEnded(portName string) bool {
+	ended := rn.endedEdges[portName]
+	if len(ended) == 0 {
+		return false
+	}
+
+	// The edges from other followers may not be registered here,
+	// then the port ends with the first end it receives
+	rn.edgeMu.RLock()
+	defer rn.edgeMu.RUnlock()
+	for id, e := range rn.inputEdges {
+		if e.e.TargetPort == portName && !ended[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reset what the node has done in the last run
+func (rn *runtimeNode) resetRun() {
+	rn.exhausted.Store(false)
+	rn.endedEdges = make(map[string]map[int]bool)
+	rn.stats = nodeStats{}
+	rn.epoch, rn.seq = 0, 0
+	rn.restarts = make(chan time.Duration, 1)
+}
@@ -0,0 +1,41 @@
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// ConflictError is returned when a workflow, node or edge is created with an ID which already exists.
+//
+// A create command may carry an idempotency key, so the leader can retry it after a timeout.
+// A retry finding what the same key created is not a conflict, it succeeds without changing anything.
+type ConflictError struct {
+	WorkflowID int
+	Kind       string // "workflow", "node" or "edge"
+	ID         int
+	Key        string // The idempotency key of the create command, empty if none
+}
+
+func (e *ConflictError) Error() string {
+	if e.Kind == "workflow" {
+		return fmt.Sprintf("%s: workflow %d", e.Unwrap(), e.ID)
+	}
+	return fmt.Sprintf("%s: workflow %d: %s %d", e.Unwrap(), e.WorkflowID, e.Kind, e.ID)
+}
+
+func (e *ConflictError) Unwrap() error {
+	switch e.Kind {
+	case "workflow":
+		return util.ErrWorkflowExists
+	case "node":
+		return util.ErrNodeExists
+	default:
+		return util.ErrEdgeExists
+	}
+}
+
+// Check whether a create command with the key is a retry of the one which created the existing one
+func isRetry(key, createdBy string) bool {
+	return key != "" && key == createdBy
+}
@@ -0,0 +1,504 @@
+package runtime
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// Deployment is the complete graph of a workflow on this follower:
+// its nodes with their settings, and the edges attached to them.
+type Deployment struct {
+	WorkflowID int        `json:"WorkflowID"`
+	Nodes      []NodeSpec `json:"Nodes"`
+	Edges      []EdgeSpec `json:"Edges"`
+}
+
+// NodeSpec is a node of a deployment. A setting left out is the node's default.
+type NodeSpec struct {
+	NodeID        int                   `json:"NodeID"`
+	NodeName      string                `json:"NodeName"`
+	Params        map[string]any        `json:"Params"`      // The params left out take their defaults
+	OutputModes   map[string]OutputMode `json:"OutputModes"` // The ports left out broadcast
+	Trigger       *hainish.Trigger      `json:"Trigger"`     // For a begin node, nil means the declared one
+	ErrorPolicy   ErrorPolicy           `json:"ErrorPolicy"`
+	RestartPolicy RestartPolicy         `json:"RestartPolicy"`
+	Timeout       *time.Duration        `json:"Timeout"`  // nil means the declared one
+	Replicas      int                   `json:"Replicas"` // 0 means 1
+	Ordered       bool                  `json:"Ordered"`
+}
+
+// EdgeSpec is an edge of a deployment, as created by CreateEdge.
+type EdgeSpec struct {
+	EdgeID           int     `json:"EdgeID"`
+	Destination      peer.ID `json:"Destination"`
+	ProducerNodeID   int     `json:"ProducerNodeID"`
+	ProducerPortName string  `json:"ProducerPortName"`
+	ConsumerNodeID   int     `json:"ConsumerNodeID"`
+	ConsumerPortName string  `json:"ConsumerPortName"`
+}
+
+// DeployResult tells what a deployment has changed.
+// Deploying the same graph again changes nothing.
+type DeployResult struct {
+	WorkflowID   int   `json:"WorkflowID"`
+	Created      bool  `json:"Created"` // The workflow didn't exist
+	CreatedNodes []int `json:"CreatedNodes"`
+	DeletedNodes []int `json:"DeletedNodes"`
+	UpdatedNodes []int `json:"UpdatedNodes"` // The nodes kept whose settings have changed
+	CreatedEdges []int `json:"CreatedEdges"`
+	DeletedEdges []int `json:"DeletedEdges"`
+}
+
+// Changed reports whether the deployment has changed anything.
+func (d DeployResult) Changed() bool {
+	return d.Created || len(d.CreatedNodes) > 0 || len(d.DeletedNodes) > 0 || len(d.UpdatedNodes) > 0 ||
+		len(d.CreatedEdges) > 0 || len(d.DeletedEdges) > 0
+}
+
+// The settings of a node, compared and applied by a deployment
+type nodeSettings struct {
+	params      map[string]any
+	outputModes map[string]OutputMode // Only the round-robin ports
+
+	// Only changed while the workflow is not running
+	trigger       hainish.Trigger
+	errorPolicy   ErrorPolicy
+	restartPolicy RestartPolicy
+	timeout       time.Duration
+	replicas      int
+	ordered       bool
+}
+
+// Check whether the settings only the params may differ in are the same
+func (s nodeSettings) sameConfig(other nodeSettings) bool {
+	return reflect.DeepEqual(s.outputModes, other.outputModes) && s.trigger == other.trigger &&
+		s.errorPolicy == other.errorPolicy && s.restartPolicy == other.restartPolicy &&
+		s.timeout == other.timeout && s.replicas == other.replicas && s.ordered == other.ordered
+}
+
+func (rn *runtimeNode) settings() nodeSettings {
+	s := nodeSettings{
+		params:        rn.paramValues(),
+		outputModes:   make(map[string]OutputMode),
+		trigger:       rn.trigger,
+		errorPolicy:   rn.errorPolicy,
+		restartPolicy: rn.restartPolicy,
+		timeout:       rn.timeout,
+		replicas:      rn.replicas,
+		ordered:       rn.ordered,
+	}
+	for portName, mode := range rn.outputModes {
+		if mode != Broadcast {
+			s.outputModes[portName] = mode
+		}
+	}
+	return s
+}
+
+// Apply the settings to the node. A node which is running only takes the params,
+// the node is told about those changed.
+func (rn *runtimeNode) apply(s nodeSettings, running bool) {
+	old := rn.paramValues()
+	rn.paramMu.Lock()
+	rn.params = maps.Clone(s.params)
+	rn.paramMu.Unlock()
+	if paramNode, ok := (*rn.node).(hainish.ParamNode); ok {
+		for _, name := range slices.Sorted(maps.Keys(s.params)) {
+			if value, exist := old[name]; !exist || !reflect.DeepEqual(value, s.params[name]) {
+				paramNode.ParamChanged(name, s.params[name])
+			}
+		}
+	}
+
+	if running {
+		return
+	}
+	rn.outputModes = maps.Clone(s.outputModes)
+	rn.trigger = s.trigger
+	rn.errorPolicy = s.errorPolicy
+	rn.restartPolicy = s.restartPolicy
+	rn.timeout = s.timeout
+	rn.replicas, rn.ordered = s.replicas, s.ordered
+}
+
+// Check the spec against the plugin node, and get the settings it asks for
+func specSettings(node hainish.Node, spec NodeSpec) (nodeSettings, error) {
+	s := nodeSettings{
+		params:        make(map[string]any),
+		outputModes:   make(map[string]OutputMode),
+		trigger:       hainish.NodeTrigger(node),
+		errorPolicy:   spec.ErrorPolicy,
+		restartPolicy: spec.RestartPolicy,
+		timeout:       declaredTimeout(node),
+		replicas:      max(spec.Replicas, 1),
+		ordered:       spec.Ordered,
+	}
+
+	ports := node.Params()
+	for portName, port := range ports {
+		if value := hainish.PortSchema(port).Default; value != nil {
+			s.params[portName] = value
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(spec.Params)) {
+		port, exist := ports[name]
+		if !exist {
+			return s, fmt.Errorf("%w: param %s", util.ErrPortNotExist, name)
+		}
+		value, err := hainish.PortSchema(port).Validate(spec.Params[name])
+		if err != nil {
+			return s, fmt.Errorf("%w: %s: %v", util.ErrInvalidParam, name, err)
+		}
+		s.params[name] = value
+	}
+
+	for _, portName := range slices.Sorted(maps.Keys(spec.OutputModes)) {
+		mode := spec.OutputModes[portName]
+		if _, exist := node.Outputs()[portName]; !exist {
+			return s, fmt.Errorf("%w: output %s", util.ErrPortNotFoundInNode, portName)
+		}
+		if mode != Broadcast && mode != RoundRobin {
+			return s, fmt.Errorf("%w: %d", util.ErrInvalidOutputMode, mode)
+		}
+		if mode != Broadcast {
+			s.outputModes[portName] = mode
+		}
+	}
+
+	if spec.Trigger != nil {
+		if !node.IsBegin() {
+			return s, util.ErrNodeNotBegin
+		}
+		s.trigger = *spec.Trigger
+	}
+	if node.IsBegin() {
+		if err := checkTrigger(s.trigger); err != nil {
+			return s, fmt.Errorf("%w: %v", util.ErrInvalidTrigger, err)
+		}
+	}
+
+	if err := s.errorPolicy.check(); err != nil {
+		return s, fmt.Errorf("%w: %v", util.ErrInvalidErrorPolicy, err)
+	}
+	if err := s.restartPolicy.check(); err != nil {
+		return s, fmt.Errorf("%w: %v", util.ErrInvalidRestartPolicy, err)
+	}
+
+	if spec.Timeout != nil {
+		if *spec.Timeout < 0 {
+			return s, fmt.Errorf("%w: %v", util.ErrInvalidTimeout, *spec.Timeout)
+		}
+		s.timeout = *spec.Timeout
+	}
+
+	if spec.Replicas < 0 {
+		return s, fmt.Errorf("%w: %d replicas", util.ErrInvalidConcurrency, spec.Replicas)
+	}
+	if s.replicas > 1 && isSerial(node) {
+		return s, util.ErrNodeNotConcurrent
+	}
+	return s, nil
+}
+
+func specOf(e edge) EdgeSpec {
+	return EdgeSpec{
+		EdgeID:           e.e.SourceEdgeID,
+		Destination:      e.e.Destination,
+		ProducerNodeID:   e.producerNodeID,
+		ProducerPortName: e.producerPortName,
+		ConsumerNodeID:   e.e.TargetNodeID,
+		ConsumerPortName: e.e.TargetPort,
+	}
+}
+
+// What a deployment does to the workflow
+type deployPlan struct {
+	result DeployResult
+
+	editable bool // Settings which only change while the workflow is not running are changed
+
+	deleteEdges []edge
+	deleteNodes []*runtimeNode
+	createNodes []NodeSpec
+	settings    map[int]nodeSettings // For the nodes created and updated
+	createEdges []EdgeSpec
+}
+
+// Check the deployment, and compare it with the graph of the workflow, which is nil if it doesn't exist
+func (r *Runtime) plan(d Deployment, wf *workflow) (*deployPlan, error) {
+	p := &deployPlan{
+		result:   DeployResult{WorkflowID: d.WorkflowID, Created: wf == nil},
+		settings: make(map[int]nodeSettings),
+	}
+
+	var existing map[int]*runtimeNode
+	var existingEdges map[int]edge
+	existingSettings := make(map[int]nodeSettings)
+	if wf != nil {
+		wf.graphMu.RLock()
+		existing, existingEdges = maps.Clone(wf.runtimeNodes), maps.Clone(wf.edges)
+		for nodeID, rn := range existing {
+			existingSettings[nodeID] = rn.settings()
+		}
+		wf.graphMu.RUnlock()
+	}
+
+	// The nodes
+	nodes := make(map[int]hainish.Node)
+	replaced := make(map[int]bool)
+	for _, spec := range d.Nodes {
+		if _, exist := nodes[spec.NodeID]; exist {
+			return nil, fmt.Errorf("node %d is deployed twice", spec.NodeID)
+		}
+		node, exist := r.nodes[spec.NodeName]
+		if !exist {
+			return nil, fmt.Errorf("node %d: %w: %s", spec.NodeID, util.ErrNodeNotFoundInPlugin, spec.NodeName)
+		}
+		nodes[spec.NodeID] = node
+
+		s, err := specSettings(node, spec)
+		if err != nil {
+			return nil, fmt.Errorf("node %d: %w", spec.NodeID, err)
+		}
+
+		rn, exist := existing[spec.NodeID]
+		switch {
+		case exist && (*rn.node).Name() == spec.NodeName:
+			current := existingSettings[spec.NodeID]
+			if reflect.DeepEqual(current, s) {
+				continue
+			}
+			p.editable = p.editable || !current.sameConfig(s)
+			p.settings[spec.NodeID] = s
+			p.result.UpdatedNodes = append(p.result.UpdatedNodes, spec.NodeID)
+		case exist:
+			replaced[spec.NodeID] = true
+			fallthrough
+		default:
+			p.createNodes = append(p.createNodes, spec)
+			p.settings[spec.NodeID] = s
+			p.result.CreatedNodes = append(p.result.CreatedNodes, spec.NodeID)
+		}
+	}
+	// A node deleted or created changes the edges attached to it,
+	// e.g. an edge to a remote node becomes one to a local node
+	changed := make(map[int]bool)
+	for _, spec := range p.createNodes {
+		changed[spec.NodeID] = true
+	}
+	for _, nodeID := range slices.Sorted(maps.Keys(existing)) {
+		if _, kept := nodes[nodeID]; !kept || replaced[nodeID] {
+			changed[nodeID] = true
+			p.deleteNodes = append(p.deleteNodes, existing[nodeID])
+			p.result.DeletedNodes = append(p.result.DeletedNodes, nodeID)
+		}
+	}
+
+	// The edges
+	specs := make(map[int]EdgeSpec)
+	singleEdges := make(map[string]int)
+	for _, spec := range d.Edges {
+		if _, exist := specs[spec.EdgeID]; exist {
+			return nil, fmt.Errorf("edge %d is deployed twice", spec.EdgeID)
+		}
+		specs[spec.EdgeID] = spec
+
+		producer, isProducerLocal := nodes[spec.ProducerNodeID]
+		consumer, isConsumerLocal := nodes[spec.ConsumerNodeID]
+		if !isProducerLocal && !isConsumerLocal {
+			return nil, fmt.Errorf("edge %d: %w", spec.EdgeID, util.ErrNodeNotFoundInWorkflow)
+		}
+		if isProducerLocal {
+			if _, exist := producer.Outputs()[spec.ProducerPortName]; !exist {
+				return nil, fmt.Errorf("edge %d: %w: %s", spec.EdgeID, util.ErrPortNotFoundInNode, spec.ProducerPortName)
+			}
+		}
+		if isConsumerLocal {
+			port, exist := consumer.Inputs()[spec.ConsumerPortName]
+			if !exist {
+				return nil, fmt.Errorf("edge %d: %w: %s", spec.EdgeID, util.ErrPortNotFoundInNode, spec.ConsumerPortName)
+			}
+			key := fmt.Sprintf("%d/%s", spec.ConsumerNodeID, spec.ConsumerPortName)
+			singleEdges[key]++
+			if hainish.PortMerge(port) == hainish.MergeSingle && singleEdges[key] > 1 {
+				return nil, fmt.Errorf("edge %d: %w", spec.EdgeID, util.ErrPortMultipleEdges)
+			}
+		}
+	}
+
+	// An edge changed, or attached to a node changed, is created again.
+	// The nodes can only be deleted without edges.
+	kept := make(map[int]bool)
+	for _, edgeID := range slices.Sorted(maps.Keys(existingEdges)) {
+		e := existingEdges[edgeID]
+		spec, exist := specs[edgeID]
+		if exist && spec == specOf(e) && !changed[spec.ProducerNodeID] && !changed[spec.ConsumerNodeID] {
+			kept[edgeID] = true
+			continue
+		}
+		p.deleteEdges = append(p.deleteEdges, e)
+		p.result.DeletedEdges = append(p.result.DeletedEdges, edgeID)
+	}
+	for _, spec := range d.Edges {
+		if !kept[spec.EdgeID] {
+			p.createEdges = append(p.createEdges, spec)
+			p.result.CreatedEdges = append(p.result.CreatedEdges, spec.EdgeID)
+		}
+	}
+	return p, nil
+}
+
+// DeployWorkflow makes the graph of the workflow the deployment.
+// A workflow which doesn't exist is created, and one which exists is compared with
+// the deployment, only the differences are applied. So deploying again changes nothing.
+//
+// The deployment is checked as a whole before anything is changed. If applying it
+// fails, what has been applied is rolled back, and a created workflow is deleted.
+// A running workflow takes the new nodes, edges and params at once. Other settings
+// of the nodes it keeps can only change while it is not running.
+// The workflow isn't run while it is deployed, it may only stop meanwhile.
+func (r *Runtime) DeployWorkflow(d Deployment) (DeployResult, error) {
+	r.deployMu.Lock()
+	defer r.deployMu.Unlock()
+
+	wf, exist := r.getWorkflow(d.WorkflowID)
+	if exist {
+		wf.runMu.Lock()
+		defer wf.runMu.Unlock()
+		err := wf.require("deploy", liveStates...)
+		if err != nil {
+			return DeployResult{WorkflowID: d.WorkflowID}, err
+		}
+	}
+
+	p, err := r.plan(d, wf)
+	if err != nil {
+		return DeployResult{WorkflowID: d.WorkflowID}, uerr.NewError(fmt.Errorf("%w: %v", util.ErrInvalidDeployment, err))
+	}
+	if p.editable {
+		err = wf.require("change the settings of running nodes", editableStates...)
+		if err != nil {
+			return DeployResult{WorkflowID: d.WorkflowID}, err
+		}
+	}
+	if !p.result.Changed() {
+		return p.result, nil
+	}
+
+	var undo []func()
+	rollback := func(err error) (DeployResult, error) {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return DeployResult{WorkflowID: d.WorkflowID}, err
+	}
+
+	if wf == nil {
+		err = r.InitWorkflow(d.WorkflowID)
+		if err != nil {
+			return DeployResult{WorkflowID: d.WorkflowID}, err
+		}
+		wf, _ = r.getWorkflow(d.WorkflowID)
+		wf.runMu.Lock() // It may have been run since it was created, its nodes are started below then
+		defer wf.runMu.Unlock()
+		undo = append(undo, func() { _ = r.DeleteWorkflow(d.WorkflowID) })
+	}
+	running := wf.isRunning() // If the run stops meanwhile, only live settings have changed anyway
+
+	for _, e := range p.deleteEdges {
+		err = r.DeleteEdge(d.WorkflowID, e.e.SourceEdgeID)
+		if err != nil {
+			return rollback(err)
+		}
+		spec, key := specOf(e), e.key
+		undo = append(undo, func() { _ = r.createEdge(key, d.WorkflowID, spec) })
+	}
+
+	for _, rn := range p.deleteNodes {
+		err = r.DeleteNode(d.WorkflowID, rn.id)
+		if err != nil {
+			return rollback(err)
+		}
+		node, s := *rn.node, rn.settings()
+		undo = append(undo, func() {
+			wf.graphMu.Lock()
+			defer wf.graphMu.Unlock()
+			restored := r.createNode(wf, node, rn.id)
+			restored.key = rn.key
+			restored.apply(s, false)
+			if wf.isRunning() {
+				_ = wf.startNode(restored)
+			}
+		})
+	}
+
+	// The nodes created are started after their settings and edges
+	var created []*runtimeNode
+	wf.graphMu.Lock()
+	if wf.deleted && len(p.createNodes) > 0 {
+		wf.graphMu.Unlock()
+		return rollback(uerr.NewError(util.ErrWorkflowNotFound))
+	}
+	for _, spec := range p.createNodes {
+		rn := r.createNode(wf, r.nodes[spec.NodeName], spec.NodeID)
+		rn.apply(p.settings[spec.NodeID], false)
+		created = append(created, rn)
+		nodeID := spec.NodeID
+		undo = append(undo, func() { _ = r.DeleteNode(d.WorkflowID, nodeID) })
+	}
+	wf.graphMu.Unlock()
+
+	for _, nodeID := range p.result.UpdatedNodes {
+		wf.graphMu.Lock()
+		rn, exist := wf.runtimeNodes[nodeID]
+		if !exist { // Deleted since the plan
+			wf.graphMu.Unlock()
+			return rollback(uerr.NewError(util.ErrNodeNotFoundInWorkflow))
+		}
+		old := rn.settings()
+		rn.apply(p.settings[nodeID], running)
+		wf.graphMu.Unlock()
+		undo = append(undo, func() {
+			wf.graphMu.Lock()
+			defer wf.graphMu.Unlock()
+			rn.apply(old, running)
+		})
+	}
+
+	for _, spec := range p.createEdges {
+		err = r.createEdge("", d.WorkflowID, spec)
+		if err != nil {
+			return rollback(err)
+		}
+		edgeID := spec.EdgeID
+		undo = append(undo, func() { _ = r.RemoveEdge(d.WorkflowID, edgeID, EdgeDiscard) })
+	}
+
+	// The run may have stopped meanwhile
+	wf.graphMu.Lock()
+	if wf.isRunning() {
+		for _, rn := range created {
+			err = wf.startNode(rn)
+			if err != nil {
+				break
+			}
+		}
+	}
+	wf.graphMu.Unlock()
+	if err != nil {
+		return rollback(err)
+	}
+	return p.result, nil
+}
+
+func (r *Runtime) createEdge(key string, workflowID int, spec EdgeSpec) error {
+	return r.CreateEdgeWithKey(key, spec.EdgeID, spec.Destination, workflowID, spec.ProducerNodeID, spec.ProducerPortName, spec.ConsumerNodeID, spec.ConsumerPortName)
+}
@@ -0,0 +1,135 @@
+package runtime
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// How often a draining workflow checks whether it has gone quiet
+const quietCheckInterval = 10 * time.Millisecond
+
+// activity tracks the work in progress of a workflow, to tell when it goes quiet.
+type activity struct {
+	busy    atomic.Int64  // Firings in flight, values waiting for their edges, and values Ansible hasn't acknowledged
+	counter atomic.Uint64 // Increased by every piece of work, to catch the work done between two checks
+}
+
+func (a *activity) begin() {
+	a.counter.Add(1)
+	a.busy.Add(1)
+}
+
+func (a *activity) end() {
+	a.busy.Add(-1)
+}
+
+func (a *activity) touch() {
+	a.counter.Add(1)
+}
+
+// AckOutput tells the runtime that Ansible has handled a value
+// taken from the result, error or process channel of the workflow.
+func (r *Runtime) AckOutput(workflowID int) {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return
+	}
+	wf.activity.end()
+}
+
+// SetActivityHandler sets the function called when a running workflow delivers a value
+// along an edge between two of its nodes on this follower, which Ansible doesn't see.
+func (r *Runtime) SetActivityHandler(handler func(workflowID int)) {
+	r.onActivity = handler
+}
+
+// Activity tells whether the workflow is quiet on this follower,
+// with a counter increased by every piece of work done in it.
+// The workflow has been idle between two calls which are quiet with the same counter.
+func (r *Runtime) Activity(workflowID int) (quiet bool, counter uint64, err error) {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return false, 0, uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	counter = wf.activity.counter.Load()
+	return wf.isQuiet(), counter, nil
+}
+
+// DrainWorkflow stops the workflow gracefully.
+// The begin nodes stop at once, and the data already in the graph keeps
+// flowing until the workflow goes quiet, or the timeout expires.
+// Then the results and logs have been handed to Ansible, and the workflow is cancelled.
+//
+// The data from other followers is still taken while draining,
+// so the leader should drain every follower of the workflow together.
+// The timeout must be positive, StopWorkflow stops the workflow at once.
+func (r *Runtime) DrainWorkflow(workflowID int, timeout time.Duration) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	if timeout <= 0 {
+		return uerr.NewError(fmt.Errorf("%w: drain timeout %v", util.ErrInvalidTimeout, timeout))
+	}
+
+	// The run is handed to its watcher under the graph lock, which it starts under
+	wf.graphMu.RLock()
+	defer wf.graphMu.RUnlock()
+	err := wf.transition(Stopping, "drain")
+	if err != nil {
+		return err
+	}
+	wf.draining.Store(true)
+	wf.drainTimeout = timeout
+	close(wf.drained)
+	return nil
+}
+
+// Wait until nothing happens in the workflow between two checks, or the timeout expires.
+// Return false on timeout, or if the workflow fails meanwhile.
+func (wf *workflow) waitQuiet(timeout time.Duration) bool {
+	deadline := wf.clock.After(timeout)
+	ticker := wf.clock.Ticker(quietCheckInterval)
+	defer ticker.Stop()
+
+	lastCounter, wasQuiet := wf.activity.counter.Load(), false
+	for {
+		select {
+		case <-ticker.C:
+			counter := wf.activity.counter.Load()
+			isQuiet := wf.isQuiet()
+			if wasQuiet && isQuiet && counter == lastCounter {
+				return true
+			}
+			lastCounter, wasQuiet = counter, isQuiet
+		case <-deadline:
+			return false
+		case <-wf.c.Done():
+			return false
+		}
+	}
+}
+
+// Check nothing is running or waiting in the ports
+func (wf *workflow) isQuiet() bool {
+	if wf.activity.busy.Load() != 0 {
+		return false
+	}
+
+	wf.graphMu.RLock()
+	defer wf.graphMu.RUnlock()
+	for _, rn := range wf.runtimeNodes {
+		for _, port := range rn.inputs {
+			if len(port) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
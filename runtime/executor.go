@@ -2,74 +2,333 @@ package runtime
 
 import (
 	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/lvyonghuan/Ubik-Util/uerr"
 	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/util"
 )
 
-func (w *workflow) runNode(node hainish.Node) {
-	params := node.Params()
+// Run the node until the workflow stops, or the node runs out of data.
+// A begin node runs out of data when its trigger won't fire any more,
+// and any node when all edges of one of its input ports have ended.
+//
+// The node takes its firings one after another, and hands each to the scheduler.
+// Up to the node's replicas of them execute at the same time, and the node's
+// publisher sends on what they have produced.
+// Return true if the node has run out of data, after every firing taken is published.
+func (w *workflow) runNode(rn *runtimeNode, t *trigger) bool {
+	w.scheduler.nodeGoroutines.Add(2) // This one takes the firings, and the other publishes them
+	defer w.scheduler.nodeGoroutines.Add(-2)
+
+	rn.slots = make(chan struct{}, rn.replicas)
+	rn.finished = make(chan *firing, rn.replicas)
+	rn.streamed = make(chan output)
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		w.publishFirings(rn)
+	}()
+
+	exhausted := w.superviseNode(rn, t)
+
+	// Wait for the firings in flight
+	for range rn.replicas {
+		rn.slots <- struct{}{}
+	}
+	close(rn.finished)
+	<-published
+	return exhausted
+}
+
+// Take the firings of the node, and hand them to the scheduler.
+// Return true if the node has run out of data.
+func (w *workflow) intake(rn *runtimeNode, t *trigger) bool {
+	for {
+		// A firing which panicked holds the node for a while
+		select {
+		case backoff := <-rn.restarts:
+			if !w.sleep(rn.c, backoff) {
+				return false
+			}
+		default:
+		}
+
+		f, ok, exhausted := w.take(rn, t)
+		if !ok {
+			return exhausted
+		}
+
+		// Wait for a replica to be free
+		select {
+		case rn.slots <- struct{}{}:
+		case <-rn.c.Done():
+			return false
+		}
+
+		w.activity.begin() // Ended when the firing is published
+		if !w.scheduler.submit(rn.c, func() { w.fire(rn, f) }) {
+			<-rn.slots
+			w.activity.end()
+			return false
+		}
+	}
+}
+
+// Take the params and inputs of the next firing.
+// Return false if there is no more firing, and whether the node has run out of data.
+func (w *workflow) take(rn *runtimeNode, t *trigger) (f *firing, ok bool, exhausted bool) {
+	node := *rn.node
 	inputs := node.Inputs()
-	outputs := node.Outputs()
-	out := make(map[string]chan any)
+	inputNames := slices.Sorted(maps.Keys(inputs)) // The run ID is taken from the first port
+
+	// The epoch is kept in the node, so a restarted loop goes on from the next one
+	i := rn.epoch
+	rn.epoch++
 
-	// Prepare output channels
-	for outputName, port := range outputs {
-		out[outputName] = port.Chan()
+	// A node without inputs would never see the stop signal
+	if rn.c.Err() != nil {
+		return nil, false, false
 	}
 
-	// Loop to get inputs and params, then execute the node
-	for i := 0; ; i++ {
-		// Get inputs value
-		in := make(map[string]any)
-		for paramName, port := range params {
-			select {
-			case in[paramName] = <-port.Chan():
-			case <-w.c.Done():
-				return
+	// Wait for the begin node's trigger
+	if t != nil && !t.wait(rn.c, i) {
+		return nil, false, rn.c.Err() == nil
+	}
+
+	// A draining workflow takes no new data from the begin nodes
+	if node.IsBegin() && w.draining.Load() {
+		return nil, false, false
+	}
+
+	// Hold at the epoch boundary while the workflow is paused
+	select {
+	case <-w.resumed():
+	case <-rn.c.Done():
+		return nil, false, false
+	}
+
+	// The params are the node's configuration
+	in := rn.paramValues()
+
+	// Each firing of a begin node starts a new run,
+	// and the other nodes continue the run of their inputs.
+	runID := ""
+	if node.IsBegin() {
+		runID = newRunID()
+	}
+
+	// The beginning node will skip the first epoch's input (if it has any)
+	// to start this workflow.
+	// Otherwise, the workflow will be blocked forever (if beginning node has any
+	// input, the node will wait for it).
+	if i != 0 || !node.IsBegin() {
+		for _, inputName := range inputNames {
+			rv, ok := w.receive(rn, inputName)
+			if !ok {
+				return nil, false, rn.c.Err() == nil
+			}
+			if runID == "" {
+				runID = rv.runID
+			}
+			in[inputName] = rv.value
+
+			// A batch port collects everything that has arrived
+			if hainish.PortMerge(inputs[inputName]) == hainish.MergeBatch {
+				in[inputName] = rn.collectBatch(rv.value, inputName)
 			}
 		}
+	}
 
-		// The beginning node will skip the first epoch's input (if it has any)
-		// to start this workflow.
-		// Otherwise, the workflow will be blocked forever (if beginning node has any
-		// input, the node will wait for it).
-		if i != 0 || !node.IsBegin() {
-			for inputName, port := range inputs {
-				select {
-				case in[inputName] = <-port.Chan():
-				case <-w.c.Done():
-					return
-				}
+	return rn.newFiring(runID, in), true, false
+}
+
+// Execute an attempt of the firing on a worker, and hand the firing to the publisher
+// when no more attempt is made.
+func (w *workflow) fire(rn *runtimeNode, f *firing) {
+	f.attempt++
+
+	var backoff time.Duration
+	crash := recovered(func() { backoff, f.ok = w.execute(rn, f) })
+	switch {
+	case crash != nil:
+		// The firing is given up, and the node is held before its next firing
+		f.ok, f.collected, f.results = false, nil, nil
+		if w.crashed(rn, f.runID, crash) {
+			select {
+			case rn.restarts <- rn.restartPolicy.backoff():
+			default:
 			}
 		}
+	case f.ok && backoff > 0:
+		w.retryLater(rn, f, backoff)
+		return
+	}
 
-		// Execute the node
-		result, err := node.Action(in, out)
-		if err != nil {
-			w.errChan <- err
+	rn.finished <- f
+}
+
+// Execute an attempt of the firing, and hand its errors to Ansible.
+// An error is dealt with by the node's error policy.
+// Return the backoff if the firing is retried, and false if the workflow has been stopped.
+func (w *workflow) execute(rn *runtimeNode, f *firing) (time.Duration, bool) {
+	rn.stats.firings.Add(1)
+	a := w.newAttempt(rn, f)
+	defer a.wait() // Also when the action panics, so the collector is done with the publisher
+	start := w.clock.Now()
+	result, err := w.act(rn, f.in, a)
+	duration := w.clock.Since(start)
+
+	if a.wait() && a.overflow && err == nil {
+		err = uerr.NewError(fmt.Errorf("%w: more than %d values", util.ErrTooManyOutputs, heldOutputLimit))
+	}
+	if err != nil {
+		rn.stats.errors.Add(1)
+		policy := rn.errorPolicy
+		decision := policy.decide(f.attempt)
+		runErr := &RunError{WorkflowID: w.id, NodeID: rn.id, RunID: f.runID, Attempt: f.attempt, Decision: decision, Err: err}
+		if decision == ErrorDeadLetter {
+			runErr.Inputs = f.in
+			w.deadLetters.add(DeadLetter{
+				WorkflowID: w.id,
+				NodeID:     rn.id,
+				RunID:      f.runID,
+				Inputs:     f.in,
+				Error:      err.Error(),
+				Attempts:   f.attempt,
+				Time:       w.clock.Now(),
+			})
+		}
+		if !w.report(runErr) {
+			return 0, false
 		}
-		if result != nil {
-			w.resultChan <- result
+
+		switch decision {
+		case ErrorRetry:
+			return policy.backoff(f.attempt), true
+		case ErrorFailWorkflow:
+			w.fail()
+			return 0, false
 		}
 	}
+
+	if err == nil {
+		f.collected = a.collected // Only the outputs of a successful attempt are sent
+	}
+	if result != nil {
+		f.results = rn.newResults(w.id, f.runID, start, duration, result)
+	}
+	return 0, true
 }
 
-func (w *workflow) listenResultAndError() {
-	// Listen edges
-	for _, e := range w.edges {
-		go e.listenEdgeOutput(w.processChan, w.c) // Listen edge output
+// Queue the firing for another attempt after the backoff.
+// Nothing waits meanwhile: the firing is queued by a timer, or given up when the node stops.
+func (w *workflow) retryLater(rn *runtimeNode, f *firing, backoff time.Duration) {
+	var (
+		mu      sync.Mutex // Held until both are set
+		claimed bool
+		timer   *clock.Timer
+		release func() bool
+	)
+	// Only the first of them goes on with the firing
+	claim := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if claimed {
+			return false
+		}
+		claimed = true
+		return true
+	}
+	giveUp := func() {
+		f.ok = false
+		rn.finished <- f
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	timer = w.clock.AfterFunc(backoff, func() {
+		if !claim() {
+			return
+		}
+		release()
+		if !w.scheduler.submit(rn.c, func() { w.fire(rn, f) }) {
+			giveUp()
+		}
+	})
+	release = context.AfterFunc(rn.c, func() {
+		if !claim() {
+			return
+		}
+		timer.Stop()
+		giveUp()
+	})
+}
+
+// Hand the error to Ansible.
+// Return false if the workflow has been stopped.
+func (w *workflow) report(err *RunError) bool {
+	w.activity.begin() // Ended when Ansible acknowledges it
+	select {
+	case w.errChan <- err:
+		return true
+	case <-w.c.Done():
+		w.activity.end()
+		return false
+	}
+}
+
+// Wait before retrying.
+// Return false if the context is cancelled.
+func (w *workflow) sleep(c context.Context, d time.Duration) bool {
+	timer := w.clock.Timer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.Done():
+		return false
 	}
 }
 
-func (e *edge) listenEdgeOutput(processChan chan hainish.Edge, cancelContext context.Context) {
+// Wait for the next value of the input port.
+// Return false if the node has been stopped, or every edge of the port has ended.
+func (w *workflow) receive(rn *runtimeNode, portName string) (runValue, bool) {
+	for !rn.portEnded(portName) {
+		select {
+		case value := <-rn.inputs[portName]:
+			end, isEnd := value.(endOfStream)
+			if !isEnd {
+				return value.(runValue), true
+			}
+			rn.endEdge(portName, int(end))
+		case <-rn.rewired:
+		case <-rn.c.Done():
+			return runValue{}, false
+		}
+	}
+	return runValue{}, false
+}
+
+// Collect the first value and all values waiting in the port into a batch.
+// The ends met are recorded, so the port ends at the next firing.
+func (rn *runtimeNode) collectBatch(first any, portName string) []hainish.Tagged {
+	batch := []hainish.Tagged{first.(hainish.Tagged)}
 	for {
 		select {
-		case result := <-e.fromPort:
-			edge := e.e
-			edge.Value = result
-			processChan <- edge
-		case <-cancelContext.Done():
-			return
+		case value := <-rn.inputs[portName]:
+			if end, isEnd := value.(endOfStream); isEnd {
+				rn.endEdge(portName, int(end))
+				continue
+			}
+			batch = append(batch, value.(runValue).value.(hainish.Tagged))
+		default:
+			return batch
 		}
 	}
 }
@@ -0,0 +1,268 @@
+package runtime
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// The most values an attempt of a node which doesn't stream may hold
+const heldOutputLimit = 4096
+
+// firing is one execution of a node, with the params and inputs it took.
+// It is attempted again when the node's error policy retries it.
+type firing struct {
+	seq   uint64 // The order the node took its firings in
+	runID string
+	in    map[string]any
+
+	// Set by the worker
+	attempt   int
+	ok        bool             // The firing is published, false if the workflow has been stopped or failed
+	collected map[string][]any // What the successful attempt has written. The key is the port name
+	results   []Result
+}
+
+func (rn *runtimeNode) newFiring(runID string, in map[string]any) *firing {
+	f := &firing{
+		seq:   rn.seq,
+		runID: runID,
+		in:    in,
+	}
+	rn.seq++
+	return f
+}
+
+// attempt is one execution of a firing's action.
+//
+// What the action writes to its output ports is collected while it runs. Unless the node
+// streams its outputs, they are held, and sent on by the node's publisher after the firing
+// has finished, so what a failed attempt has written is thrown away.
+// A streaming node's outputs are handed to the publisher as they are written.
+type attempt struct {
+	runID string
+	out   map[string]chan any // What the action writes to
+
+	collected map[string][]any // The held outputs, the key is the port name
+	held      int
+	overflow  bool // More values were written than can be held
+
+	returned  chan struct{} // Closed when the action returns
+	abandoned chan struct{} // Closed when the worker no longer waits for the action
+	collector chan struct{} // Closed when the collector has stopped
+}
+
+// A value a streaming node has written, handed to its publisher
+type output struct {
+	portName string
+	item     edgeItem
+}
+
+// Make an attempt of the firing, and start collecting its outputs
+func (w *workflow) newAttempt(rn *runtimeNode, f *firing) *attempt {
+	a := &attempt{
+		runID:     f.runID,
+		out:       make(map[string]chan any, len(rn.outputs)),
+		collected: make(map[string][]any, len(rn.outputs)),
+		returned:  make(chan struct{}),
+		abandoned: make(chan struct{}),
+		collector: make(chan struct{}),
+	}
+	for portName, size := range rn.outputs {
+		a.out[portName] = make(chan any, size)
+	}
+	if len(a.out) == 0 {
+		close(a.collector)
+		return a
+	}
+
+	w.scheduler.firingGoroutines.Add(1)
+	go func() {
+		defer w.scheduler.firingGoroutines.Add(-1)
+		w.collect(rn, a)
+	}()
+	return a
+}
+
+// Collect what the action writes to every output port, until it returns.
+// The action never waits for the collector, unless the node streams its outputs.
+func (w *workflow) collect(rn *runtimeNode, a *attempt) {
+	defer close(a.collector)
+
+	portNames := slices.Sorted(maps.Keys(a.out))
+	cases := make([]reflect.SelectCase, 0, len(portNames)+1)
+	for _, portName := range portNames {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(a.out[portName])})
+	}
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(a.returned)})
+
+	for {
+		chosen, value, _ := reflect.Select(cases)
+		if chosen < len(portNames) {
+			w.keep(rn, a, portNames[chosen], value.Interface())
+			continue
+		}
+
+		// Take what was written before the action returned
+		for _, portName := range portNames {
+			for len(a.out[portName]) > 0 {
+				w.keep(rn, a, portName, <-a.out[portName])
+			}
+		}
+		return
+	}
+}
+
+// Hold the value, or hand it to the publisher if the node streams its outputs.
+// What an abandoned action writes is thrown away.
+func (w *workflow) keep(rn *runtimeNode, a *attempt, portName string, value any) {
+	select {
+	case <-a.abandoned:
+		return
+	default:
+	}
+
+	if !rn.streaming {
+		if a.held == heldOutputLimit {
+			a.overflow = true
+			return
+		}
+		a.held++
+		a.collected[portName] = append(a.collected[portName], value)
+		return
+	}
+
+	select {
+	case rn.streamed <- output{portName: portName, item: edgeItem{runID: a.runID, value: value}}:
+	case <-a.abandoned:
+	case <-w.c.Done():
+	}
+}
+
+// Wait for the collector to take everything the action has written.
+// Return false if the action has been abandoned, and what it writes is thrown away.
+func (a *attempt) wait() bool {
+	select {
+	case <-a.abandoned:
+		return false
+	default:
+	}
+	<-a.collector
+	return true
+}
+
+// Send on the firings of the node as they finish, until the node exits.
+// When the node preserves the order, a firing waits for those taken before it.
+// The values a streaming node writes are sent on as they come.
+func (w *workflow) publishFirings(rn *runtimeNode) {
+	pending := make(map[uint64]*firing)
+	next := uint64(0)
+	for {
+		select {
+		case o := <-rn.streamed:
+			rn.stats.outputs.Add(1)
+			w.dispatch(rn, o.portName, o.item)
+		case f, ok := <-rn.finished:
+			if !ok {
+				return
+			}
+			if !rn.ordered {
+				w.publish(rn, f)
+				continue
+			}
+
+			pending[f.seq] = f
+			for f, ok := pending[next]; ok; f, ok = pending[next] {
+				delete(pending, next)
+				w.publish(rn, f)
+				next++
+			}
+		}
+	}
+}
+
+// Send what the firing has written to the edges of the node, then its results.
+// The replica and the activity of the firing are released then.
+func (w *workflow) publish(rn *runtimeNode, f *firing) {
+	defer func() {
+		<-rn.slots
+		w.activity.end()
+	}()
+	if !f.ok {
+		return
+	}
+
+	for _, portName := range slices.Sorted(maps.Keys(f.collected)) {
+		for _, value := range f.collected[portName] {
+			rn.stats.outputs.Add(1)
+			if !w.dispatch(rn, portName, edgeItem{runID: f.runID, value: value}) {
+				return
+			}
+		}
+	}
+
+	for _, r := range f.results {
+		rn.stats.results.Add(1)
+		w.activity.begin() // Ended when Ansible acknowledges it
+		select {
+		case w.resultChan <- r:
+		case <-w.c.Done():
+			w.activity.end()
+			return
+		}
+	}
+}
+
+// Check whether the node declares itself unsafe to run concurrently
+func isSerial(node hainish.Node) bool {
+	if node, ok := node.(hainish.SerialNode); ok {
+		return node.Serial()
+	}
+	return false
+}
+
+// Check whether the node declares that it streams its outputs
+func isStreaming(node hainish.Node) bool {
+	if node, ok := node.(hainish.StreamingNode); ok {
+		return node.Streaming()
+	}
+	return false
+}
+
+// SetConcurrency sets how many firings of the node may execute at the same time.
+// With ordered, the outputs and results of the node keep the order its firings took
+// their inputs in. Otherwise, they are sent as each firing finishes.
+// The outputs of a streaming node are sent as they are written either way.
+func (r *Runtime) SetConcurrency(workflowID, nodeID, replicas int, ordered bool) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+	wf.graphMu.Lock()
+	defer wf.graphMu.Unlock()
+
+	err := wf.require("set concurrency", editableStates...)
+	if err != nil {
+		return err
+	}
+
+	node, exist := wf.runtimeNodes[nodeID]
+	if !exist {
+		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+	}
+
+	if replicas < 1 {
+		return uerr.NewError(fmt.Errorf("%w: %d replicas", util.ErrInvalidConcurrency, replicas))
+	}
+	if replicas > 1 && isSerial(*node.node) {
+		return uerr.NewError(util.ErrNodeNotConcurrent)
+	}
+
+	node.replicas, node.ordered = replicas, ordered
+	return nil
+}
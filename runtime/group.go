@@ -0,0 +1,53 @@
+package runtime
+
+import "sync"
+
+// group counts goroutines like a sync.WaitGroup, but may be added to while it is waited for,
+// e.g. by a node created in a running workflow.
+type group struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // Closed when the count drops to 0
+}
+
+// Closed at once for an empty group
+var idle = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+func (g *group) add() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.n == 0 {
+		g.idle = make(chan struct{})
+	}
+	g.n++
+}
+
+func (g *group) done() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n--
+	if g.n == 0 {
+		close(g.idle)
+	}
+}
+
+// Get a channel closed once the group is empty.
+// A goroutine added after that is waited for by the next call.
+func (g *group) wait() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.n == 0 {
+		return idle
+	}
+	return g.idle
+}
+
+func (g *group) len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.n
+}
@@ -2,6 +2,10 @@ package runtime
 
 import (
 	"context"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lvyonghuan/Ubik-Util/uerr"
 	"github.com/lvyonghuan/mobiles/hainish"
@@ -9,32 +13,159 @@ import (
 )
 
 type runtimeNode struct {
+	id          int
 	node        *hainish.Node
+	key         string // The idempotency key of the command which created the node
 	outputEdges map[int]edge
-	params      map[string]any
+	inputEdges  map[int]edge
+	edgeMu      sync.RWMutex   // The edges may be edited while the workflow runs
+	params      map[string]any // Read by every firing
+	paramMu     sync.RWMutex
+
+	inputs      map[string]chan any   // Input channels of this runtime node. The key is the port name.
+	outputs     map[string]int        // Output ports of this runtime node and their capacity. The key is the port name.
+	outputModes map[string]OutputMode // How each output port distributes values among its edges.
+
+	done    chan struct{} // Closed when the node exits in the current run
+	rewired chan struct{} // Wakes the node when an input edge is removed
+
+	trigger  hainish.Trigger // When a begin node fires, declared by the node or set by the leader
+	triggers chan struct{}   // Manual triggers not fired yet
+
+	errorPolicy   ErrorPolicy   // What happens when the action returns an error
+	restartPolicy RestartPolicy // What happens when the node panics
+	timeout       time.Duration // How long an execution may take, declared by the node or set by the leader
+
+	replicas  int  // How many firings may execute at the same time
+	ordered   bool // The firings are published in the order they were taken
+	streaming bool // The outputs are sent on as they are written, declared by the node
+
+	// Only used in a run
+	c          context.Context // Cancelled when the workflow stops, or the node is removed from it
+	cancel     context.CancelFunc
+	removed    atomic.Bool            // The node has been removed from the running workflow
+	epoch      int                    // The next firing of the intake
+	seq        uint64                 // The next firing taken
+	slots      chan struct{}          // Holds a token for each firing in flight
+	finished   chan *firing           // Firings handed to the publisher
+	streamed   chan output            // Values of a streaming node handed to the publisher
+	restarts   chan time.Duration     // The backoff after a firing panicked
+	edgeQueues map[string][]edgeQueue // The queues of the edges of each output port, ordered by edge ID
+	nextEdge   map[string]int         // The next edge of each round-robin port, only used by the publisher
+
+	exhausted  atomic.Bool             // The node has run out of data in the current run
+	endedEdges map[string]map[int]bool // The edges ended on each input port in the current run
+	stats      nodeStats
+
+	// The only edge a single input port has received values from.
+	// Used when the producer lives on another follower.
+	inputSources map[string]int
+	sourceMu     sync.Mutex
 }
 
-func (rn *runtimeNode) startSendParams(stopContext context.Context) error {
-	paramPorts := (*rn.node).Params()
+func newRuntimeNode(id int, node *hainish.Node) *runtimeNode {
+	rn := &runtimeNode{
+		id:           id,
+		node:         node,
+		outputEdges:  make(map[int]edge),
+		inputEdges:   make(map[int]edge),
+		params:       make(map[string]any),
+		inputs:       make(map[string]chan any),
+		outputs:      make(map[string]int),
+		outputModes:  make(map[string]OutputMode),
+		inputSources: make(map[string]int),
+		trigger:      hainish.NodeTrigger(*node),
+		timeout:      declaredTimeout(*node),
+		replicas:     1,
+		streaming:    isStreaming(*node),
+		triggers:     make(chan struct{}, manualTriggerBuffer),
+		rewired:      make(chan struct{}, 1),
+		endedEdges:   make(map[string]map[int]bool),
+	}
 
-	for portName, param := range rn.params {
-		port, isExist := paramPorts[portName]
-		if !isExist {
-			return uerr.NewError(util.ErrPortNotExist)
+	// Each runtime node owns its input channels, so two runtime nodes
+	// created from the same plugin node don't steal each other's values.
+	for portName, port := range (*node).Inputs() {
+		rn.inputs[portName] = make(chan any, cap(port.Chan()))
+	}
+	for portName, port := range (*node).Outputs() {
+		rn.outputs[portName] = max(cap(port.Chan()), 1)
+	}
+	for portName, port := range (*node).Params() {
+		if value := hainish.PortSchema(port).Default; value != nil {
+			rn.params[portName] = value
 		}
+	}
 
-		go sendParam(param, port.Chan(), stopContext)
+	return rn
+}
+
+// Check whether the input port can take one more incoming edge
+func (rn *runtimeNode) checkIncomingEdge(edgeID int, portName string) error {
+	port, exist := (*rn.node).Inputs()[portName]
+	if !exist {
+		return uerr.NewError(util.ErrPortNotFoundInNode)
 	}
 
+	if hainish.PortMerge(port) != hainish.MergeSingle {
+		return nil
+	}
+	rn.edgeMu.RLock()
+	defer rn.edgeMu.RUnlock()
+	for id, e := range rn.inputEdges {
+		if id != edgeID && e.e.TargetPort == portName {
+			return uerr.NewError(util.ErrPortMultipleEdges)
+		}
+	}
 	return nil
 }
 
-func sendParam(param any, port chan any, stopContext context.Context) {
+// Check whether a single input port can take a value from the source edge.
+// The port is bound to the registered input edge, or to the first edge
+// it receives a value from if the edge is not registered on this follower.
+func (rn *runtimeNode) acceptSingleSource(portName string, sourceEdgeID int) bool {
+	rn.edgeMu.RLock()
+	for id, e := range rn.inputEdges {
+		if e.e.TargetPort == portName {
+			rn.edgeMu.RUnlock()
+			return id == sourceEdgeID
+		}
+	}
+	rn.edgeMu.RUnlock()
+
+	rn.sourceMu.Lock()
+	defer rn.sourceMu.Unlock()
+	source, exist := rn.inputSources[portName]
+	if !exist {
+		rn.inputSources[portName] = sourceEdgeID
+		return true
+	}
+	return source == sourceEdgeID
+}
+
+// Drop the values left in the ports by the last run
+func (rn *runtimeNode) drainPorts() {
+	for _, port := range rn.inputs {
+		drain(port)
+	}
+	for len(rn.triggers) > 0 {
+		<-rn.triggers
+	}
+}
+
+func drain(port chan any) {
 	for {
 		select {
-		case port <- param: // Send param to port
-		case <-stopContext.Done(): // Stop signal received
+		case <-port:
+		default:
 			return
 		}
 	}
 }
+
+// Get a copy of the params, the inputs of a firing are added to it
+func (rn *runtimeNode) paramValues() map[string]any {
+	rn.paramMu.RLock()
+	defer rn.paramMu.RUnlock()
+	return maps.Clone(rn.params)
+}
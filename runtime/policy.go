@@ -0,0 +1,163 @@
+package runtime
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// ErrorAction is what the runtime does when a node's action returns an error.
+type ErrorAction string
+
+const (
+	ErrorSkip         ErrorAction = ""              // Report the error and go on with the next input (default)
+	ErrorRetry        ErrorAction = "retry"         // Execute again with the same input after a backoff
+	ErrorDeadLetter   ErrorAction = "dead_letter"   // Keep the failing input in the dead-letter store, and go on
+	ErrorFailWorkflow ErrorAction = "fail_workflow" // Stop the workflow as Failed
+)
+
+// The defaults of a retry policy
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+	defaultMultiplier     = 2
+)
+
+// How many dead letters a workflow keeps, the oldest ones are dropped
+const deadLetterLimit = 1024
+
+// ErrorPolicy decides what happens when a node's action returns an error.
+// Whatever the decision, what the failed execution wrote to the output ports is not sent on,
+// unless the node streams its outputs.
+type ErrorPolicy struct {
+	Action ErrorAction `json:"Action"`
+
+	// For ErrorRetry
+	MaxAttempts    int           `json:"MaxAttempts"`    // Executions in total, including the first
+	InitialBackoff time.Duration `json:"InitialBackoff"` // Wait before the first retry
+	MaxBackoff     time.Duration `json:"MaxBackoff"`     // The backoff stops growing here
+	Multiplier     float64       `json:"Multiplier"`     // The backoff grows by this after each retry
+	Then           ErrorAction   `json:"Then"`           // What to do when the attempts run out
+}
+
+func (p ErrorPolicy) check() error {
+	switch p.Action {
+	case ErrorSkip, ErrorDeadLetter, ErrorFailWorkflow:
+		return nil
+	case ErrorRetry:
+	default:
+		return fmt.Errorf("unknown action %q", p.Action)
+	}
+
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1, got %d", p.MaxAttempts)
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 || p.Multiplier < 0 {
+		return fmt.Errorf("backoff must not be negative")
+	}
+	switch p.Then {
+	case ErrorSkip, ErrorDeadLetter, ErrorFailWorkflow:
+		return nil
+	default:
+		return fmt.Errorf("invalid action %q after retries", p.Then)
+	}
+}
+
+// Decide what to do after the attempt failed
+func (p ErrorPolicy) decide(attempt int) ErrorAction {
+	if p.Action != ErrorRetry {
+		return p.Action
+	}
+	if attempt < p.MaxAttempts {
+		return ErrorRetry
+	}
+	return p.Then
+}
+
+// Get the wait before retrying the failed attempt
+func (p ErrorPolicy) backoff(attempt int) time.Duration {
+	backoff, maxBackoff, multiplier := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if backoff == 0 {
+		backoff = defaultInitialBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	if multiplier == 0 {
+		multiplier = defaultMultiplier
+	}
+
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff = time.Duration(float64(backoff) * multiplier)
+	}
+	return min(backoff, maxBackoff)
+}
+
+// SetErrorPolicy sets what happens when the node's action returns an error.
+func (r *Runtime) SetErrorPolicy(workflowID, nodeID int, policy ErrorPolicy) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+	wf.graphMu.Lock()
+	defer wf.graphMu.Unlock()
+
+	err := wf.require("set error policy", editableStates...)
+	if err != nil {
+		return err
+	}
+
+	node, exist := wf.runtimeNodes[nodeID]
+	if !exist {
+		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+	}
+
+	err = policy.check()
+	if err != nil {
+		return uerr.NewError(fmt.Errorf("%w: %v", util.ErrInvalidErrorPolicy, err))
+	}
+
+	node.errorPolicy = policy
+	return nil
+}
+
+// DeadLetter is an input a node failed on, kept by the ErrorDeadLetter policy.
+type DeadLetter struct {
+	WorkflowID int            `json:"WorkflowID"`
+	NodeID     int            `json:"NodeID"`
+	RunID      string         `json:"RunID"`
+	Inputs     map[string]any `json:"Inputs"`
+	Error      string         `json:"Error"`
+	Attempts   int            `json:"Attempts"`
+	Time       time.Time      `json:"Time"`
+}
+
+type deadLetters struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (d *deadLetters) add(letter DeadLetter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.letters) >= deadLetterLimit {
+		d.letters = d.letters[1:]
+	}
+	d.letters = append(d.letters, letter)
+}
+
+// DeadLetters returns the inputs the nodes of the workflow failed on, oldest first.
+func (r *Runtime) DeadLetters(workflowID int) ([]DeadLetter, error) {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return nil, uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	wf.deadLetters.mu.Lock()
+	defer wf.deadLetters.mu.Unlock()
+	return append([]DeadLetter(nil), wf.deadLetters.letters...), nil
+}
@@ -0,0 +1,259 @@
+package runtime
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+
+	"github.com/lvyonghuan/mobiles/hainish"
+)
+
+// OutputMode decides how an output port distributes its values among the
+// edges attached to it.
+type OutputMode int
+
+const (
+	Broadcast  OutputMode = iota // Every edge receives every value (default)
+	RoundRobin                   // Each value goes to the next edge in turn
+)
+
+// A value waiting to be sent along an edge, or the end of the edge
+type edgeItem struct {
+	runID string
+	value any
+	end   bool
+}
+
+// The queue of an output edge, the edge's listener sends what is put into it
+type edgeQueue struct {
+	edgeID  int
+	items   chan edgeItem
+	discard chan struct{} // Closed when the edge is removed, and what is left on it is dropped
+}
+
+// Start a listener for every output edge of the node.
+// The node's publisher hands each value to the edges of its port according to
+// the port's output mode, and the listener of each edge sends them out in turn.
+func (w *workflow) listenEdges(rn *runtimeNode) {
+	rn.edgeMu.Lock()
+	defer rn.edgeMu.Unlock()
+
+	rn.edgeQueues = make(map[string][]edgeQueue)
+	rn.nextEdge = make(map[string]int)
+	for _, edgeID := range slices.Sorted(maps.Keys(rn.outputEdges)) {
+		w.listenEdge(rn, rn.outputEdges[edgeID])
+	}
+}
+
+// Start a listener for the output edge, keeping the queues of its port ordered by edge ID.
+// The caller holds the node's edge lock.
+func (w *workflow) listenEdge(rn *runtimeNode, e edge) {
+	q := edgeQueue{
+		edgeID:  e.e.SourceEdgeID,
+		items:   make(chan edgeItem, rn.outputs[e.producerPortName]),
+		discard: make(chan struct{}),
+	}
+	queues := rn.edgeQueues[e.producerPortName]
+	i, _ := slices.BinarySearchFunc(queues, q.edgeID, func(q edgeQueue, edgeID int) int {
+		return cmp.Compare(q.edgeID, edgeID)
+	})
+	rn.edgeQueues[e.producerPortName] = slices.Insert(queues, i, q)
+
+	w.listeners.add()
+	w.scheduler.edgeGoroutines.Add(1)
+	w.goRun(func() {
+		defer w.listeners.done()
+		defer w.scheduler.edgeGoroutines.Add(-1)
+		w.sendEdge(e, q)
+	})
+}
+
+// The listener keeps sending until the queue is closed after the node exits
+// or the edge is removed, so the publisher won't be blocked after the workflow is stopped.
+func (w *workflow) sendEdge(e edge, q edgeQueue) {
+	for item := range q.items {
+		select {
+		case <-q.discard:
+		default:
+			if item.end {
+				w.sendEndToEdge(e, q.discard)
+			} else {
+				w.sendToEdge(e, item.runID, item.value, q.discard)
+			}
+		}
+		w.activity.end()
+	}
+}
+
+// Stop the listener of the output edge removed from the running node.
+// The values on the edge are sent before it stops, or dropped.
+func (w *workflow) unlistenEdge(rn *runtimeNode, edgeID int, removal EdgeRemoval) {
+	find := func() (string, int) {
+		for portName, queues := range rn.edgeQueues {
+			for i, q := range queues {
+				if q.edgeID == edgeID {
+					return portName, i
+				}
+			}
+		}
+		return "", -1
+	}
+
+	// The publisher may be waiting for the listener, which must stop sending first
+	rn.edgeMu.RLock()
+	portName, i := find()
+	if i >= 0 && removal == EdgeDiscard {
+		close(rn.edgeQueues[portName][i].discard)
+	}
+	rn.edgeMu.RUnlock()
+	if i < 0 {
+		return // The node isn't running
+	}
+
+	rn.edgeMu.Lock()
+	portName, i = find()
+	if i < 0 {
+		rn.edgeMu.Unlock()
+		return // Closed by the node meanwhile
+	}
+	q := rn.edgeQueues[portName][i]
+	rn.edgeQueues[portName] = slices.Delete(rn.edgeQueues[portName], i, i+1)
+	rn.edgeMu.Unlock()
+
+	close(q.items)
+}
+
+// Hand a value written to the output port to its edges.
+// Return false if the workflow has been stopped.
+func (w *workflow) dispatch(rn *runtimeNode, portName string, item edgeItem) bool {
+	rn.edgeMu.RLock()
+	defer rn.edgeMu.RUnlock()
+
+	// A port without edges just drops the value
+	queues := rn.edgeQueues[portName]
+	if len(queues) == 0 {
+		return w.c.Err() == nil
+	}
+
+	switch rn.outputModes[portName] {
+	case RoundRobin:
+		// The edges may have changed since the last value
+		next := rn.nextEdge[portName] % len(queues)
+		rn.nextEdge[portName] = (next + 1) % len(queues)
+		return w.enqueue(queues[next], item)
+	default:
+		for _, q := range queues {
+			if !w.enqueue(q, item) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (w *workflow) enqueue(q edgeQueue, item edgeItem) bool {
+	w.activity.begin() // Ended when the listener has sent it
+	select {
+	case q.items <- item:
+		return true
+	case <-w.c.Done():
+		w.activity.end()
+		return false
+	}
+}
+
+// Close the edges of the node after it exits.
+// If the node has run out of data, the consumers are told nothing more comes.
+func (w *workflow) closeEdges(rn *runtimeNode, exhausted bool) {
+	rn.edgeMu.Lock()
+	edgeQueues := rn.edgeQueues
+	rn.edgeQueues = nil // No edge is listened to after the node exits
+	rn.edgeMu.Unlock()
+
+	for _, queues := range edgeQueues {
+		for _, q := range queues {
+			if exhausted {
+				w.enqueue(q, edgeItem{end: true})
+			}
+			close(q.items)
+		}
+	}
+}
+
+// Get the consumer of the edge if it lives on this follower.
+// The consumer node may have been created after the edge was listened to.
+// The graph lock isn't taken: whoever edits the graph may wait for the listener,
+// while the publisher holds the producer's edges.
+func (w *workflow) localConsumer(e edge) (*runtimeNode, bool) {
+	consumer, exist := w.localEdges.Load(e.e.SourceEdgeID)
+	if !exist {
+		return nil, false
+	}
+	return consumer.(*runtimeNode), true
+}
+
+// Put the value into the edge's envelope and send it out.
+// Along a local edge, the value is delivered to the consumer's port at once,
+// without going through Ansible.
+// Return false if the workflow has been stopped, or the value is discarded.
+func (w *workflow) sendToEdge(e edge, runID string, value any, discard chan struct{}) bool {
+	data := e.e
+	data.RunID = runID
+	data.Value = value
+	if consumer, ok := w.localConsumer(e); ok {
+		return w.sendLocal(consumer, data, discard)
+	}
+
+	w.activity.begin() // Ended when Ansible acknowledges it
+	select {
+	case w.processChan <- data:
+		return true
+	case <-discard:
+		w.activity.end()
+		return false
+	case <-w.c.Done():
+		w.activity.end()
+		return false
+	}
+}
+
+// Tell the consumer nothing more comes along the edge.
+// Return false if the workflow has been stopped, or the edge is discarded.
+func (w *workflow) sendEndToEdge(e edge, discard chan struct{}) bool {
+	data := e.e
+	data.EndOfStream = true
+	if consumer, ok := w.localConsumer(e); ok {
+		return w.sendLocal(consumer, data, discard)
+	}
+
+	w.activity.begin() // Ended when Ansible acknowledges it
+	select {
+	case w.processChan <- data:
+		return true
+	case <-discard:
+		w.activity.end()
+		return false
+	case <-w.c.Done():
+		w.activity.end()
+		return false
+	}
+}
+
+// Deliver the envelope to the consumer on this follower, as if Ansible had received it.
+// Ansible is told the workflow is active, as it doesn't see the envelope.
+// Return false if the workflow has been stopped, or the edge is discarded.
+func (w *workflow) sendLocal(consumer *runtimeNode, data hainish.Edge, discard chan struct{}) bool {
+	if w.onActivity != nil {
+		w.onActivity(w.id)
+	}
+
+	// Like the data received by Ansible, an envelope the consumer can't take is dropped,
+	// ValidateWorkflow tells why
+	_ = w.deliverTo(w.c, consumer, data, discard)
+	select {
+	case <-discard:
+		return false
+	default:
+		return w.c.Err() == nil
+	}
+}
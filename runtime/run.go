@@ -0,0 +1,89 @@
+package runtime
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lvyonghuan/mobiles/hainish"
+)
+
+// Result is a value returned by a node's action, with where and when it was produced.
+type Result struct {
+	WorkflowID int           `json:"WorkflowID"`
+	NodeID     int           `json:"NodeID"`
+	NodeName   string        `json:"NodeName"`
+	RunID      string        `json:"RunID"`
+	Name       string        `json:"Name"`      // Empty unless the node returns hainish.Results
+	Timestamp  time.Time     `json:"Timestamp"` // When the execution started
+	Duration   time.Duration `json:"Duration"`  // How long the execution took
+	Value      any           `json:"Value"`
+
+	Codec hainish.Codec `json:"-"` // Encodes the value for the leader
+}
+
+// Split what an action returned into results.
+// The named results are ordered by name.
+func (rn *runtimeNode) newResults(workflowID int, runID string, start time.Time, duration time.Duration, value any) []Result {
+	node := *rn.node
+	result := Result{
+		WorkflowID: workflowID,
+		NodeID:     rn.id,
+		NodeName:   node.Name(),
+		RunID:      runID,
+		Timestamp:  start,
+		Duration:   duration,
+		Value:      value,
+		Codec:      hainish.JSONCodec{},
+	}
+
+	named, ok := value.(hainish.Results)
+	if !ok {
+		return []Result{result}
+	}
+
+	results := make([]Result, 0, len(named))
+	for _, name := range slices.Sorted(maps.Keys(named)) {
+		result.Name = name
+		result.Value = named[name]
+		result.Codec = hainish.JSONCodec{}
+		if port, exist := node.Outputs()[name]; exist {
+			result.Codec = hainish.PortCodec(port)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// RunError is an error returned by a node's action, with the run it happened in
+// and what the node's error policy decided to do about it.
+type RunError struct {
+	WorkflowID int
+	NodeID     int
+	RunID      string
+	Attempt    int            // Starts from 1, 0 when the node panicked
+	Decision   ErrorAction    // What the runtime does next
+	Inputs     map[string]any // The failing input, only kept when it is dead-lettered
+	Err        error
+}
+
+func (e *RunError) Error() string {
+	return fmt.Sprintf("workflow %d: node %d: run %s: %v", e.WorkflowID, e.NodeID, e.RunID, e.Err)
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// Each firing of a begin node starts a new run
+func newRunID() string {
+	return uuid.NewString()
+}
+
+// A value waiting in an input port, with the run it belongs to
+type runValue struct {
+	runID string
+	value any
+}
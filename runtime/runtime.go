@@ -2,243 +2,845 @@ package runtime
 
 import (
 	"context"
-
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/lvyonghuan/Ubik-Util/uerr"
 	"github.com/lvyonghuan/mobiles/hainish"
 	"github.com/lvyonghuan/mobiles/util"
 )
 
+// Runtime runs the workflows of this follower.
+// Its methods may be called from concurrent goroutines, e.g. the stream handlers of Ansible.
 type Runtime struct {
 	workflows map[int]*workflow
+	mu        sync.RWMutex // Guards workflows, each workflow guards its own graph
+	deployMu  sync.Mutex   // One deployment at a time, so each is planned against the graph the last one left
 
 	nodes map[string]hainish.Node
+
+	localPeer peer.ID // The follower this runtime runs on
+
+	clock clock.Clock // Times the begin node triggers
+
+	scheduler *scheduler // Executes the node firings of every workflow
+
+	onComplete func(summary CompletionSummary)
+	onActivity func(workflowID int)
 }
 
 func InitRuntime(nodes map[string]hainish.Node) *Runtime {
 	return &Runtime{
 		workflows: make(map[int]*workflow),
 		nodes:     nodes,
+		clock:     clock.New(),
+		scheduler: newScheduler(clock.New(), defaultWorkers),
 	}
 }
 
+// SetLocalPeer tells the runtime which follower it runs on,
+// so it knows which edges are delivered to itself.
+// It is called before any workflow is created.
+func (r *Runtime) SetLocalPeer(peerID peer.ID) {
+	r.localPeer = peerID
+}
+
+func (r *Runtime) getWorkflow(workflowID int) (*workflow, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	wf, exist := r.workflows[workflowID]
+	return wf, exist
+}
+
 type workflow struct {
+	id           int
+	key          string // The idempotency key of the command which created the workflow
 	runtimeNodes map[int]*runtimeNode
+	graphMu      sync.RWMutex // The nodes and edges may be edited while the workflow runs, also guards c and cancel
+	deleted      bool         // Deleted from the runtime, nothing is created in it any more
 	c            context.Context
 	cancel       context.CancelFunc
 
-	edges map[int]edge
+	state      WorkflowState
+	stateMu    sync.Mutex
+	resume     chan struct{}   // Closed unless the workflow is paused
+	goroutines group           // Counts the goroutines of a run
+	exited     <-chan struct{} // Closed by the watcher of the last run once its goroutines have exited
+	runMu      sync.Mutex      // Runs start one at a time, so none waits for the goroutines another adds, and not during a deployment
+
+	listeners group // Counts the output listeners of a run, started under the graph lock
+
+	activity     activity
+	draining     atomic.Bool   // The begin nodes stop firing while draining
+	drained      chan struct{} // Closed when the run is drained, after the timeout is set
+	drainTimeout time.Duration
+
+	clock     clock.Clock
+	scheduler *scheduler
+
+	edges       map[int]edge
+	localEdges  sync.Map    // The consumer nodes of the edges delivered here, by edge ID. Read by the listeners without the graph lock
+	deadLetters deadLetters // Inputs the nodes failed on
 
 	resultChan  chan any
 	errChan     chan error
 	processChan chan hainish.Edge
+	onActivity  func(workflowID int) // Told about what is delivered along the local edges
 }
 
 type edge struct {
-	e              hainish.Edge
-	fromPort       chan any
-	producerNodeID int
+	e                hainish.Edge
+	producerNodeID   int
+	producerPortName string
+
+	isOutput bool // The producer node lives on this follower
+	isInput  bool // The consumer node lives on this follower
+
+	key string // The idempotency key of the command which created the edge
+}
+
+// InitWorkflow creates an empty workflow.
+// An existing workflow is not replaced, a *ConflictError is returned.
+func (r *Runtime) InitWorkflow(workflowID int) error {
+	return r.InitWorkflowWithKey("", workflowID)
 }
 
-func (r *Runtime) InitWorkflow(workflowID int) {
+// InitWorkflowWithKey creates an empty workflow by a command with the idempotency key.
+// Retrying the command with the same key succeeds without changing anything.
+func (r *Runtime) InitWorkflowWithKey(key string, workflowID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if wf, exist := r.workflows[workflowID]; exist {
+		if isRetry(key, wf.key) {
+			return nil
+		}
+		return uerr.NewError(&ConflictError{WorkflowID: workflowID, Kind: "workflow", ID: workflowID, Key: key})
+	}
+
 	// Initialize a workflow
 	// Each workflow has its own context
 	c, cancel := context.WithCancel(context.Background())
 	runtimeNodes := make(map[int]*runtimeNode)
+	resume := make(chan struct{})
+	close(resume)
 	r.workflows[workflowID] = &workflow{
+		id:           workflowID,
+		key:          key,
 		runtimeNodes: runtimeNodes,
 		c:            c,
 		cancel:       cancel,
+		resume:       resume,
+		exited:       idle,
 		edges:        make(map[int]edge),
+		clock:        r.clock,
+		scheduler:    r.scheduler,
 	}
+	return nil
 }
 
+// CreateRuntimeNode creates a node of the plugin in the workflow.
+// A node created in a running workflow starts at once.
+// An existing node is not replaced, a *ConflictError is returned.
 func (r *Runtime) CreateRuntimeNode(nodeName string, nodeID int, workflowID int) error {
+	return r.CreateRuntimeNodeWithKey("", nodeName, nodeID, workflowID)
+}
+
+// CreateRuntimeNodeWithKey creates a node by a command with the idempotency key.
+// Retrying the command with the same key succeeds without changing anything.
+func (r *Runtime) CreateRuntimeNodeWithKey(key string, nodeName string, nodeID int, workflowID int) error {
 	node, isExist := r.nodes[nodeName]
 	if !isExist {
 		return uerr.NewError(util.ErrNodeNotFoundInPlugin)
 	}
-	wf, exist := r.workflows[workflowID]
+	wf, exist := r.getWorkflow(workflowID)
 	if !exist {
 		return uerr.NewError(util.ErrWorkflowNotFound)
 	}
+	err := wf.require("create node", liveStates...)
+	if err != nil {
+		return err
+	}
+
+	// The state is read under the graph lock, which a run is started, completed and cancelled under
+	wf.graphMu.Lock()
+	defer wf.graphMu.Unlock()
+	if wf.deleted {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
 
-	// Create a runtime node
-	// TODO 这里应该有一个警告判断，当ID已经存在时
-	wf.runtimeNodes[nodeID] = &runtimeNode{
-		node:        &node,
-		outputEdges: make(map[int]edge),
-		params:      make(map[string]any),
+	if existing, exist := wf.runtimeNodes[nodeID]; exist {
+		if isRetry(key, existing.key) && (*existing.node).Name() == nodeName {
+			return nil
+		}
+		return uerr.NewError(&ConflictError{WorkflowID: workflowID, Kind: "node", ID: nodeID, Key: key})
+	}
+
+	// A node created in a running workflow must be able to start
+	running := wf.isRunning()
+	if running && node.IsBegin() {
+		err = checkTrigger(hainish.NodeTrigger(node))
+		if err != nil {
+			return uerr.NewError(fmt.Errorf("%w: %v", util.ErrInvalidTrigger, err))
+		}
+	}
+
+	rn := r.createNode(wf, node, nodeID)
+	rn.key = key
+	if running {
+		return wf.startNode(rn)
 	}
 	return nil
 }
 
+// NodeIDs returns the IDs of the workflow's nodes on this follower, in order.
+func (r *Runtime) NodeIDs(workflowID int) ([]int, error) {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return nil, uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	wf.graphMu.RLock()
+	defer wf.graphMu.RUnlock()
+	return slices.Sorted(maps.Keys(wf.runtimeNodes)), nil
+}
+
+// Create a runtime node of the plugin node without starting it.
+// The caller holds the graph lock, and has checked the ID is free.
+func (r *Runtime) createNode(wf *workflow, node hainish.Node, nodeID int) *runtimeNode {
+	// Create a runtime node
+	rn := newRuntimeNode(nodeID, &node)
+	wf.runtimeNodes[nodeID] = rn
+
+	// The edges delivered to this node may have been created before it
+	for edgeID, e := range wf.edges {
+		if e.isInput || e.e.TargetNodeID != nodeID || r.localPeer == "" || e.e.Destination != r.localPeer {
+			continue
+		}
+		if _, exist := node.Inputs()[e.e.TargetPort]; !exist {
+			continue // Leave it to ValidateWorkflow
+		}
+		e.isInput = true
+		wf.edges[edgeID] = e
+		wf.localEdges.Store(edgeID, rn)
+		rn.inputEdges[edgeID] = e
+		if e.isOutput {
+			producerNode := wf.runtimeNodes[e.producerNodeID]
+			producerNode.edgeMu.Lock()
+			producerNode.outputEdges[edgeID] = e
+			producerNode.edgeMu.Unlock()
+		}
+	}
+	return rn
+}
+
+// CreateEdge creates an edge on this follower.
+// If the producer node lives here, the edge is an output edge of it.
+// If the consumer node lives here, the edge is registered as an input edge of it,
+// and the consumer port is checked whether it accepts one more incoming edge.
+// So the leader should send the edge to both followers when they are different.
+// When both nodes live here, the values along the edge are delivered in memory.
+// On a running workflow, a producer node here starts sending along the edge at once.
+// An existing edge is not replaced, a *ConflictError is returned.
 func (r *Runtime) CreateEdge(edgeID int, destination peer.ID, workflowID int, producerNodeID int, producerPortName string, consumerNodeID int, consumerPortName string) error {
-	wf, exist := r.workflows[workflowID]
+	return r.CreateEdgeWithKey("", edgeID, destination, workflowID, producerNodeID, producerPortName, consumerNodeID, consumerPortName)
+}
+
+// CreateEdgeWithKey creates an edge by a command with the idempotency key.
+// Retrying the command with the same key succeeds without changing anything.
+func (r *Runtime) CreateEdgeWithKey(key string, edgeID int, destination peer.ID, workflowID int, producerNodeID int, producerPortName string, consumerNodeID int, consumerPortName string) error {
+	wf, exist := r.getWorkflow(workflowID)
 	if !exist {
 		return uerr.NewError(util.ErrWorkflowNotFound)
 	}
+	err := wf.require("create edge", liveStates...)
+	if err != nil {
+		return err
+	}
 
-	producerNode, exist := wf.runtimeNodes[producerNodeID]
-	if !exist {
+	wf.graphMu.Lock()
+	defer wf.graphMu.Unlock()
+	if wf.deleted {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	if existing, exist := wf.edges[edgeID]; exist {
+		spec := EdgeSpec{
+			EdgeID:           edgeID,
+			Destination:      destination,
+			ProducerNodeID:   producerNodeID,
+			ProducerPortName: producerPortName,
+			ConsumerNodeID:   consumerNodeID,
+			ConsumerPortName: consumerPortName,
+		}
+		if isRetry(key, existing.key) && specOf(existing) == spec {
+			return nil
+		}
+		return uerr.NewError(&ConflictError{WorkflowID: workflowID, Kind: "edge", ID: edgeID, Key: key})
+	}
+
+	producerNode, isProducerLocal := wf.runtimeNodes[producerNodeID]
+	consumerNode, isConsumerLocal := wf.runtimeNodes[consumerNodeID]
+	if !isProducerLocal && !isConsumerLocal {
 		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
 	}
 
-	producerPort, exist := (*producerNode.node).Outputs()[producerPortName]
-	if !exist {
-		return uerr.NewError(util.ErrPortNotFoundInNode)
+	if isProducerLocal {
+		_, exist = producerNode.outputs[producerPortName]
+		if !exist {
+			return uerr.NewError(util.ErrPortNotFoundInNode)
+		}
+	}
+
+	if isConsumerLocal {
+		err = consumerNode.checkIncomingEdge(edgeID, consumerPortName)
+		if err != nil {
+			return err
+		}
 	}
 
 	e := hainish.NewEdge(destination, workflowID, consumerNodeID, consumerPortName)
-	fromPort := producerPort.Chan()
+	e.SourceEdgeID = edgeID
 	// Add the edge to the workflow
 	wf.edges[edgeID] = edge{
-		e:              *e,
-		fromPort:       fromPort,
-		producerNodeID: producerNodeID,
+		e:                *e,
+		producerNodeID:   producerNodeID,
+		producerPortName: producerPortName,
+		isOutput:         isProducerLocal,
+		isInput:          isConsumerLocal,
+		key:              key,
+	}
+	if isConsumerLocal {
+		wf.localEdges.Store(edgeID, consumerNode)
 	}
 
 	// Add the edge to the producer node's output edges
-	producerNode.outputEdges[edgeID] = wf.edges[edgeID]
+	if isProducerLocal {
+		producerNode.edgeMu.Lock()
+		producerNode.outputEdges[edgeID] = wf.edges[edgeID]
+		if producerNode.edgeQueues != nil {
+			wf.listenEdge(producerNode, wf.edges[edgeID]) // The node is running
+		}
+		producerNode.edgeMu.Unlock()
+	}
+	// Add the edge to the consumer node's input edges
+	if isConsumerLocal {
+		consumerNode.edgeMu.Lock()
+		consumerNode.inputEdges[edgeID] = wf.edges[edgeID]
+		consumerNode.edgeMu.Unlock()
+	}
 
 	return nil
 }
 
+// RunWorkflow validates the workflow and runs it.
+// An invalid workflow is refused with a *ValidationError.
 func (r *Runtime) RunWorkflow(workflowID int, resultChan chan any, errChan chan error, processChan chan hainish.Edge) (context.Context, error) {
-	wf, exist := r.workflows[workflowID]
+	return r.runWorkflow(workflowID, false, resultChan, errChan, processChan)
+}
+
+// ForceRunWorkflow runs the workflow without validating it.
+func (r *Runtime) ForceRunWorkflow(workflowID int, resultChan chan any, errChan chan error, processChan chan hainish.Edge) (context.Context, error) {
+	return r.runWorkflow(workflowID, true, resultChan, errChan, processChan)
+}
+
+func (r *Runtime) runWorkflow(workflowID int, force bool, resultChan chan any, errChan chan error, processChan chan hainish.Edge) (context.Context, error) {
+	wf, exist := r.getWorkflow(workflowID)
 	if !exist {
 		return nil, uerr.NewError(util.ErrWorkflowNotFound)
 	}
+	wf.runMu.Lock()
+	defer wf.runMu.Unlock()
+
+	err := wf.require("run", Created, Stopped, Failed, Completed)
+	if err != nil {
+		return nil, err
+	}
+
+	if !force {
+		problems, err := r.ValidateWorkflow(workflowID)
+		if err != nil {
+			return nil, err
+		}
+		if len(problems) > 0 {
+			return nil, uerr.NewError(&ValidationError{WorkflowID: workflowID, Problems: problems})
+		}
+	}
+
+	// Wait for the last run to exit, it may have failed just now
+	<-wf.exited
+
+	// A node created while the nodes are started must not be started twice
+	wf.graphMu.Lock()
+	defer wf.graphMu.Unlock()
+	if wf.deleted {
+		return nil, uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	err = wf.transition(Running, "run")
+	if err != nil {
+		return nil, err
+	}
+
+	// A stopped workflow restarts with a fresh context and empty ports.
+	// The data sent to a workflow not yet running is kept.
+	if wf.c.Err() != nil {
+		wf.activity.busy.Store(0) // The values Ansible didn't handle are gone
+		wf.c, wf.cancel = context.WithCancel(context.Background())
+		for _, runtimeNode := range wf.runtimeNodes {
+			runtimeNode.drainPorts()
+		}
+	}
 
 	// Set the result and error channels
 	wf.resultChan = resultChan
 	wf.errChan = errChan
 	wf.processChan = processChan
+	wf.onActivity = r.onActivity
+
+	// Report to the leader when every node has run out of data,
+	// or wait for the goroutines of the run once it is stopped
+	started := wf.clock.Now()
+	drained, exited := make(chan struct{}), make(chan struct{})
+	wf.drained, wf.exited = drained, exited
+	wf.scheduler.watcherGoroutines.Add(1)
+	go wf.watchRun(started, drained, exited, r.onComplete)
 
 	// Start all nodes in the workflow
 	for _, runtimeNode := range wf.runtimeNodes {
-		// Start sending params if any
-		err := runtimeNode.startSendParams(wf.c)
+		err = wf.startNode(runtimeNode)
 		if err != nil {
+			wf.fail()
 			return nil, err
 		}
+	}
+
+	return wf.c, nil
+}
 
-		// Listen for results and errors
-		go wf.listenResultAndError()
+// Start the node in the current run.
+// The caller holds the graph lock.
+func (wf *workflow) startNode(rn *runtimeNode) error {
+	rn.resetRun()
 
-		// Run each node in a separate goroutine
-		go wf.runNode(*runtimeNode.node)
+	// A begin node fires according to its trigger
+	var t *trigger
+	if (*rn.node).IsBegin() {
+		var err error
+		t, err = wf.newTrigger(rn)
+		if err != nil {
+			return err
+		}
 	}
 
-	return wf.c, nil
+	// The node is stopped with the workflow, or when it is removed
+	rn.c, rn.cancel = context.WithCancel(wf.c)
+
+	// Send on the outputs, one listener for each edge
+	wf.listenEdges(rn)
+
+	// Run each node in a separate goroutine
+	rn.done = make(chan struct{})
+	wf.goRun(func() {
+		defer close(rn.done)
+		if t != nil {
+			defer t.stop()
+		}
+		exhausted := wf.runNode(rn, t)
+		rn.exhausted.Store(exhausted)
+		wf.closeEdges(rn, exhausted)
+	})
+	return nil
+}
+
+// Check whether the nodes of the workflow are started
+func (wf *workflow) isRunning() bool {
+	state := wf.getState()
+	return state == Running || state == Paused
 }
 
 func (r *Runtime) StopWorkflow(workflowID int) error {
-	wf, exist := r.workflows[workflowID]
+	wf, exist := r.getWorkflow(workflowID)
 	if !exist {
 		return uerr.NewError(util.ErrWorkflowNotFound)
 	}
 
-	// Stop the workflow by cancelling its context
-	wf.cancel()
+	err := wf.transition(Stopping, "stop")
+	if err != nil {
+		return err
+	}
+
+	// Stop the workflow by cancelling its context.
+	// The watcher of the run marks it stopped when all its goroutines have exited.
+	wf.stop()
 	return nil
 }
 
+// PauseWorkflow holds every node of the workflow at its next epoch boundary.
+// The data in the ports and on the way is kept.
+func (r *Runtime) PauseWorkflow(workflowID int) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	return wf.transition(Paused, "pause")
+}
+
+// ResumeWorkflow lets the nodes of a paused workflow continue.
+func (r *Runtime) ResumeWorkflow(workflowID int) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	err := wf.require("resume", Paused)
+	if err != nil {
+		return err
+	}
+	return wf.transition(Running, "resume")
+}
+
 func (r *Runtime) DeleteWorkflow(workflowID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	wf, exist := r.workflows[workflowID]
 	if !exist {
 		return uerr.NewError(util.ErrWorkflowNotFound)
 	}
 
-	// FIXME 其他状态检测
-	wf.cancel() // Ensure the workflow is stopped
+	// The workflow can't be run while it is deleted
+	wf.graphMu.Lock()
+	defer wf.graphMu.Unlock()
+
+	// A running workflow should be stopped first
+	err := wf.require("delete workflow", Created, Stopped, Failed, Completed)
+	if err != nil {
+		return err
+	}
+	wf.cancel() // Release the context
+	wf.deleted = true
 
 	delete(r.workflows, workflowID)
 	return nil
 }
 
+// DeleteNode deletes a node without edges from the workflow.
+// A running node is stopped first, and the firings it has taken are published.
 func (r *Runtime) DeleteNode(workflowID, nodeID int) error {
-	wf, exist := r.workflows[workflowID]
+	wf, exist := r.getWorkflow(workflowID)
 	if !exist {
 		return uerr.NewError(util.ErrWorkflowNotFound)
 	}
 
-	wf.cancel() // Ensure the workflow is stopped
+	err := wf.require("delete node", liveStates...)
+	if err != nil {
+		return err
+	}
 
+	wf.graphMu.Lock()
 	node, exist := wf.runtimeNodes[nodeID]
 	if !exist {
+		wf.graphMu.Unlock()
 		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
 	}
 
 	//Ensure this node don't have any edge
-	if len(node.outputEdges) > 0 {
+	node.edgeMu.RLock()
+	hasEdges := len(node.outputEdges) > 0 || len(node.inputEdges) > 0
+	node.edgeMu.RUnlock()
+	if hasEdges {
+		wf.graphMu.Unlock()
 		return uerr.NewError(util.ErrDeletingNodeHasEdges)
 	}
 
 	// Delete the node
 	delete(wf.runtimeNodes, nodeID)
+	wf.graphMu.Unlock()
+
+	// Stop the node if it has been started
+	if node.cancel != nil {
+		node.removed.Store(true)
+		node.cancel()
+		<-node.done
+	}
 	return nil
 }
 
+// EdgeRemoval decides what happens to the values on the way along an edge
+// removed from a running workflow.
+type EdgeRemoval int
+
+const (
+	EdgeDrain   EdgeRemoval = iota // The values are sent before the edge is removed (default)
+	EdgeDiscard                    // The values are dropped
+)
+
+// DeleteEdge deletes an edge, the values on the way along it are sent first.
 func (r *Runtime) DeleteEdge(workflowID, edgeID int) error {
-	wf, exist := r.workflows[workflowID]
+	return r.RemoveEdge(workflowID, edgeID, EdgeDrain)
+}
+
+// RemoveEdge deletes an edge, and stops its listener if the producer node is running.
+// The values on the way along the edge are sent or dropped according to the removal.
+// A discarded edge also drops the values waiting in the consumer's input port,
+// if the port takes a single edge.
+func (r *Runtime) RemoveEdge(workflowID, edgeID int, removal EdgeRemoval) error {
+	wf, exist := r.getWorkflow(workflowID)
 	if !exist {
 		return uerr.NewError(util.ErrWorkflowNotFound)
 	}
 
+	err := wf.require("delete edge", liveStates...)
+	if err != nil {
+		return err
+	}
+
+	if removal != EdgeDrain && removal != EdgeDiscard {
+		return uerr.NewError(fmt.Errorf("%w: %d", util.ErrInvalidEdgeRemoval, removal))
+	}
+
+	wf.graphMu.Lock()
 	edge, exist := wf.edges[edgeID]
 	if !exist {
-		return uerr.NewError(util.ErrPortNotFoundInNode)
+		wf.graphMu.Unlock()
+		return uerr.NewError(util.ErrEdgeNotFoundInWorkflow)
 	}
 
-	// Delete the edge from the producer node's output edges
-	producerNode, exist := wf.runtimeNodes[edge.producerNodeID]
-	if !exist {
-		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+	var producerNode, consumerNode *runtimeNode
+	if edge.isOutput {
+		producerNode, exist = wf.runtimeNodes[edge.producerNodeID]
+		if !exist {
+			wf.graphMu.Unlock()
+			return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+		}
+	}
+	if edge.isInput {
+		consumerNode, exist = wf.runtimeNodes[edge.e.TargetNodeID]
+		if !exist {
+			wf.graphMu.Unlock()
+			return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+		}
 	}
-	delete(producerNode.outputEdges, edgeID)
 
-	// Delete the edge from the workflow
+	// Delete the edge from the workflow, and from the nodes' edges
 	delete(wf.edges, edgeID)
+	wf.localEdges.Delete(edgeID)
+	if producerNode != nil {
+		producerNode.edgeMu.Lock()
+		delete(producerNode.outputEdges, edgeID)
+		producerNode.edgeMu.Unlock()
+	}
+	if consumerNode != nil {
+		consumerNode.edgeMu.Lock()
+		delete(consumerNode.inputEdges, edgeID)
+		consumerNode.edgeMu.Unlock()
+	}
+	wf.graphMu.Unlock()
+
+	// The listener may wait for Ansible to take the values, so the graph isn't held meanwhile
+	if producerNode != nil {
+		wf.unlistenEdge(producerNode, edgeID, removal)
+	}
+
+	if consumerNode != nil {
+		port := (*consumerNode.node).Inputs()[edge.e.TargetPort]
+		if removal == EdgeDiscard && hainish.PortMerge(port) == hainish.MergeSingle {
+			drain(consumerNode.inputs[edge.e.TargetPort])
+		}
+
+		// The port may have ended without the edge
+		select {
+		case consumerNode.rewired <- struct{}{}:
+		default:
+		}
+	}
 	return nil
 }
 
+// SetParam sets a param of the node, checked against the schema of its port.
+// On a running workflow, the value is taken by the next firing of the node.
+// A node implementing hainish.ParamNode is told about the new value.
 func (r *Runtime) SetParam(workflowID, nodeID int, portName string, value any) error {
-	wf, exist := r.workflows[workflowID]
+	wf, exist := r.getWorkflow(workflowID)
 	if !exist {
 		return uerr.NewError(util.ErrWorkflowNotFound)
 	}
 
-	node, exist := wf.runtimeNodes[nodeID]
+	err := wf.require("set param", liveStates...)
+	if err != nil {
+		return err
+	}
+
+	node, exist := wf.node(nodeID)
 	if !exist {
 		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
 	}
 
+	port, exist := (*node.node).Params()[portName]
+	if !exist {
+		return uerr.NewError(util.ErrPortNotExist)
+	}
+
+	value, err = hainish.PortSchema(port).Validate(value)
+	if err != nil {
+		return uerr.NewError(fmt.Errorf("%w: %s: %v", util.ErrInvalidParam, portName, err))
+	}
+
+	node.paramMu.Lock()
 	node.params[portName] = value
+	node.paramMu.Unlock()
+
+	if paramNode, ok := (*node.node).(hainish.ParamNode); ok {
+		paramNode.ParamChanged(portName, value)
+	}
+	return nil
+}
+
+// SetOutputMode sets how the values produced on an output port are
+// distributed among the edges attached to it.
+func (r *Runtime) SetOutputMode(workflowID, nodeID int, portName string, mode OutputMode) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+	wf.graphMu.Lock() // The settings are read when the workflow starts
+	defer wf.graphMu.Unlock()
+
+	err := wf.require("set output mode", editableStates...)
+	if err != nil {
+		return err
+	}
+
+	node, exist := wf.runtimeNodes[nodeID]
+	if !exist {
+		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+	}
+
+	_, exist = node.outputs[portName]
+	if !exist {
+		return uerr.NewError(util.ErrPortNotFoundInNode)
+	}
+
+	if mode != Broadcast && mode != RoundRobin {
+		return uerr.NewError(util.ErrInvalidOutputMode)
+	}
+
+	node.outputModes[portName] = mode
 	return nil
 }
 
 func (r *Runtime) PassingProcessDataToRuntimeNode(data hainish.Edge) error {
-	wf, exist := r.workflows[data.TargetWorkflowID]
+	wf, exist := r.getWorkflow(data.TargetWorkflowID)
 	if !exist {
 		return uerr.NewError(util.ErrWorkflowNotFound)
 	}
 
-	node, exist := wf.runtimeNodes[data.TargetNodeID]
+	// Data may arrive before this follower runs the workflow,
+	// or while it is draining
+	err := wf.require("pass data", Created, Running, Paused, Stopping)
+	if err != nil {
+		return err
+	}
+
+	wf.graphMu.RLock()
+	c := wf.c // The context of the current run
+	wf.graphMu.RUnlock()
+	return wf.deliver(c, data, nil)
+}
+
+// Deliver the value, or the end of its edge, to the input port of the consumer node.
+// Delivering stops when the context is cancelled, or the discard channel is closed.
+func (wf *workflow) deliver(c context.Context, data hainish.Edge, discard chan struct{}) error {
+	node, exist := wf.node(data.TargetNodeID)
 	if !exist {
+		wf.activity.touch()
 		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
 	}
+	return wf.deliverTo(c, node, data, discard)
+}
+
+// Deliver the value, or the end of its edge, to the input port of the node.
+func (wf *workflow) deliverTo(c context.Context, node *runtimeNode, data hainish.Edge, discard chan struct{}) error {
+	wf.activity.touch()
 
 	port, exist := (*node.node).Inputs()[data.TargetPort]
 	if !exist {
 		return uerr.NewError(util.ErrPortNotFoundInNode)
 	}
 
-	// Send data to the port
-	select { // Non-blocking send to avoid deadlock
-	case port.Chan() <- data.Value:
-	case <-wf.c.Done():
+	// The end of an edge follows its last value
+	if data.EndOfStream {
+		if hainish.PortMerge(port) == hainish.MergeSingle && !node.acceptSingleSource(data.TargetPort, data.SourceEdgeID) {
+			return uerr.NewError(util.ErrPortMultipleEdges)
+		}
+		select {
+		case node.inputs[data.TargetPort] <- endOfStream(data.SourceEdgeID):
+		case <-discard:
+		case <-c.Done():
+		}
 		return nil
 	}
+
+	// Merge the value according to the port's merge mode
+	var value any
+	switch hainish.PortMerge(port) {
+	case hainish.MergeInterleave:
+		value = data.Value
+	case hainish.MergeTagged, hainish.MergeBatch:
+		value = hainish.Tagged{EdgeID: data.SourceEdgeID, RunID: data.RunID, Value: data.Value}
+	default:
+		// A single port only takes values from one edge
+		if !node.acceptSingleSource(data.TargetPort, data.SourceEdgeID) {
+			return uerr.NewError(util.ErrPortMultipleEdges)
+		}
+		value = data.Value
+	}
+
+	// Wait for the port to take the value, unless the edge is discarded or the run stopped meanwhile
+	select {
+	case node.inputs[data.TargetPort] <- runValue{runID: data.RunID, value: value}:
+	case <-discard:
+	case <-c.Done():
+	}
 	return nil
 }
+
+// Get a node of the workflow, whose graph may be edited meanwhile
+func (wf *workflow) node(nodeID int) (*runtimeNode, bool) {
+	wf.graphMu.RLock()
+	defer wf.graphMu.RUnlock()
+	rn, exist := wf.runtimeNodes[nodeID]
+	return rn, exist
+}
+
+// Run a goroutine which belongs to the current run of the workflow
+func (wf *workflow) goRun(f func()) {
+	wf.goroutines.add()
+	go func() {
+		defer wf.goroutines.done()
+		f()
+	}()
+}
+
+// Cancel the context of the current run, which may be starting
+func (wf *workflow) stop() {
+	wf.graphMu.RLock()
+	defer wf.graphMu.RUnlock()
+	wf.cancel()
+}
+
+// Stop the workflow because of an error
+func (wf *workflow) fail() {
+	if wf.transition(Failed, "fail") != nil {
+		return // Already stopped or failed
+	}
+	wf.cancel()
+}
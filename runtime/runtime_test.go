@@ -1,10 +1,19 @@
 package runtime
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/lvyonghuan/Ubik-Util/uerr"
 	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/util"
 )
 
 // mockNode simulates node implementation
@@ -12,6 +21,8 @@ type mockNode struct {
 	name        string
 	description string
 	isBegin     bool
+	isEnd       bool
+	trigger     hainish.Trigger
 	inputs      map[string]hainish.Port
 	outputs     map[string]hainish.Port
 	params      map[string]hainish.Port
@@ -30,6 +41,14 @@ func (m *mockNode) IsBegin() bool {
 	return m.isBegin
 }
 
+func (m *mockNode) IsEnd() bool {
+	return m.isEnd
+}
+
+func (m *mockNode) Trigger() hainish.Trigger {
+	return m.trigger
+}
+
 func (m *mockNode) Inputs() map[string]hainish.Port {
 	return m.inputs
 }
@@ -51,6 +70,7 @@ type mockPort struct {
 	name        string
 	description string
 	portType    string
+	merge       hainish.MergeMode
 	channel     chan any
 }
 
@@ -66,6 +86,10 @@ func (m *mockPort) Type() string {
 	return m.portType
 }
 
+func (m *mockPort) Merge() hainish.MergeMode {
+	return m.merge
+}
+
 func (m *mockPort) Chan() chan any {
 	return m.channel
 }
@@ -310,7 +334,7 @@ func TestWorkflowExecution(t *testing.T) {
 	// Check for results
 	select {
 	case result := <-resultChan:
-		if result != "completed" {
+		if result.(Result).Value != "completed" {
 			t.Errorf("Expected result 'completed', got '%v'", result)
 		}
 	default:
@@ -377,3 +401,2900 @@ func TestWorkflowStop(t *testing.T) {
 		t.Error("Expected workflow context to be cancelled")
 	}
 }
+
+// newCounterNode creates a begin node that writes 1, 2, 3... to its output port
+func newCounterNode() *mockNode {
+	count := 0
+	return &mockNode{
+		name:        "counterNode",
+		description: "Counter Node",
+		isBegin:     true,
+		inputs:      map[string]hainish.Port{},
+		outputs: map[string]hainish.Port{"output1": &mockPort{
+			name:     "output1",
+			portType: "int",
+			channel:  make(chan any, 1),
+		}},
+		params: map[string]hainish.Port{},
+		action: func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+			count++
+			output["output1"] <- count
+			return nil, nil
+		},
+	}
+}
+
+// runFanOutWorkflow runs a counter node whose output port feeds two edges,
+// and returns the first n envelopes sent out of the workflow.
+func runFanOutWorkflow(t *testing.T, mode OutputMode, n int) []hainish.Edge {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode()})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+
+	if err := runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1"); err != nil {
+		t.Fatalf("Unexpected error creating edge: %v", err)
+	}
+	if err := runtime.CreateEdge(2, "peer456", 1, 1, "output1", 3, "input1"); err != nil {
+		t.Fatalf("Unexpected error creating edge: %v", err)
+	}
+	if err := runtime.SetOutputMode(1, 1, "output1", mode); err != nil {
+		t.Fatalf("Unexpected error setting output mode: %v", err)
+	}
+
+	processChan := make(chan hainish.Edge, 1)
+	_, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan)
+	if err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	var received []hainish.Edge
+	for len(received) < n {
+		select {
+		case data := <-processChan:
+			received = append(received, data)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out after receiving %d values", len(received))
+		}
+	}
+	return received
+}
+
+// valuesByNode groups the values of the envelopes by their target node.
+// Each edge has its own listener, so only the order along an edge is kept.
+func valuesByNode(received []hainish.Edge) map[int][]any {
+	values := make(map[int][]any)
+	for _, data := range received {
+		values[data.TargetNodeID] = append(values[data.TargetNodeID], data.Value)
+	}
+	return values
+}
+
+// TestOutputBroadcast tests that every edge of a port receives every value
+func TestOutputBroadcast(t *testing.T) {
+	received := runFanOutWorkflow(t, Broadcast, 8)
+
+	values := valuesByNode(received)
+	if len(values) != 2 || len(values[2]) == 0 || len(values[3]) == 0 {
+		t.Fatalf("Expected values delivered to nodes 2 and 3, got %v", values)
+	}
+	for nodeID, nodeValues := range values {
+		for i, value := range nodeValues {
+			if value != i+1 {
+				t.Errorf("Node %d: expected value %d, got %v", nodeID, i+1, value)
+			}
+		}
+	}
+}
+
+// TestOutputRoundRobin tests that the values of a port are spread among its edges
+func TestOutputRoundRobin(t *testing.T) {
+	received := runFanOutWorkflow(t, RoundRobin, 8)
+
+	values := valuesByNode(received)
+	if len(values) != 2 || len(values[2]) == 0 || len(values[3]) == 0 {
+		t.Fatalf("Expected values delivered to nodes 2 and 3, got %v", values)
+	}
+	for nodeID, nodeValues := range values {
+		for i, value := range nodeValues {
+			// Node 2 takes the odd values, and node 3 the even ones
+			expected := 2*i + nodeID - 1
+			if value != expected {
+				t.Errorf("Node %d: expected value %d, got %v", nodeID, expected, value)
+			}
+		}
+	}
+}
+
+// TestSetOutputModeInvalid tests setting an output mode on a missing port or with a bad mode
+func TestSetOutputModeInvalid(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode()})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+
+	if err := runtime.SetOutputMode(1, 1, "missing", RoundRobin); err == nil {
+		t.Error("Expected error when setting the mode of a missing port")
+	}
+	if err := runtime.SetOutputMode(1, 1, "output1", OutputMode(42)); err == nil {
+		t.Error("Expected error when setting an unknown mode")
+	}
+}
+
+// newEchoNode creates a node which returns whatever it receives on input1 as its result
+func newEchoNode(merge hainish.MergeMode, buffer int) *mockNode {
+	return &mockNode{
+		name:        "echoNode",
+		description: "Echo Node",
+		inputs: map[string]hainish.Port{"input1": &mockPort{
+			name:     "input1",
+			portType: "any",
+			merge:    merge,
+			channel:  make(chan any, buffer),
+		}},
+		outputs: map[string]hainish.Port{},
+		params:  map[string]hainish.Port{},
+		action: func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+			return inputs["input1"], nil
+		},
+	}
+}
+
+// TestCreateEdgeFanIn tests the validation of edges converging on one input port
+func TestCreateEdgeFanIn(t *testing.T) {
+	nodes := map[string]hainish.Node{
+		"counterNode": newCounterNode(),
+		"singleNode":  newEchoNode(hainish.MergeSingle, 1),
+		"mergeNode":   newEchoNode(hainish.MergeInterleave, 1),
+	}
+	runtime := InitRuntime(nodes)
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("singleNode", 2, 1)
+	runtime.CreateRuntimeNode("mergeNode", 3, 1)
+
+	// A single port accepts only one edge
+	if err := runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1"); err != nil {
+		t.Errorf("Unexpected error creating edge: %v", err)
+	}
+	if err := runtime.CreateEdge(2, "peer123", 1, 1, "output1", 2, "input1"); err == nil {
+		t.Error("Expected error when creating a second edge into a single port")
+	}
+
+	// A merging port accepts many
+	if err := runtime.CreateEdge(3, "peer123", 1, 1, "output1", 3, "input1"); err != nil {
+		t.Errorf("Unexpected error creating edge: %v", err)
+	}
+	if err := runtime.CreateEdge(4, "peer123", 1, 1, "output1", 3, "input1"); err != nil {
+		t.Errorf("Unexpected error creating second edge into a merging port: %v", err)
+	}
+
+	// The consumer port must exist
+	if err := runtime.CreateEdge(5, "peer123", 1, 1, "output1", 3, "missing"); err == nil {
+		t.Error("Expected error when creating an edge into a missing port")
+	}
+
+	if len(runtime.workflows[1].runtimeNodes[3].inputEdges) != 2 {
+		t.Errorf("Expected 2 input edges on node 3, got %d", len(runtime.workflows[1].runtimeNodes[3].inputEdges))
+	}
+}
+
+// TestSingleInputRejectsSecondSource tests that a single port rejects values from another remote edge
+func TestSingleInputRejectsSecondSource(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"echoNode": newEchoNode(hainish.MergeSingle, 2)})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("echoNode", 1, 1)
+
+	data := hainish.Edge{TargetWorkflowID: 1, TargetNodeID: 1, TargetPort: "input1", SourceEdgeID: 7, Value: "a"}
+	if err := runtime.PassingProcessDataToRuntimeNode(data); err != nil {
+		t.Errorf("Unexpected error passing data: %v", err)
+	}
+
+	data.SourceEdgeID = 8
+	if err := runtime.PassingProcessDataToRuntimeNode(data); err == nil {
+		t.Error("Expected error when a single port receives values from a second edge")
+	}
+}
+
+// runFanInWorkflow delivers values from two edges into the echo node and returns its first result
+func runFanInWorkflow(t *testing.T, merge hainish.MergeMode) any {
+	runtime := InitRuntime(map[string]hainish.Node{"echoNode": newEchoNode(merge, 2)})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("echoNode", 1, 1)
+
+	// The producers live on another follower
+	runtime.CreateEdge(1, "peer123", 1, 10, "output1", 1, "input1")
+	runtime.CreateEdge(2, "peer123", 1, 11, "output1", 1, "input1")
+
+	for edgeID, value := range map[int]string{1: "a", 2: "b"} {
+		data := hainish.Edge{TargetWorkflowID: 1, TargetNodeID: 1, TargetPort: "input1", SourceEdgeID: edgeID, Value: value}
+		if err := runtime.PassingProcessDataToRuntimeNode(data); err != nil {
+			t.Fatalf("Unexpected error passing data: %v", err)
+		}
+	}
+
+	resultChan := make(chan any, 1)
+	_, err := runtime.RunWorkflow(1, resultChan, make(chan error, 1), make(chan hainish.Edge, 1))
+	if err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	select {
+	case result := <-resultChan:
+		return result.(Result).Value
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for result")
+		return nil
+	}
+}
+
+// TestMergeTagged tests that a tagged port tells which edge each value came from
+func TestMergeTagged(t *testing.T) {
+	result := runFanInWorkflow(t, hainish.MergeTagged)
+
+	tagged, ok := result.(hainish.Tagged)
+	if !ok {
+		t.Fatalf("Expected a hainish.Tagged, got %T", result)
+	}
+	expected := map[int]string{1: "a", 2: "b"}
+	if expected[tagged.EdgeID] != tagged.Value {
+		t.Errorf("Value %v is tagged with the wrong edge %d", tagged.Value, tagged.EdgeID)
+	}
+}
+
+// TestMergeBatch tests that a batch port collects all waiting values in one firing
+func TestMergeBatch(t *testing.T) {
+	result := runFanInWorkflow(t, hainish.MergeBatch)
+
+	batch, ok := result.([]hainish.Tagged)
+	if !ok {
+		t.Fatalf("Expected a []hainish.Tagged, got %T", result)
+	}
+	if len(batch) != 2 {
+		t.Fatalf("Expected a batch of 2 values, got %d", len(batch))
+	}
+	expected := map[int]string{1: "a", 2: "b"}
+	for _, tagged := range batch {
+		if expected[tagged.EdgeID] != tagged.Value {
+			t.Errorf("Value %v is tagged with the wrong edge %d", tagged.Value, tagged.EdgeID)
+		}
+	}
+}
+
+// newRelayNode creates a non-begin node which passes input1 to output1
+func newRelayNode() *mockNode {
+	return &mockNode{
+		name:        "relayNode",
+		description: "Relay Node",
+		inputs: map[string]hainish.Port{"input1": &mockPort{
+			name:     "input1",
+			portType: "any",
+			channel:  make(chan any, 1),
+		}},
+		outputs: map[string]hainish.Port{"output1": &mockPort{
+			name:     "output1",
+			portType: "any",
+			channel:  make(chan any, 1),
+		}},
+		params: map[string]hainish.Port{},
+		action: func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+			output["output1"] <- inputs["input1"]
+			return nil, nil
+		},
+	}
+}
+
+// hasProblem reports whether the problems contain one of the kind on the node
+func hasProblem(problems []Problem, kind ProblemKind, nodeID int) bool {
+	for _, problem := range problems {
+		if problem.Kind == kind && problem.NodeID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// TestValidateWorkflow tests the problems found in a broken graph
+func TestValidateWorkflow(t *testing.T) {
+	nodes := map[string]hainish.Node{
+		"counterNode": newCounterNode(),
+		"relayNode":   newRelayNode(),
+	}
+	runtime := InitRuntime(nodes)
+	runtime.SetLocalPeer("self")
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("relayNode", 2, 1) // No producer
+	runtime.CreateRuntimeNode("relayNode", 3, 1) // 3 and 4 feed each other
+	runtime.CreateRuntimeNode("relayNode", 4, 1)
+
+	runtime.CreateEdge(1, "self", 1, 1, "output1", 9, "input1") // Node 9 doesn't exist
+	runtime.CreateEdge(2, "self", 1, 3, "output1", 4, "input1")
+	runtime.CreateEdge(3, "self", 1, 4, "output1", 3, "input1")
+
+	problems, err := runtime.ValidateWorkflow(1)
+	if err != nil {
+		t.Fatalf("Unexpected error validating workflow: %v", err)
+	}
+
+	if !hasProblem(problems, ProblemDanglingEdge, 9) {
+		t.Error("Expected a dangling edge to node 9")
+	}
+	if !hasProblem(problems, ProblemMissingProducer, 2) {
+		t.Error("Expected node 2 to miss its producer")
+	}
+	if !hasProblem(problems, ProblemCycleWithoutBegin, 3) {
+		t.Error("Expected nodes 3 and 4 to form a cycle without begin node")
+	}
+	if len(problems) != 3 {
+		t.Errorf("Expected 3 problems, got %d: %v", len(problems), problems)
+	}
+
+	// Refuse to run it, unless forced
+	_, err = runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), make(chan hainish.Edge, 1))
+	if err == nil {
+		t.Error("Expected error when running an invalid workflow")
+	}
+	_, err = runtime.ForceRunWorkflow(1, make(chan any, 1), make(chan error, 1), make(chan hainish.Edge, 1))
+	if err != nil {
+		t.Errorf("Unexpected error force running workflow: %v", err)
+	}
+	runtime.StopWorkflow(1)
+}
+
+// TestValidateWorkflowEdgeBeforeNode tests an edge created before its local consumer
+func TestValidateWorkflowEdgeBeforeNode(t *testing.T) {
+	nodes := map[string]hainish.Node{
+		"counterNode": newCounterNode(),
+		"relayNode":   newRelayNode(),
+	}
+	runtime := InitRuntime(nodes)
+	runtime.SetLocalPeer("self")
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateEdge(1, "self", 1, 1, "output1", 2, "input1")
+	runtime.CreateRuntimeNode("relayNode", 2, 1)
+
+	problems, err := runtime.ValidateWorkflow(1)
+	if err != nil {
+		t.Fatalf("Unexpected error validating workflow: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Expected no problem, got %v", problems)
+	}
+}
+
+// waitForState waits until the workflow reaches the state
+func waitForState(t *testing.T, runtime *Runtime, workflowID int, expected WorkflowState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		state, err := runtime.WorkflowState(workflowID)
+		if err != nil {
+			t.Fatalf("Unexpected error querying state: %v", err)
+		}
+		if state == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected workflow state %s, got %s", expected, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForStates waits until the workflow reaches one of the states
+func waitForStates(t *testing.T, runtime *Runtime, workflowID int, expected ...WorkflowState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		state, err := runtime.WorkflowState(workflowID)
+		if err != nil {
+			t.Fatalf("Unexpected error querying state: %v", err)
+		}
+		if slices.Contains(expected, state) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected workflow state in %v, got %s", expected, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// isStateError reports whether the error is a *StateError
+func isStateError(err error) bool {
+	ubikErr, ok := err.(uerr.UbikError)
+	if !ok {
+		return false
+	}
+	_, ok = ubikErr.MetaError().(*StateError)
+	return ok
+}
+
+// TestWorkflowStateTransitions tests the workflow state machine
+func TestWorkflowStateTransitions(t *testing.T) {
+	nodes := map[string]hainish.Node{
+		"counterNode": newCounterNode(),
+		"relayNode":   newRelayNode(),
+	}
+	runtime := InitRuntime(nodes)
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("relayNode", 2, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+
+	waitForState(t, runtime, 1, Created)
+
+	// Stop before running is illegal
+	if err := runtime.StopWorkflow(1); !isStateError(err) {
+		t.Errorf("Expected a state error when stopping a created workflow, got %v", err)
+	}
+
+	_, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), make(chan hainish.Edge, 1))
+	if err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	waitForState(t, runtime, 1, Running)
+
+	// A running workflow can't be run twice, or deleted
+	_, err = runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), make(chan hainish.Edge, 1))
+	if !isStateError(err) {
+		t.Errorf("Expected a state error when running a running workflow, got %v", err)
+	}
+	if err = runtime.SetTimeout(1, 1, time.Second); !isStateError(err) {
+		t.Errorf("Expected a state error when setting a timeout of a running workflow, got %v", err)
+	}
+	if err = runtime.DeleteWorkflow(1); !isStateError(err) {
+		t.Errorf("Expected a state error when deleting a running workflow, got %v", err)
+	}
+
+	if stats := runtime.SchedulerStats(); stats.WatcherGoroutines != 1 {
+		t.Errorf("Expected the watcher of the run, got %+v", stats)
+	}
+	if err = runtime.StopWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error stopping workflow: %v", err)
+	}
+	waitForState(t, runtime, 1, Stopped)
+	waitForRunGoroutines(t, runtime)
+
+	// A stopped workflow can be edited and deleted
+	if err = runtime.DeleteEdge(1, 1); err != nil {
+		t.Errorf("Unexpected error deleting edge: %v", err)
+	}
+	if err = runtime.DeleteNode(1, 2); err != nil {
+		t.Errorf("Unexpected error deleting node: %v", err)
+	}
+	if err = runtime.DeleteWorkflow(1); err != nil {
+		t.Errorf("Unexpected error deleting workflow: %v", err)
+	}
+}
+
+// TestWorkflowRestart tests running a workflow again after stopping it
+func TestWorkflowRestart(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode()})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+
+	for run := 0; run < 2; run++ {
+		processChan := make(chan hainish.Edge, 1)
+		ctx, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan)
+		if err != nil {
+			t.Fatalf("Run %d: unexpected error running workflow: %v", run, err)
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("Run %d: expected a live context", run)
+		}
+
+		select {
+		case <-processChan:
+		case <-time.After(time.Second):
+			t.Fatalf("Run %d: timed out waiting for data", run)
+		}
+
+		if err = runtime.StopWorkflow(1); err != nil {
+			t.Fatalf("Run %d: unexpected error stopping workflow: %v", run, err)
+		}
+		waitForState(t, runtime, 1, Stopped)
+	}
+
+	// Nodes and edges are kept
+	wf := runtime.workflows[1]
+	if len(wf.runtimeNodes) != 1 || len(wf.edges) != 1 {
+		t.Errorf("Expected 1 node and 1 edge, got %d and %d", len(wf.runtimeNodes), len(wf.edges))
+	}
+}
+
+// TestWorkflowPauseResume tests holding a workflow and continuing it without losing data
+func TestWorkflowPauseResume(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode()})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+
+	processChan := make(chan hainish.Edge, 1)
+	_, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan)
+	if err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	var received []any
+	receive := func() bool {
+		select {
+		case data := <-processChan:
+			received = append(received, data.Value)
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+
+	receive()
+	if err = runtime.PauseWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error pausing workflow: %v", err)
+	}
+	waitForState(t, runtime, 1, Paused)
+
+	// The values already produced still arrive, then nothing more
+	for receive() {
+	}
+	paused := len(received)
+	if receive() {
+		t.Error("Expected no value while paused")
+	}
+
+	if err = runtime.ResumeWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error resuming workflow: %v", err)
+	}
+	if err = runtime.ResumeWorkflow(1); !isStateError(err) {
+		t.Errorf("Expected a state error when resuming a running workflow, got %v", err)
+	}
+	for len(received) < paused+3 {
+		if !receive() {
+			t.Fatal("Timed out waiting for data after resuming")
+		}
+	}
+
+	// Nothing is lost or repeated
+	for i, value := range received {
+		if value != i+1 {
+			t.Fatalf("Expected values 1, 2, 3..., got %v", received)
+		}
+	}
+}
+
+// pumpProcessData plays Ansible for a test workflow: values for "self" are passed
+// back to the runtime, the others are sent to received. Every value is acknowledged.
+func pumpProcessData(runtime *Runtime, workflowID int, processChan chan hainish.Edge, received chan any) {
+	// Like a stream handler, the local data is delivered by another goroutine
+	local := make(chan hainish.Edge, 1024)
+	go func() {
+		for data := range local {
+			runtime.PassingProcessDataToRuntimeNode(data)
+			runtime.AckOutput(workflowID)
+		}
+	}()
+
+	for data := range processChan {
+		if data.Destination == "self" {
+			local <- data
+			continue
+		}
+		received <- data.Value
+		runtime.AckOutput(workflowID)
+	}
+}
+
+// TestWorkflowDrain tests that draining lets the data in the graph reach its end
+func TestWorkflowDrain(t *testing.T) {
+	var produced atomic.Int64
+	counterNode := newCounterNode()
+	counterNode.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		time.Sleep(time.Millisecond)
+		output["output1"] <- int(produced.Add(1))
+		return nil, nil
+	}
+	nodes := map[string]hainish.Node{
+		"counterNode": counterNode,
+		"relayNode":   newRelayNode(),
+	}
+	runtime := InitRuntime(nodes)
+	runtime.SetLocalPeer("self")
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("relayNode", 2, 1)
+	runtime.CreateEdge(1, "self", 1, 1, "output1", 2, "input1")
+	runtime.CreateEdge(2, "peer123", 1, 2, "output1", 3, "input1")
+
+	processChan := make(chan hainish.Edge, 1)
+	received := make(chan any, 1024)
+	_, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan)
+	if err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	go pumpProcessData(runtime, 1, processChan, received)
+
+	time.Sleep(20 * time.Millisecond)
+	if err = runtime.DrainWorkflow(1, time.Second); err != nil {
+		t.Fatalf("Unexpected error draining workflow: %v", err)
+	}
+	waitForState(t, runtime, 1, Stopped)
+
+	// Every value produced has flowed through the relay node
+	if int64(len(received)) != produced.Load() {
+		t.Fatalf("Expected %d values, got %d", produced.Load(), len(received))
+	}
+	for i := 1; len(received) > 0; i++ {
+		if value := <-received; value != i {
+			t.Fatalf("Expected value %d, got %v", i, value)
+		}
+	}
+}
+
+// TestDrainTimeout tests that the drain timeout is checked, and timed by the workflow's clock
+func TestDrainTimeout(t *testing.T) {
+	clk := clock.NewMock()
+	runtime, _ := runTriggeredWorkflow(t, hainish.Trigger{Kind: hainish.TriggerLoop}, clk)
+
+	if err := runtime.DrainWorkflow(1, 0); !isError(err, util.ErrInvalidTimeout) {
+		t.Errorf("Expected %v, got %v", util.ErrInvalidTimeout, err)
+	}
+	if state, _ := runtime.WorkflowState(1); state != Running {
+		t.Errorf("Expected the workflow still running, got %v", state)
+	}
+
+	// Nobody takes the values, so the workflow never goes quiet
+	if err := runtime.DrainWorkflow(1, time.Minute); err != nil {
+		t.Fatalf("Unexpected error draining workflow: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if state, _ := runtime.WorkflowState(1); state != Stopping {
+		t.Errorf("Expected the workflow draining until the timeout, got %v", state)
+	}
+	if stats := runtime.SchedulerStats(); stats.WatcherGoroutines != 1 {
+		t.Errorf("Expected the watcher of the run to wait for the drain, got %+v", stats)
+	}
+	clk.Add(time.Minute)
+	waitForState(t, runtime, 1, Stopped)
+	waitForRunGoroutines(t, runtime)
+}
+
+// TestParseCron tests parsing cron expressions and finding their next time
+func TestParseCron(t *testing.T) {
+	start := time.Date(2025, time.January, 1, 10, 7, 30, 0, time.UTC) // A Wednesday
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2025, time.January, 1, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, time.January, 1, 10, 15, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2025, time.January, 2, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 3 *", time.Date(2025, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2025, time.January, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2025, time.January, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 5", time.Date(2025, time.January, 3, 0, 0, 0, 0, time.UTC)}, // Friday comes before the 15th
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", test.expr, err)
+			continue
+		}
+		if next := schedule.next(start); !next.Equal(test.next) {
+			t.Errorf("%q: expected next time %v, got %v", test.expr, test.next, next)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("Expected error parsing %q", expr)
+		}
+	}
+}
+
+// runTriggeredWorkflow runs a counter node with the trigger, and returns the channel its values are sent to
+func runTriggeredWorkflow(t *testing.T, trigger hainish.Trigger, clk clock.Clock) (*Runtime, chan hainish.Edge) {
+	t.Helper()
+	counterNode := newCounterNode()
+	counterNode.trigger = trigger
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": counterNode})
+	runtime.clock = clk
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+
+	processChan := make(chan hainish.Edge, 16)
+	_, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan)
+	if err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	t.Cleanup(func() { runtime.StopWorkflow(1) })
+	return runtime, processChan
+}
+
+// expectFirings checks that exactly n values come out of the workflow
+func expectFirings(t *testing.T, processChan chan hainish.Edge, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-processChan:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out after %d firings, expected %d", i, n)
+		}
+	}
+	select {
+	case data := <-processChan:
+		t.Fatalf("Expected %d firings, got another value %v", n, data.Value)
+	case <-time.After(30 * time.Millisecond):
+	}
+}
+
+// TestTriggerOnce tests that a begin node with a once trigger fires only once
+func TestTriggerOnce(t *testing.T) {
+	mock := clock.NewMock()
+	runtime, processChan := runTriggeredWorkflow(t, hainish.Trigger{Kind: hainish.TriggerOnce}, mock)
+
+	// The value is followed by the end of the edge
+	if data := receiveEdge(t, processChan); data.EndOfStream || data.Value != 1 {
+		t.Fatalf("Expected value 1, got %+v", data)
+	}
+	if data := receiveEdge(t, processChan); !data.EndOfStream {
+		t.Fatalf("Expected the end of the edge, got %+v", data)
+	}
+	expectFirings(t, processChan, 0)
+
+	// The workflow completes once Ansible has handled both
+	if state, _ := runtime.WorkflowState(1); state != Running {
+		t.Errorf("Expected workflow state %s, got %s", Running, state)
+	}
+	runtime.AckOutput(1)
+	runtime.AckOutput(1)
+
+	// The completion is checked on the ticks of the workflow clock
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if state, _ := runtime.WorkflowState(1); state == Completed {
+			break
+		}
+		mock.Add(quietCheckInterval)
+	}
+	waitForState(t, runtime, 1, Completed)
+}
+
+// TestTriggerInterval tests that a begin node fires at once and then on every tick
+func TestTriggerInterval(t *testing.T) {
+	mock := clock.NewMock()
+	_, processChan := runTriggeredWorkflow(t, hainish.Trigger{Kind: hainish.TriggerInterval, Interval: time.Minute}, mock)
+	expectFirings(t, processChan, 1)
+
+	mock.Add(30 * time.Second)
+	expectFirings(t, processChan, 0)
+
+	mock.Add(30 * time.Second)
+	expectFirings(t, processChan, 1)
+
+	mock.Add(time.Minute)
+	expectFirings(t, processChan, 1)
+}
+
+// TestTriggerCron tests that a begin node fires at the times of its cron expression
+func TestTriggerCron(t *testing.T) {
+	mock := clock.NewMock()
+	mock.Set(time.Date(2025, time.January, 1, 10, 0, 0, 0, time.UTC))
+	_, processChan := runTriggeredWorkflow(t, hainish.Trigger{Kind: hainish.TriggerCron, Cron: "*/5 * * * *"}, mock)
+
+	// Nothing fires before 10:05
+	for i := 0; i < 4; i++ {
+		mock.Add(time.Minute)
+	}
+	expectFirings(t, processChan, 0)
+
+	mock.Add(time.Minute)
+	expectFirings(t, processChan, 1)
+
+	// The next firing is at 10:10
+	for i := 0; i < 5; i++ {
+		mock.Add(time.Minute)
+	}
+	expectFirings(t, processChan, 1)
+}
+
+// TestTriggerManual tests that a begin node fires once for each trigger from the leader
+func TestTriggerManual(t *testing.T) {
+	runtime, processChan := runTriggeredWorkflow(t, hainish.Trigger{Kind: hainish.TriggerManual}, clock.NewMock())
+	expectFirings(t, processChan, 0)
+
+	for i := 0; i < 2; i++ {
+		if err := runtime.TriggerWorkflow(1); err != nil {
+			t.Fatalf("Unexpected error triggering workflow: %v", err)
+		}
+	}
+	expectFirings(t, processChan, 2)
+
+	// A workflow without manual triggers can't be triggered
+	other, _ := runTriggeredWorkflow(t, hainish.Trigger{Kind: hainish.TriggerOnce}, clock.NewMock())
+	if err := other.TriggerWorkflow(1); !isError(err, util.ErrNoManualTrigger) {
+		t.Errorf("Expected %v, got %v", util.ErrNoManualTrigger, err)
+	}
+}
+
+// TestSetTrigger tests overriding the trigger of a begin node
+func TestSetTrigger(t *testing.T) {
+	nodes := map[string]hainish.Node{
+		"counterNode": newCounterNode(),
+		"relayNode":   newRelayNode(),
+	}
+	runtime := InitRuntime(nodes)
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("relayNode", 2, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+	runtime.CreateEdge(2, "peer123", 1, 2, "output1", 3, "input1")
+
+	if err := runtime.SetTrigger(1, 2, hainish.Trigger{Kind: hainish.TriggerOnce}); !isError(err, util.ErrNodeNotBegin) {
+		t.Errorf("Expected %v, got %v", util.ErrNodeNotBegin, err)
+	}
+	if err := runtime.SetTrigger(1, 1, hainish.Trigger{Kind: hainish.TriggerInterval}); !isError(err, util.ErrInvalidTrigger) {
+		t.Errorf("Expected %v, got %v", util.ErrInvalidTrigger, err)
+	}
+	if err := runtime.SetTrigger(1, 1, hainish.Trigger{Kind: hainish.TriggerCron, Cron: "* * *"}); !isError(err, util.ErrInvalidTrigger) {
+		t.Errorf("Expected %v, got %v", util.ErrInvalidTrigger, err)
+	}
+	if err := runtime.SetTrigger(1, 1, hainish.Trigger{Kind: hainish.TriggerManual}); err != nil {
+		t.Fatalf("Unexpected error setting trigger: %v", err)
+	}
+
+	processChan := make(chan hainish.Edge, 16)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+	expectFirings(t, processChan, 0)
+
+	if err := runtime.TriggerWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error triggering workflow: %v", err)
+	}
+	expectFirings(t, processChan, 1)
+}
+
+// TestValidateWorkflowTrigger tests that a begin node declaring an invalid trigger is reported
+func TestValidateWorkflowTrigger(t *testing.T) {
+	counterNode := newCounterNode()
+	counterNode.trigger = hainish.Trigger{Kind: hainish.TriggerCron, Cron: "bad"}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": counterNode})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+
+	problems, err := runtime.ValidateWorkflow(1)
+	if err != nil {
+		t.Fatalf("Unexpected error validating workflow: %v", err)
+	}
+	if !hasProblem(problems, ProblemInvalidTrigger, 1) {
+		t.Errorf("Expected an invalid trigger problem, got %v", problems)
+	}
+}
+
+// isError reports whether the error wraps the target
+func isError(err error, target error) bool {
+	ubikErr, ok := err.(uerr.UbikError)
+	if !ok {
+		return false
+	}
+	return errors.Is(ubikErr.MetaError(), target)
+}
+
+// mockContextNode simulates a node whose action receives a context
+type mockContextNode struct {
+	*mockNode
+	actionContext func(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error)
+}
+
+func (m *mockContextNode) ActionContext(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error) {
+	return m.actionContext(c, inputs, output)
+}
+
+// receiveEdge waits for the next envelope sent out of the workflow
+func receiveEdge(t *testing.T, processChan chan hainish.Edge) hainish.Edge {
+	t.Helper()
+	select {
+	case data := <-processChan:
+		return data
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for data")
+		return hainish.Edge{}
+	}
+}
+
+// TestRunIDPropagation tests that every firing of a begin node starts a run,
+// and its ID follows the values through the edges to the results and errors
+func TestRunIDPropagation(t *testing.T) {
+	errFailed := errors.New("failed")
+	counterNode := newCounterNode()
+	counterNode.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	seen := make(chan string, 1)
+	relayNode := &mockContextNode{
+		mockNode: newRelayNode(),
+		actionContext: func(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error) {
+			seen <- hainish.RunID(c)
+			output["output1"] <- inputs["input1"]
+			if inputs["input1"] == 1 {
+				return inputs["input1"], errFailed // What the failed firing wrote is not sent on
+			}
+			return inputs["input1"], nil
+		},
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": counterNode, "relayNode": relayNode})
+	runtime.SetLocalPeer("self")
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("relayNode", 2, 1)
+	runtime.CreateEdge(1, "self", 1, 1, "output1", 2, "input1")
+	runtime.CreateEdge(2, "peer123", 1, 2, "output1", 3, "input1")
+
+	resultChan := make(chan any, 1)
+	errChan := make(chan error, 1)
+	processChan := make(chan hainish.Edge, 1)
+	if _, err := runtime.RunWorkflow(1, resultChan, errChan, processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	var lastRunID string
+	for i := 0; i < 2; i++ {
+		if err := runtime.TriggerWorkflow(1); err != nil {
+			t.Fatalf("Unexpected error triggering workflow: %v", err)
+		}
+
+		// Edge 1 is delivered here, so the relay sees the run of the begin node
+		runID := <-seen
+		if runID == "" || runID == lastRunID {
+			t.Fatalf("Expected a new run ID, got %q", runID)
+		}
+		lastRunID = runID
+		if result := (<-resultChan).(Result); result.RunID != runID || result.NodeID != 2 {
+			t.Errorf("Expected the result of node 2 in run %q, got %+v", runID, result)
+		}
+
+		// The first run fails in the relay, and the second one is sent out
+		if i == 0 {
+			var runErr *RunError
+			if err := <-errChan; !errors.As(err, &runErr) || runErr.RunID != runID || !errors.Is(err, errFailed) {
+				t.Errorf("Expected the error in run %q, got %v", runID, err)
+			}
+			continue
+		}
+		data := receiveEdge(t, processChan)
+		if data.RunID != runID || data.Value != 2 {
+			t.Errorf("Expected value 2 in run %q, got %+v", runID, data)
+		}
+		if data.SourceEdgeID != 2 {
+			t.Errorf("Expected the relayed value along edge 2, got edge %d", data.SourceEdgeID)
+		}
+	}
+	select {
+	case data := <-processChan:
+		t.Errorf("Expected only the value of the second run, got %+v", data)
+	default:
+	}
+}
+
+// upperCodec is a codec only told apart by its name
+type upperCodec struct{ hainish.JSONCodec }
+
+func (upperCodec) Name() string { return "upper" }
+
+// codecPort is a mockPort with a codec
+type codecPort struct {
+	*mockPort
+	codec hainish.Codec
+}
+
+func (p *codecPort) Codec() hainish.Codec { return p.codec }
+
+// TestNamedResults tests that a node can emit several named results in one execution,
+// each with where and when it was produced
+func TestNamedResults(t *testing.T) {
+	mock := clock.NewMock()
+	start := mock.Now()
+	node := newCounterNode()
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	node.outputs["text"] = &codecPort{mockPort: &mockPort{name: "text", channel: make(chan any, 1)}, codec: upperCodec{}}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		mock.Add(2 * time.Second)
+		return hainish.Results{"text": "hello", "count": 1}, nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.clock = mock
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+
+	resultChan := make(chan any, 2)
+	if _, err := runtime.RunWorkflow(1, resultChan, make(chan error, 1), make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	expected := []struct {
+		name  string
+		value any
+		codec string
+	}{
+		{"count", 1, "json"},
+		{"text", "hello", "upper"},
+	}
+	for _, e := range expected {
+		var result Result
+		select {
+		case r := <-resultChan:
+			result = r.(Result)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for result")
+		}
+
+		if result.Name != e.name || result.Value != e.value || result.Codec.Name() != e.codec {
+			t.Errorf("Expected result %s=%v encoded by %s, got %s=%v encoded by %s", e.name, e.value, e.codec, result.Name, result.Value, result.Codec.Name())
+		}
+		if result.WorkflowID != 1 || result.NodeID != 1 || result.NodeName != "counterNode" || result.RunID == "" {
+			t.Errorf("Unexpected result header %+v", result)
+		}
+		if !result.Timestamp.Equal(start) || result.Duration != 2*time.Second {
+			t.Errorf("Expected execution at %v for 2s, got %v for %v", start, result.Timestamp, result.Duration)
+		}
+	}
+}
+
+// TestWorkflowCompletion tests that a workflow completes when its begin nodes are exhausted
+// and the data has reached the end nodes, and that it can run again
+func TestWorkflowCompletion(t *testing.T) {
+	counterNode := newCounterNode()
+	counterNode.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	endNode := newEchoNode(hainish.MergeSingle, 1)
+	endNode.isEnd = true
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": counterNode, "echoNode": endNode})
+	runtime.SetLocalPeer("self")
+	summaries := make(chan CompletionSummary, 1)
+	runtime.SetCompletionHandler(func(summary CompletionSummary) { summaries <- summary })
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("echoNode", 2, 1)
+	runtime.CreateEdge(1, "self", 1, 1, "output1", 2, "input1")
+
+	for run := 1; run <= 2; run++ {
+		resultChan := make(chan any, 1)
+		processChan := make(chan hainish.Edge, 1)
+		if _, err := runtime.RunWorkflow(1, resultChan, make(chan error, 1), processChan); err != nil {
+			t.Fatalf("Unexpected error running workflow: %v", err)
+		}
+		go pumpProcessData(runtime, 1, processChan, make(chan any, 1))
+
+		select {
+		case result := <-resultChan:
+			if result.(Result).NodeID != 2 {
+				t.Errorf("Expected the result of the end node, got %+v", result)
+			}
+			runtime.AckOutput(1)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for result")
+		}
+
+		var summary CompletionSummary
+		select {
+		case summary = <-summaries:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for completion")
+		}
+		close(processChan)
+		waitForState(t, runtime, 1, Completed)
+
+		if summary.WorkflowID != 1 || len(summary.Nodes) != 2 {
+			t.Fatalf("Unexpected summary %+v", summary)
+		}
+		counter, end := summary.Nodes[0], summary.Nodes[1]
+		if counter.NodeID != 1 || counter.Firings != 1 || counter.Outputs != 1 || counter.IsEnd {
+			t.Errorf("Unexpected stats of the begin node %+v", counter)
+		}
+		if end.NodeID != 2 || end.Firings != 1 || end.Results != 1 || !end.IsEnd {
+			t.Errorf("Unexpected stats of the end node %+v", end)
+		}
+	}
+}
+
+// TestValidateWorkflowEndNode tests that an end node feeding other nodes is reported
+func TestValidateWorkflowEndNode(t *testing.T) {
+	endNode := newRelayNode()
+	endNode.isEnd = true
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode(), "relayNode": endNode})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("relayNode", 2, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+	runtime.CreateEdge(2, "peer123", 1, 2, "output1", 3, "input1")
+
+	problems, err := runtime.ValidateWorkflow(1)
+	if err != nil {
+		t.Fatalf("Unexpected error validating workflow: %v", err)
+	}
+	if !hasProblem(problems, ProblemEndNodeHasOutputs, 2) {
+		t.Errorf("Expected an end node problem, got %v", problems)
+	}
+}
+
+// TestParamSchema tests params are checked against their schema, take their defaults,
+// and a required one keeps the workflow from running until it is set
+func TestParamSchema(t *testing.T) {
+	low := 0.0
+	node := newCounterNode()
+	node.params = map[string]hainish.Port{
+		"retries": hainish.NewParamPort("retries", hainish.ParamSchema{Type: hainish.ParamInt, Default: 3, Min: &low}),
+		"mode":    hainish.NewParamPort("mode", hainish.ParamSchema{Type: hainish.ParamString, Required: true, Enum: []any{"fast", "safe"}}),
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+
+	rn := runtime.workflows[1].runtimeNodes[1]
+	if rn.paramValues()["retries"] != 3 {
+		t.Errorf("Expected the default 3, got %v", rn.paramValues()["retries"])
+	}
+
+	problems, err := runtime.ValidateWorkflow(1)
+	if err != nil {
+		t.Fatalf("Unexpected error validating workflow: %v", err)
+	}
+	if !hasProblem(problems, ProblemMissingParam, 1) {
+		t.Errorf("Expected a missing param problem, got %v", problems)
+	}
+
+	for name, value := range map[string]any{"retries": -1, "mode": "slow"} {
+		if err := runtime.SetParam(1, 1, name, value); !isError(err, util.ErrInvalidParam) {
+			t.Errorf("Expected an invalid param error setting %s to %v, got %v", name, value, err)
+		}
+	}
+
+	// A number decoded from JSON is given to the node as an int
+	if err := runtime.SetParam(1, 1, "retries", 5.0); err != nil {
+		t.Fatalf("Unexpected error setting param: %v", err)
+	}
+	if err := runtime.SetParam(1, 1, "mode", "safe"); err != nil {
+		t.Fatalf("Unexpected error setting param: %v", err)
+	}
+	if rn.paramValues()["retries"] != 5 {
+		t.Errorf("Expected 5 as an int, got %v (%T)", rn.paramValues()["retries"], rn.paramValues()["retries"])
+	}
+	problems, _ = runtime.ValidateWorkflow(1)
+	if hasProblem(problems, ProblemMissingParam, 1) {
+		t.Errorf("Expected no missing param problem, got %v", problems)
+	}
+}
+
+// runFailingNode runs a begin node firing once, whose action fails the given times before it succeeds
+func runFailingNode(t *testing.T, policy ErrorPolicy, failures int) (*Runtime, chan any, chan error) {
+	t.Helper()
+	errFailed := errors.New("failed")
+	node := newCounterNode()
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		if failures > 0 {
+			failures--
+			return nil, errFailed
+		}
+		return "ok", nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	if err := runtime.SetErrorPolicy(1, 1, policy); err != nil {
+		t.Fatalf("Unexpected error setting error policy: %v", err)
+	}
+
+	resultChan := make(chan any, 1)
+	errChan := make(chan error, 10)
+	if _, err := runtime.RunWorkflow(1, resultChan, errChan, make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	t.Cleanup(func() { runtime.StopWorkflow(1) })
+	return runtime, resultChan, errChan
+}
+
+// expectDecision waits for the next error and checks what the policy decided
+func expectDecision(t *testing.T, errChan chan error, attempt int, decision ErrorAction) *RunError {
+	t.Helper()
+	select {
+	case err := <-errChan:
+		var runErr *RunError
+		if !errors.As(err, &runErr) || runErr.Attempt != attempt || runErr.Decision != decision {
+			t.Fatalf("Expected attempt %d decided %q, got %v", attempt, decision, err)
+		}
+		return runErr
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for error")
+		return nil
+	}
+}
+
+// TestErrorPolicyRetry tests that a failed action is retried until it succeeds
+func TestErrorPolicyRetry(t *testing.T) {
+	policy := ErrorPolicy{Action: ErrorRetry, MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	_, resultChan, errChan := runFailingNode(t, policy, 2)
+
+	expectDecision(t, errChan, 1, ErrorRetry)
+	expectDecision(t, errChan, 2, ErrorRetry)
+	select {
+	case result := <-resultChan:
+		if result.(Result).Value != "ok" {
+			t.Errorf("Expected the result of the third attempt, got %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for result")
+	}
+}
+
+// TestErrorPolicyRetryOutputs tests that only what the successful attempt writes is sent on
+func TestErrorPolicyRetryOutputs(t *testing.T) {
+	attempts := 0
+	node := newCounterNode()
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		attempts++
+		output["output1"] <- attempts
+		if attempts < 3 {
+			return nil, errors.New("failed")
+		}
+		return nil, nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+	if err := runtime.SetErrorPolicy(1, 1, ErrorPolicy{Action: ErrorRetry, MaxAttempts: 3, InitialBackoff: time.Millisecond}); err != nil {
+		t.Fatalf("Unexpected error setting error policy: %v", err)
+	}
+
+	processChan := make(chan hainish.Edge, 16)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 10), processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	t.Cleanup(func() { runtime.StopWorkflow(1) })
+
+	if data := receiveEdge(t, processChan); data.EndOfStream || data.Value != 3 {
+		t.Fatalf("Expected the output of the third attempt, got %+v", data)
+	}
+	if data := receiveEdge(t, processChan); !data.EndOfStream {
+		t.Fatalf("Expected the end of the edge, got %+v", data)
+	}
+	expectFirings(t, processChan, 0)
+}
+
+// TestErrorPolicyDeadLetter tests that the input is dead-lettered when the retries run out
+func TestErrorPolicyDeadLetter(t *testing.T) {
+	policy := ErrorPolicy{Action: ErrorRetry, MaxAttempts: 2, InitialBackoff: time.Millisecond, Then: ErrorDeadLetter}
+	runtime, _, errChan := runFailingNode(t, policy, 2)
+
+	expectDecision(t, errChan, 1, ErrorRetry)
+	runErr := expectDecision(t, errChan, 2, ErrorDeadLetter)
+	if runErr.Inputs == nil {
+		t.Error("Expected the dead-lettered input in the error")
+	}
+
+	letters, err := runtime.DeadLetters(1)
+	if err != nil {
+		t.Fatalf("Unexpected error getting dead letters: %v", err)
+	}
+	if len(letters) != 1 || letters[0].NodeID != 1 || letters[0].Attempts != 2 || letters[0].RunID != runErr.RunID || letters[0].Error != "failed" {
+		t.Errorf("Unexpected dead letters %+v", letters)
+	}
+}
+
+// TestErrorPolicyFailWorkflow tests that an error can fail the workflow
+func TestErrorPolicyFailWorkflow(t *testing.T) {
+	runtime, _, errChan := runFailingNode(t, ErrorPolicy{Action: ErrorFailWorkflow}, 1)
+
+	expectDecision(t, errChan, 1, ErrorFailWorkflow)
+	waitForState(t, runtime, 1, Failed)
+}
+
+// TestErrorPolicySkip tests that an error is skipped by default
+func TestErrorPolicySkip(t *testing.T) {
+	node := newCounterNode()
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		return nil, errors.New("failed")
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	errChan := make(chan error, 1)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), errChan, make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	for i := 0; i < 2; i++ {
+		if err := runtime.TriggerWorkflow(1); err != nil {
+			t.Fatalf("Unexpected error triggering workflow: %v", err)
+		}
+		expectDecision(t, errChan, 1, ErrorSkip)
+	}
+	if state, _ := runtime.WorkflowState(1); state != Running {
+		t.Errorf("Expected the workflow to keep running, got %v", state)
+	}
+}
+
+// TestSetErrorPolicy tests that invalid error policies are rejected
+func TestSetErrorPolicy(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode()})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+
+	invalid := []ErrorPolicy{
+		{Action: "unknown"},
+		{Action: ErrorRetry},
+		{Action: ErrorRetry, MaxAttempts: 2, InitialBackoff: -time.Second},
+		{Action: ErrorRetry, MaxAttempts: 2, Then: ErrorRetry},
+	}
+	for _, policy := range invalid {
+		if err := runtime.SetErrorPolicy(1, 1, policy); !isError(err, util.ErrInvalidErrorPolicy) {
+			t.Errorf("Expected an invalid error policy error for %+v, got %v", policy, err)
+		}
+	}
+	if err := runtime.SetErrorPolicy(1, 2, ErrorPolicy{}); !isError(err, util.ErrNodeNotFoundInWorkflow) {
+		t.Errorf("Expected a node not found error, got %v", err)
+	}
+	if _, err := runtime.DeadLetters(2); !isError(err, util.ErrWorkflowNotFound) {
+		t.Errorf("Expected a workflow not found error, got %v", err)
+	}
+}
+
+// TestErrorPolicyBackoff tests that the backoff grows exponentially up to its maximum
+func TestErrorPolicyBackoff(t *testing.T) {
+	policy := ErrorPolicy{Action: ErrorRetry, MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, backoff := range expected {
+		if got := policy.backoff(i + 1); got != backoff {
+			t.Errorf("Attempt %d: expected backoff %v, got %v", i+1, backoff, got)
+		}
+	}
+	if got := (ErrorPolicy{}).backoff(1); got != defaultInitialBackoff {
+		t.Errorf("Expected the default backoff, got %v", got)
+	}
+}
+
+// runPanickingNode runs a manually triggered begin node whose action panics on the given firings
+func runPanickingNode(t *testing.T, policy RestartPolicy, panics ...int) (*Runtime, chan any, chan error) {
+	t.Helper()
+	firing := 0
+	node := newCounterNode()
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		firing++
+		if slices.Contains(panics, firing) {
+			panic("boom")
+		}
+		return firing, nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	if err := runtime.SetRestartPolicy(1, 1, policy); err != nil {
+		t.Fatalf("Unexpected error setting restart policy: %v", err)
+	}
+
+	resultChan := make(chan any, 1)
+	errChan := make(chan error, 10)
+	if _, err := runtime.RunWorkflow(1, resultChan, errChan, make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	t.Cleanup(func() { runtime.StopWorkflow(1) })
+	return runtime, resultChan, errChan
+}
+
+// TestSupervisorRestart tests that a panicking node is restarted and goes on with the next firing
+func TestSupervisorRestart(t *testing.T) {
+	runtime, resultChan, errChan := runPanickingNode(t, RestartPolicy{Backoff: time.Millisecond}, 1)
+
+	if err := runtime.TriggerWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error triggering workflow: %v", err)
+	}
+	runErr := expectDecision(t, errChan, 0, ErrorRestart)
+	var panicErr *PanicError
+	if !errors.As(runErr, &panicErr) || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Errorf("Expected the panic with its stack, got %v", runErr.Err)
+	}
+	if runErr.RunID == "" {
+		t.Error("Expected the run the panic happened in")
+	}
+
+	if err := runtime.TriggerWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error triggering workflow: %v", err)
+	}
+	select {
+	case result := <-resultChan:
+		if result.(Result).Value != 2 {
+			t.Errorf("Expected the result of the second firing, got %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for result")
+	}
+
+	if crashes, err := runtime.NodeCrashes(1, 1); err != nil || crashes != 1 {
+		t.Errorf("Expected 1 crash, got %d, %v", crashes, err)
+	}
+	if state, _ := runtime.WorkflowState(1); state != Running {
+		t.Errorf("Expected the workflow to keep running, got %v", state)
+	}
+}
+
+// TestSupervisorFail tests that the workflow fails when the node may not be restarted
+func TestSupervisorFail(t *testing.T) {
+	runtime, _, errChan := runPanickingNode(t, RestartPolicy{Mode: RestartNever}, 1)
+	if err := runtime.TriggerWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error triggering workflow: %v", err)
+	}
+	expectDecision(t, errChan, 0, ErrorFailWorkflow)
+	waitForState(t, runtime, 1, Failed)
+
+	// The restarts run out
+	runtime, _, errChan = runPanickingNode(t, RestartPolicy{MaxRestarts: 1, Backoff: time.Millisecond}, 1, 2)
+	for _, decision := range []ErrorAction{ErrorRestart, ErrorFailWorkflow} {
+		if err := runtime.TriggerWorkflow(1); err != nil {
+			t.Fatalf("Unexpected error triggering workflow: %v", err)
+		}
+		expectDecision(t, errChan, 0, decision)
+	}
+	waitForState(t, runtime, 1, Failed)
+}
+
+// TestSetRestartPolicy tests that invalid restart policies are rejected
+func TestSetRestartPolicy(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode()})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+
+	invalid := []RestartPolicy{
+		{Mode: "unknown"},
+		{MaxRestarts: -1},
+		{Backoff: -time.Second},
+	}
+	for _, policy := range invalid {
+		if err := runtime.SetRestartPolicy(1, 1, policy); !isError(err, util.ErrInvalidRestartPolicy) {
+			t.Errorf("Expected an invalid restart policy error for %+v, got %v", policy, err)
+		}
+	}
+	if err := runtime.SetRestartPolicy(1, 2, RestartPolicy{}); !isError(err, util.ErrNodeNotFoundInWorkflow) {
+		t.Errorf("Expected a node not found error, got %v", err)
+	}
+	if _, err := runtime.NodeCrashes(1, 2); !isError(err, util.ErrNodeNotFoundInWorkflow) {
+		t.Errorf("Expected a node not found error, got %v", err)
+	}
+}
+
+// mockTimeoutNode simulates a node which declares a timeout
+type mockTimeoutNode struct {
+	*mockContextNode
+	timeout time.Duration
+}
+
+func (m *mockTimeoutNode) Timeout() time.Duration {
+	return m.timeout
+}
+
+// TestActionTimeout tests that a hung action is given up when its time is up,
+// and the timeout goes through the error policy
+func TestActionTimeout(t *testing.T) {
+	started := make(chan struct{}, 1)
+	cancelled := make(chan error, 1)
+	node := &mockTimeoutNode{
+		mockContextNode: &mockContextNode{
+			mockNode: newCounterNode(),
+			actionContext: func(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error) {
+				started <- struct{}{}
+				<-c.Done()
+				cancelled <- c.Err()
+				return nil, nil
+			},
+		},
+		timeout: time.Second,
+	}
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	mock := clock.NewMock()
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.clock = mock
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	if err := runtime.SetErrorPolicy(1, 1, ErrorPolicy{Action: ErrorDeadLetter}); err != nil {
+		t.Fatalf("Unexpected error setting error policy: %v", err)
+	}
+
+	errChan := make(chan error, 1)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), errChan, make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the action")
+	}
+	mock.Add(time.Second)
+
+	runErr := expectDecision(t, errChan, 1, ErrorDeadLetter)
+	var timeoutErr *TimeoutError
+	if !errors.As(runErr, &timeoutErr) || timeoutErr.NodeID != 1 || timeoutErr.RunID != runErr.RunID || timeoutErr.Timeout != time.Second {
+		t.Errorf("Expected a timeout error of node 1, got %v", runErr.Err)
+	}
+	if !errors.Is(runErr, context.DeadlineExceeded) {
+		t.Errorf("Expected the timeout to be a deadline exceeded, got %v", runErr.Err)
+	}
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the action context to be cancelled by its deadline, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the action context to be cancelled")
+	}
+}
+
+// TestSetTimeout tests that the leader overrides the declared timeout
+func TestSetTimeout(t *testing.T) {
+	node := &mockTimeoutNode{mockContextNode: &mockContextNode{mockNode: newCounterNode()}, timeout: time.Second}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+
+	rn := runtime.workflows[1].runtimeNodes[1]
+	if rn.timeout != time.Second {
+		t.Errorf("Expected the declared timeout, got %v", rn.timeout)
+	}
+	if err := runtime.SetTimeout(1, 1, time.Minute); err != nil || rn.timeout != time.Minute {
+		t.Errorf("Expected the timeout to be overridden, got %v, %v", rn.timeout, err)
+	}
+	if err := runtime.SetTimeout(1, 1, -time.Second); !isError(err, util.ErrInvalidTimeout) {
+		t.Errorf("Expected an invalid timeout error, got %v", err)
+	}
+	if err := runtime.SetTimeout(1, 2, time.Second); !isError(err, util.ErrNodeNotFoundInWorkflow) {
+		t.Errorf("Expected a node not found error, got %v", err)
+	}
+}
+
+// TestActionTimeoutPanic tests that a panic in an action with a timeout reaches the supervisor
+func TestActionTimeoutPanic(t *testing.T) {
+	runtime, _, errChan := runPanickingNode(t, RestartPolicy{Mode: RestartNever}, 1)
+	runtime.workflows[1].runtimeNodes[1].timeout = time.Minute
+	if err := runtime.TriggerWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error triggering workflow: %v", err)
+	}
+
+	runErr := expectDecision(t, errChan, 0, ErrorFailWorkflow)
+	var panicErr *PanicError
+	if !errors.As(runErr, &panicErr) || panicErr.Value != "boom" {
+		t.Errorf("Expected the panic of the action, got %v", runErr.Err)
+	}
+}
+
+// runReplicatedNode runs a relay node with replicas, fed by another follower,
+// and returns what it sends on and its results
+func runReplicatedNode(t *testing.T, replicas int, ordered bool, action func(inputs map[string]any, output map[string]chan any) (any, error)) (*Runtime, chan hainish.Edge, chan any) {
+	t.Helper()
+	relayNode := newRelayNode()
+	relayNode.action = action
+	runtime := InitRuntime(map[string]hainish.Node{"relayNode": relayNode})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("relayNode", 1, 1)
+	runtime.CreateEdge(2, "peer123", 1, 1, "output1", 2, "input1")
+	if err := runtime.SetConcurrency(1, 1, replicas, ordered); err != nil {
+		t.Fatalf("Unexpected error setting concurrency: %v", err)
+	}
+
+	resultChan := make(chan any, replicas)
+	processChan := make(chan hainish.Edge, replicas)
+	if _, err := runtime.ForceRunWorkflow(1, resultChan, make(chan error, replicas), processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	t.Cleanup(func() { runtime.StopWorkflow(1) })
+
+	go func() {
+		for i := 1; i <= replicas; i++ {
+			runtime.PassingProcessDataToRuntimeNode(hainish.Edge{
+				TargetWorkflowID: 1,
+				TargetNodeID:     1,
+				TargetPort:       "input1",
+				SourceEdgeID:     1,
+				RunID:            fmt.Sprintf("run%d", i),
+				Value:            i,
+			})
+		}
+	}()
+	return runtime, processChan, resultChan
+}
+
+// TestReplicasRunConcurrently tests that the replicas of a node execute at the same time
+func TestReplicasRunConcurrently(t *testing.T) {
+	var running atomic.Int32
+	all := make(chan struct{})
+	_, processChan, _ := runReplicatedNode(t, 3, false, func(inputs map[string]any, output map[string]chan any) (any, error) {
+		if running.Add(1) == 3 {
+			close(all)
+		}
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+			return nil, errors.New("replicas not running concurrently")
+		}
+		output["output1"] <- inputs["input1"]
+		return nil, nil
+	})
+
+	seen := make(map[string]any)
+	for i := 0; i < 3; i++ {
+		data := receiveEdge(t, processChan)
+		seen[data.RunID] = data.Value
+	}
+	for i := 1; i <= 3; i++ {
+		if seen[fmt.Sprintf("run%d", i)] != i {
+			t.Errorf("Expected value %d in run%d, got %v", i, i, seen)
+		}
+	}
+}
+
+// TestReplicasOrdered tests that the outputs and results of replicas keep the order of their firings
+func TestReplicasOrdered(t *testing.T) {
+	lastDone := make(chan struct{})
+	_, processChan, resultChan := runReplicatedNode(t, 3, true, func(inputs map[string]any, output map[string]chan any) (any, error) {
+		// The first firing finishes after the last
+		switch inputs["input1"] {
+		case 1:
+			select {
+			case <-lastDone:
+			case <-time.After(time.Second):
+			}
+		case 3:
+			defer close(lastDone)
+		}
+		output["output1"] <- inputs["input1"]
+		return inputs["input1"], nil
+	})
+
+	for i := 1; i <= 3; i++ {
+		data := receiveEdge(t, processChan)
+		if data.RunID != fmt.Sprintf("run%d", i) || data.Value != i {
+			t.Errorf("Expected value %d in run%d, got %v in %s", i, i, data.Value, data.RunID)
+		}
+		select {
+		case result := <-resultChan:
+			if result.(Result).Value != i {
+				t.Errorf("Expected result %d, got %+v", i, result)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for result")
+		}
+	}
+}
+
+// mockSerialNode simulates a node which is not safe to run concurrently
+type mockSerialNode struct {
+	*mockNode
+}
+
+func (m *mockSerialNode) Serial() bool {
+	return true
+}
+
+// TestSetConcurrency tests that invalid concurrency and serial nodes are rejected
+func TestSetConcurrency(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{
+		"relayNode":  newRelayNode(),
+		"serialNode": &mockSerialNode{mockNode: newRelayNode()},
+	})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("relayNode", 1, 1)
+	runtime.CreateRuntimeNode("serialNode", 2, 1)
+
+	if err := runtime.SetConcurrency(1, 1, 0, false); !isError(err, util.ErrInvalidConcurrency) {
+		t.Errorf("Expected an invalid concurrency error, got %v", err)
+	}
+	if err := runtime.SetConcurrency(1, 2, 2, false); !isError(err, util.ErrNodeNotConcurrent) {
+		t.Errorf("Expected a node not concurrent error, got %v", err)
+	}
+	if err := runtime.SetConcurrency(1, 2, 1, true); err != nil {
+		t.Errorf("Expected a single replica of a serial node to be allowed, got %v", err)
+	}
+	if err := runtime.SetConcurrency(1, 3, 2, false); !isError(err, util.ErrNodeNotFoundInWorkflow) {
+		t.Errorf("Expected a node not found error, got %v", err)
+	}
+}
+
+// TestSchedulerSingleWorker tests that a single worker isn't starved by nodes waiting for each other,
+// even when an action writes more values than its port holds
+func TestSchedulerSingleWorker(t *testing.T) {
+	counterNode := newCounterNode()
+	counterNode.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	burstNode := newRelayNode()
+	burstNode.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		for i := 0; i < 5; i++ {
+			output["output1"] <- i
+		}
+		return nil, nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": counterNode, "relayNode": burstNode})
+	if err := runtime.SetWorkers(1); err != nil {
+		t.Fatalf("Unexpected error setting workers: %v", err)
+	}
+	runtime.SetLocalPeer("self")
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("relayNode", 2, 1)
+	runtime.CreateEdge(1, "self", 1, 1, "output1", 2, "input1")
+	runtime.CreateEdge(2, "peer123", 1, 2, "output1", 3, "input1")
+
+	processChan := make(chan hainish.Edge, 1)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+	received := make(chan any, 8)
+	go pumpProcessData(runtime, 1, processChan, received)
+
+	for i := 0; i < 5; i++ {
+		select {
+		case value := <-received:
+			if value != i {
+				t.Errorf("Expected value %d, got %v", i, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out after receiving %d values", i)
+		}
+	}
+
+	stats := runtime.SchedulerStats()
+	if stats.Workers != 1 || stats.Dispatched < 2 || stats.Completed < 2 {
+		t.Errorf("Unexpected scheduler stats %+v", stats)
+	}
+}
+
+// TestSetWorkers tests resizing the worker pool
+func TestSetWorkers(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{})
+	if stats := runtime.SchedulerStats(); stats.Workers != defaultWorkers {
+		t.Errorf("Expected %d workers, got %d", defaultWorkers, stats.Workers)
+	}
+
+	for _, workers := range []int{defaultWorkers + 2, 1} {
+		if err := runtime.SetWorkers(workers); err != nil {
+			t.Fatalf("Unexpected error setting workers: %v", err)
+		}
+		if stats := runtime.SchedulerStats(); stats.Workers != workers {
+			t.Errorf("Expected %d workers, got %d", workers, stats.Workers)
+		}
+	}
+	if err := runtime.SetWorkers(0); !isError(err, util.ErrInvalidWorkers) {
+		t.Errorf("Expected an invalid workers error, got %v", err)
+	}
+}
+
+// TestSetWorkersQueueFull tests that shrinking the pool while the queue is full
+// doesn't hold up the stats
+func TestSetWorkersQueueFull(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{})
+	if err := runtime.SetWorkers(2); err != nil {
+		t.Fatalf("Unexpected error setting workers: %v", err)
+	}
+
+	// The workers are held, and the queue filled behind them
+	release := make(chan struct{})
+	for range jobQueueSize + 2 {
+		runtime.scheduler.submit(context.Background(), func() { <-release })
+	}
+	resized := make(chan error, 1)
+	go func() { resized <- runtime.SetWorkers(1) }()
+
+	// The stats are reported while the stop job waits for the queue
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		for runtime.SchedulerStats().Workers != 1 {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out getting the stats while the pool shrinks")
+	}
+	select {
+	case <-resized:
+		t.Fatal("Expected the pool to shrink after the queued firings")
+	default:
+	}
+
+	close(release)
+	if err := <-resized; err != nil {
+		t.Fatalf("Unexpected error setting workers: %v", err)
+	}
+}
+
+// mockStreamingNode simulates a node which streams its outputs
+type mockStreamingNode struct {
+	*mockNode
+}
+
+func (m *mockStreamingNode) Streaming() bool {
+	return true
+}
+
+// waitForGoroutines waits until no goroutine is left beside the worker pool
+func waitForGoroutines(t *testing.T, runtime *Runtime) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats := runtime.SchedulerStats()
+		if stats.NodeGoroutines == 0 && stats.FiringGoroutines == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no goroutine left beside the pool, got %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForRunGoroutines waits until the edge listeners and the watchers of the runs have exited
+func waitForRunGoroutines(t *testing.T, runtime *Runtime) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats := runtime.SchedulerStats()
+		if stats.EdgeGoroutines == 0 && stats.WatcherGoroutines == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no listener or watcher left, got %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestStreamingNode tests that a streaming node's outputs are sent on while its action runs,
+// and that the goroutines beside the pool are reported
+func TestStreamingNode(t *testing.T) {
+	release := make(chan struct{})
+	node := &mockStreamingNode{mockNode: newCounterNode()}
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		output["output1"] <- 1
+		<-release
+		return nil, nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+
+	processChan := make(chan hainish.Edge, 16)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	if data := receiveEdge(t, processChan); data.EndOfStream || data.Value != 1 {
+		t.Fatalf("Expected value 1 before the action returns, got %+v", data)
+	}
+	stats := runtime.SchedulerStats()
+	if stats.NodeGoroutines != 2 || stats.FiringGoroutines != 1 || stats.EdgeGoroutines != 1 || stats.WatcherGoroutines != 1 {
+		t.Errorf("Expected the node's, the collector's, the edge's and the watcher's goroutines, got %+v", stats)
+	}
+
+	close(release)
+	if data := receiveEdge(t, processChan); !data.EndOfStream {
+		t.Fatalf("Expected the end of the edge, got %+v", data)
+	}
+	waitForGoroutines(t, runtime)
+
+	// The edge's and the watcher's goroutines exit with the run
+	runtime.AckOutput(1)
+	runtime.AckOutput(1)
+	waitForState(t, runtime, 1, Completed)
+	waitForRunGoroutines(t, runtime)
+}
+
+// TestHeldOutputLimit tests that an attempt writing more values than can be held fails,
+// and sends none of them
+func TestHeldOutputLimit(t *testing.T) {
+	node := newCounterNode()
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		for i := 0; i <= heldOutputLimit; i++ {
+			output["output1"] <- i
+		}
+		return nil, nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+
+	errChan := make(chan error, 1)
+	processChan := make(chan hainish.Edge, 16)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), errChan, processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	runErr := expectDecision(t, errChan, 1, ErrorSkip)
+	if !isError(runErr.Err, util.ErrTooManyOutputs) {
+		t.Errorf("Expected a too many outputs error, got %v", runErr.Err)
+	}
+	if data := receiveEdge(t, processChan); !data.EndOfStream {
+		t.Fatalf("Expected only the end of the edge, got %+v", data)
+	}
+}
+
+// TestActionTimeoutAbandoned tests that an action which ignores its timeout is never blocked
+// on its output ports, and what it writes after the timeout is thrown away
+func TestActionTimeoutAbandoned(t *testing.T) {
+	started := make(chan struct{}, 1)
+	returned := make(chan struct{})
+	node := &mockTimeoutNode{
+		mockContextNode: &mockContextNode{
+			mockNode: newCounterNode(),
+			actionContext: func(c context.Context, inputs map[string]any, output map[string]chan any) (result any, err error) {
+				started <- struct{}{}
+				<-c.Done()
+				for i := 0; i < 5; i++ {
+					output["output1"] <- i
+				}
+				close(returned)
+				return nil, nil
+			},
+		},
+		timeout: time.Second,
+	}
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	mock := clock.NewMock()
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.clock = mock
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+
+	errChan := make(chan error, 1)
+	processChan := make(chan hainish.Edge, 16)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), errChan, processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the action")
+	}
+	mock.Add(time.Second)
+
+	expectDecision(t, errChan, 1, ErrorSkip)
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the abandoned action not to be blocked on its outputs")
+	}
+	if data := receiveEdge(t, processChan); !data.EndOfStream {
+		t.Fatalf("Expected only the end of the edge, got %+v", data)
+	}
+	waitForGoroutines(t, runtime)
+}
+
+// TestErrorPolicyRetryStopped tests that a firing waiting for its retry is given up
+// when the workflow stops
+func TestErrorPolicyRetryStopped(t *testing.T) {
+	node := newCounterNode()
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		return nil, errors.New("failed")
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.clock = clock.NewMock() // The backoff never runs out
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	if err := runtime.SetErrorPolicy(1, 1, ErrorPolicy{Action: ErrorRetry, MaxAttempts: 3, InitialBackoff: time.Minute}); err != nil {
+		t.Fatalf("Unexpected error setting error policy: %v", err)
+	}
+
+	errChan := make(chan error, 1)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), errChan, make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	expectDecision(t, errChan, 1, ErrorRetry)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- runtime.StopWorkflow(1) }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Unexpected error stopping workflow: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out stopping the workflow during the backoff")
+	}
+	waitForState(t, runtime, 1, Stopped)
+}
+
+// TestErrorPolicyRetryNodeDeleted tests that a firing waiting for its retry is given up
+// when its node is deleted
+func TestErrorPolicyRetryNodeDeleted(t *testing.T) {
+	node := newCounterNode()
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		return nil, errors.New("failed")
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.clock = clock.NewMock() // The backoff never runs out
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("counterNode", 2, 1) // Keeps the workflow running
+	if err := runtime.SetErrorPolicy(1, 1, ErrorPolicy{Action: ErrorRetry, MaxAttempts: 3, InitialBackoff: time.Minute}); err != nil {
+		t.Fatalf("Unexpected error setting error policy: %v", err)
+	}
+	if err := runtime.SetTrigger(1, 2, hainish.Trigger{Kind: hainish.TriggerManual}); err != nil {
+		t.Fatalf("Unexpected error setting trigger: %v", err)
+	}
+
+	errChan := make(chan error, 1)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), errChan, make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	t.Cleanup(func() { runtime.StopWorkflow(1) })
+	expectDecision(t, errChan, 1, ErrorRetry)
+
+	deleted := make(chan error, 1)
+	go func() { deleted <- runtime.DeleteNode(1, 1) }()
+	select {
+	case err := <-deleted:
+		if err != nil {
+			t.Fatalf("Unexpected error deleting node: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out deleting the node during the backoff")
+	}
+	if state, _ := runtime.WorkflowState(1); state != Running {
+		t.Errorf("Expected workflow state %s, got %s", Running, state)
+	}
+}
+
+// TestParamsAsConfiguration tests that every firing reads the params set on the node
+func TestParamsAsConfiguration(t *testing.T) {
+	node := newCounterNode()
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	node.params = map[string]hainish.Port{"threshold": &mockPort{name: "threshold", portType: "int", channel: make(chan any)}}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		return inputs["threshold"], nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	if err := runtime.SetParam(1, 1, "threshold", 10); err != nil {
+		t.Fatalf("Unexpected error setting param: %v", err)
+	}
+
+	resultChan := make(chan any, 1)
+	if _, err := runtime.RunWorkflow(1, resultChan, make(chan error, 1), make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	for i := 0; i < 3; i++ {
+		if err := runtime.TriggerWorkflow(1); err != nil {
+			t.Fatalf("Unexpected error triggering workflow: %v", err)
+		}
+		select {
+		case result := <-resultChan:
+			if result.(Result).Value != 10 {
+				t.Errorf("Expected the param in every firing, got %+v", result)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for result")
+		}
+	}
+}
+
+// TestLiveSetParam tests that a param set on a running workflow is taken by the next firing,
+// and the node is told about it
+func TestLiveSetParam(t *testing.T) {
+	changed := make(chan any, 1)
+	node := &mockParamNode{mockNode: newCounterNode(), changed: changed}
+	node.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	node.params = map[string]hainish.Port{"threshold": &mockPort{name: "threshold", portType: "int", channel: make(chan any)}}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		return inputs["threshold"], nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": node})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	if err := runtime.SetParam(1, 1, "threshold", 10); err != nil {
+		t.Fatalf("Unexpected error setting param: %v", err)
+	}
+	<-changed
+
+	resultChan := make(chan any, 1)
+	if _, err := runtime.RunWorkflow(1, resultChan, make(chan error, 1), make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	for _, threshold := range []int{10, 20} {
+		if threshold != 10 {
+			if err := runtime.SetParam(1, 1, "threshold", threshold); err != nil {
+				t.Fatalf("Unexpected error setting param on a running workflow: %v", err)
+			}
+			if value := <-changed; value != threshold {
+				t.Errorf("Expected the node to be told %d, got %v", threshold, value)
+			}
+		}
+
+		if err := runtime.TriggerWorkflow(1); err != nil {
+			t.Fatalf("Unexpected error triggering workflow: %v", err)
+		}
+		select {
+		case result := <-resultChan:
+			if result.(Result).Value != threshold {
+				t.Errorf("Expected the firing to take %d, got %+v", threshold, result)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for result")
+		}
+	}
+
+	if err := runtime.SetParam(1, 1, "missing", 1); !isError(err, util.ErrPortNotExist) {
+		t.Errorf("Expected a port not exist error, got %v", err)
+	}
+}
+
+// mockParamNode simulates a node which is told when a param is set
+type mockParamNode struct {
+	*mockNode
+	changed chan any
+}
+
+func (m *mockParamNode) ParamChanged(name string, value any) {
+	m.changed <- value
+}
+
+// runLiveWorkflow runs a manually triggered counter node feeding a remote node along edge 1
+func runLiveWorkflow(t *testing.T) (*Runtime, chan hainish.Edge) {
+	t.Helper()
+	counterNode := newCounterNode()
+	counterNode.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": counterNode})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+
+	processChan := make(chan hainish.Edge)
+	_, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan)
+	if err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	t.Cleanup(func() { runtime.StopWorkflow(1) })
+	return runtime, processChan
+}
+
+// expectTargets receives the envelopes of a firing, and checks which nodes they are sent to
+func expectTargets(t *testing.T, processChan chan hainish.Edge, targets ...int) {
+	t.Helper()
+	var received []int
+	for range targets {
+		received = append(received, receiveEdge(t, processChan).TargetNodeID)
+	}
+	slices.Sort(received)
+	if !slices.Equal(received, targets) {
+		t.Errorf("Expected values sent to nodes %v, got %v", targets, received)
+	}
+
+	select {
+	case data := <-processChan:
+		t.Errorf("Unexpected value sent to node %d", data.TargetNodeID)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// TestLiveEdgeEdits tests that edges created on a running workflow are sent along at once,
+// and removed ones are not any more
+func TestLiveEdgeEdits(t *testing.T) {
+	runtime, processChan := runLiveWorkflow(t)
+
+	if err := runtime.CreateEdge(2, "peer123", 1, 1, "output1", 3, "input1"); err != nil {
+		t.Fatalf("Unexpected error creating an edge on a running workflow: %v", err)
+	}
+	runtime.TriggerWorkflow(1)
+	expectTargets(t, processChan, 2, 3)
+
+	if err := runtime.DeleteEdge(1, 1); err != nil {
+		t.Fatalf("Unexpected error deleting an edge of a running workflow: %v", err)
+	}
+	runtime.TriggerWorkflow(1)
+	expectTargets(t, processChan, 3)
+
+	if err := runtime.RemoveEdge(1, 2, EdgeRemoval(2)); !isError(err, util.ErrInvalidEdgeRemoval) {
+		t.Errorf("Expected an invalid edge removal error, got %v", err)
+	}
+}
+
+// TestLiveRemoveEdge tests that the values on the way along a removed edge are sent or dropped
+func TestLiveRemoveEdge(t *testing.T) {
+	tests := []struct {
+		removal EdgeRemoval
+		targets []int
+	}{
+		{EdgeDrain, []int{2, 3}},
+		{EdgeDiscard, []int{2}},
+	}
+
+	for _, test := range tests {
+		runtime, processChan := runLiveWorkflow(t)
+		if err := runtime.CreateEdge(2, "peer123", 1, 1, "output1", 3, "input1"); err != nil {
+			t.Fatalf("Unexpected error creating edge: %v", err)
+		}
+
+		// Wait until the listener of each edge holds the value, as nobody takes it
+		runtime.TriggerWorkflow(1)
+		wf := runtime.workflows[1]
+		deadline := time.Now().Add(time.Second)
+		for wf.activity.busy.Load() != 4 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		if err := runtime.RemoveEdge(1, 2, test.removal); err != nil {
+			t.Fatalf("Unexpected error removing edge: %v", err)
+		}
+		expectTargets(t, processChan, test.targets...)
+		runtime.StopWorkflow(1)
+	}
+}
+
+// TestLiveNodeEdits tests that a node created on a running workflow starts at once,
+// and a deleted one is stopped
+func TestLiveNodeEdits(t *testing.T) {
+	runtime, processChan := runLiveWorkflow(t)
+	beginNode := newCounterNode()
+	beginNode.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	runtime.nodes["beginNode"] = beginNode
+
+	if err := runtime.CreateRuntimeNode("beginNode", 3, 1); err != nil {
+		t.Fatalf("Unexpected error creating a node on a running workflow: %v", err)
+	}
+	if err := runtime.CreateEdge(2, "peer123", 1, 3, "output1", 4, "input1"); err != nil {
+		t.Fatalf("Unexpected error creating edge: %v", err)
+	}
+	runtime.TriggerWorkflow(1)
+	expectTargets(t, processChan, 2, 4)
+
+	if err := runtime.DeleteNode(1, 3); !isError(err, util.ErrDeletingNodeHasEdges) {
+		t.Errorf("Expected a node has edges error, got %v", err)
+	}
+	runtime.DeleteEdge(1, 2)
+	if err := runtime.DeleteNode(1, 3); err != nil {
+		t.Fatalf("Unexpected error deleting a node of a running workflow: %v", err)
+	}
+	select {
+	case <-runtime.workflows[1].runtimeNodes[1].done:
+		t.Error("Expected the other nodes to keep running")
+	default:
+	}
+	runtime.TriggerWorkflow(1)
+	expectTargets(t, processChan, 2)
+
+	if err := runtime.StopWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error stopping workflow: %v", err)
+	}
+	waitForState(t, runtime, 1, Stopped)
+}
+
+// TestLiveNodeCompletion tests that a workflow completes after the nodes created while it runs
+func TestLiveNodeCompletion(t *testing.T) {
+	counterNode := newCounterNode()
+	counterNode.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	onceNode := newCounterNode()
+	onceNode.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": counterNode, "onceNode": onceNode})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	processChan := make(chan hainish.Edge, 1)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 1), make(chan error, 1), processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	// The manual node never runs out of data, so it is replaced
+	if err := runtime.CreateRuntimeNode("onceNode", 2, 1); err != nil {
+		t.Fatalf("Unexpected error creating node: %v", err)
+	}
+	if err := runtime.DeleteNode(1, 1); err != nil {
+		t.Fatalf("Unexpected error deleting node: %v", err)
+	}
+	waitForState(t, runtime, 1, Completed)
+}
+
+// TestLiveNodeCompletionRace tests that a node created right as the last one runs out of data
+// keeps the workflow running
+func TestLiveNodeCompletionRace(t *testing.T) {
+	onceNode := newCounterNode()
+	onceNode.trigger = hainish.Trigger{Kind: hainish.TriggerOnce}
+	onceNode.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		return "once", nil
+	}
+	counterNode := newCounterNode()
+	counterNode.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	counterNode.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		return "manual", nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"onceNode": onceNode, "counterNode": counterNode})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("onceNode", 1, 1)
+	resultChan := make(chan any, 1)
+	if _, err := runtime.RunWorkflow(1, resultChan, make(chan error, 1), make(chan hainish.Edge, 1)); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	// The once node has exited, and the run only waits for Ansible to handle its result
+	select {
+	case result := <-resultChan:
+		if result.(Result).Value != "once" {
+			t.Fatalf("Expected the result of the once node, got %v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the once node to fire")
+	}
+	waitForGoroutines(t, runtime)
+	if err := runtime.CreateRuntimeNode("counterNode", 2, 1); err != nil {
+		t.Fatalf("Unexpected error creating node: %v", err)
+	}
+	runtime.AckOutput(1)
+
+	// The new node is waited for past the quiet checks, and still fires
+	time.Sleep(5 * quietCheckInterval)
+	if state, _ := runtime.WorkflowState(1); state != Running {
+		t.Fatalf("Expected workflow state %s, got %s", Running, state)
+	}
+	if err := runtime.TriggerWorkflow(1); err != nil {
+		t.Fatalf("Unexpected error triggering workflow: %v", err)
+	}
+	select {
+	case result := <-resultChan:
+		if result.(Result).Value != "manual" {
+			t.Fatalf("Expected the result of the new node, got %v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the new node to fire")
+	}
+	runtime.AckOutput(1)
+
+	if err := runtime.DeleteNode(1, 2); err != nil {
+		t.Fatalf("Unexpected error deleting node: %v", err)
+	}
+	waitForState(t, runtime, 1, Completed)
+}
+
+// newDeployment is a counter node feeding a relay node, which feeds a remote node
+func newDeployment() Deployment {
+	return Deployment{
+		WorkflowID: 1,
+		Nodes: []NodeSpec{
+			{NodeID: 1, NodeName: "counterNode"},
+			{NodeID: 2, NodeName: "relayNode"},
+		},
+		Edges: []EdgeSpec{
+			{EdgeID: 1, Destination: "peer123", ProducerNodeID: 1, ProducerPortName: "output1", ConsumerNodeID: 2, ConsumerPortName: "input1"},
+			{EdgeID: 2, Destination: "peer456", ProducerNodeID: 2, ProducerPortName: "output1", ConsumerNodeID: 3, ConsumerPortName: "input1"},
+		},
+	}
+}
+
+// TestDeployWorkflow tests that a deployment creates the graph, and deploying again only applies the differences
+func TestDeployWorkflow(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode(), "relayNode": newRelayNode()})
+
+	result, err := runtime.DeployWorkflow(newDeployment())
+	if err != nil {
+		t.Fatalf("Unexpected error deploying workflow: %v", err)
+	}
+	if !result.Created || !slices.Equal(result.CreatedNodes, []int{1, 2}) || !slices.Equal(result.CreatedEdges, []int{1, 2}) {
+		t.Errorf("Expected the workflow, nodes 1, 2 and edges 1, 2 created, got %+v", result)
+	}
+	wf := runtime.workflows[1]
+	if len(wf.runtimeNodes) != 2 || len(wf.edges) != 2 {
+		t.Fatalf("Expected 2 nodes and 2 edges, got %d and %d", len(wf.runtimeNodes), len(wf.edges))
+	}
+	if problems, _ := runtime.ValidateWorkflow(1); len(problems) != 0 {
+		t.Errorf("Expected a valid workflow, got %v", problems)
+	}
+
+	result, err = runtime.DeployWorkflow(newDeployment())
+	if err != nil {
+		t.Fatalf("Unexpected error deploying again: %v", err)
+	}
+	if result.Changed() {
+		t.Errorf("Expected deploying again to change nothing, got %+v", result)
+	}
+
+	// Change the relay's error policy, and send it to another node
+	d := newDeployment()
+	d.Nodes[1].ErrorPolicy = ErrorPolicy{Action: ErrorDeadLetter}
+	d.Edges[1] = EdgeSpec{EdgeID: 3, Destination: "peer456", ProducerNodeID: 2, ProducerPortName: "output1", ConsumerNodeID: 4, ConsumerPortName: "input1"}
+	result, err = runtime.DeployWorkflow(d)
+	if err != nil {
+		t.Fatalf("Unexpected error deploying changes: %v", err)
+	}
+	if result.Created || len(result.CreatedNodes) != 0 || len(result.DeletedNodes) != 0 ||
+		!slices.Equal(result.UpdatedNodes, []int{2}) ||
+		!slices.Equal(result.DeletedEdges, []int{2}) || !slices.Equal(result.CreatedEdges, []int{3}) {
+		t.Errorf("Expected node 2 updated and edge 2 replaced by edge 3, got %+v", result)
+	}
+	if wf.runtimeNodes[2].errorPolicy.Action != ErrorDeadLetter {
+		t.Errorf("Expected the new error policy, got %+v", wf.runtimeNodes[2].errorPolicy)
+	}
+	if _, exist := wf.edges[2]; exist {
+		t.Error("Expected edge 2 deleted")
+	}
+
+	// A node of another plugin node is replaced, with its edges
+	d.Nodes[1].NodeName = "counterNode"
+	d.Edges = d.Edges[1:]
+	d.Edges[0].ProducerNodeID = 1
+	result, err = runtime.DeployWorkflow(d)
+	if err != nil {
+		t.Fatalf("Unexpected error replacing node: %v", err)
+	}
+	if !slices.Equal(result.DeletedNodes, []int{2}) || !slices.Equal(result.CreatedNodes, []int{2}) ||
+		!slices.Equal(result.DeletedEdges, []int{1, 3}) || !slices.Equal(result.CreatedEdges, []int{3}) {
+		t.Errorf("Expected node 2 replaced and edge 1 deleted, got %+v", result)
+	}
+	if (*wf.runtimeNodes[2].node).Name() != "counterNode" {
+		t.Errorf("Expected node 2 to be a counter node, got %s", (*wf.runtimeNodes[2].node).Name())
+	}
+
+	// An edge to a remote node is created again when the node is deployed here
+	d = newDeployment()
+	d.Nodes, d.Edges = d.Nodes[:1], d.Edges[:1]
+	runtime.DeployWorkflow(d)
+	result, err = runtime.DeployWorkflow(newDeployment())
+	if err != nil {
+		t.Fatalf("Unexpected error deploying the node: %v", err)
+	}
+	if !slices.Equal(result.DeletedEdges, []int{1}) || !slices.Equal(result.CreatedEdges, []int{1, 2}) {
+		t.Errorf("Expected edge 1 created again, got %+v", result)
+	}
+	if len(wf.runtimeNodes[2].inputEdges) != 1 {
+		t.Error("Expected edge 1 attached to node 2")
+	}
+}
+
+// TestDeployWorkflowInvalid tests that an invalid deployment changes nothing
+func TestDeployWorkflowInvalid(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode(), "relayNode": newRelayNode()})
+
+	tests := map[string]func(d *Deployment){
+		"unknown node":   func(d *Deployment) { d.Nodes[1].NodeName = "missing" },
+		"duplicate node": func(d *Deployment) { d.Nodes[1].NodeID = 1 },
+		"unknown port":   func(d *Deployment) { d.Edges[1].ProducerPortName = "missing" },
+		"remote edge":    func(d *Deployment) { d.Edges[1].ProducerNodeID = 5 },
+		"unknown param":  func(d *Deployment) { d.Nodes[0].Params = map[string]any{"missing": 1} },
+		"bad policy":     func(d *Deployment) { d.Nodes[1].ErrorPolicy = ErrorPolicy{Action: "missing"} },
+		"single merge": func(d *Deployment) {
+			d.Edges = append(d.Edges, EdgeSpec{EdgeID: 3, Destination: "peer123", ProducerNodeID: 1, ProducerPortName: "output1", ConsumerNodeID: 2, ConsumerPortName: "input1"})
+		},
+	}
+	for name, change := range tests {
+		d := newDeployment()
+		change(&d)
+		if _, err := runtime.DeployWorkflow(d); !isError(err, util.ErrInvalidDeployment) {
+			t.Errorf("%s: expected an invalid deployment error, got %v", name, err)
+		}
+		if _, exist := runtime.workflows[1]; exist {
+			t.Fatalf("%s: expected no workflow created", name)
+		}
+	}
+
+	// An existing graph is kept
+	if _, err := runtime.DeployWorkflow(newDeployment()); err != nil {
+		t.Fatalf("Unexpected error deploying workflow: %v", err)
+	}
+	d := newDeployment()
+	d.Nodes = d.Nodes[:1]
+	d.Edges[1].ProducerPortName = "missing"
+	if _, err := runtime.DeployWorkflow(d); !isError(err, util.ErrInvalidDeployment) {
+		t.Errorf("Expected an invalid deployment error, got %v", err)
+	}
+	if wf := runtime.workflows[1]; len(wf.runtimeNodes) != 2 || len(wf.edges) != 2 {
+		t.Errorf("Expected the graph kept, got %d nodes and %d edges", len(wf.runtimeNodes), len(wf.edges))
+	}
+}
+
+// TestDeployRunningWorkflow tests that a running workflow takes new nodes and edges at once,
+// but not other settings of the nodes it keeps
+func TestDeployRunningWorkflow(t *testing.T) {
+	runtime, processChan := runLiveWorkflow(t)
+	beginNode := newCounterNode()
+	beginNode.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	runtime.nodes["beginNode"] = beginNode
+
+	d := Deployment{
+		WorkflowID: 1,
+		Nodes:      []NodeSpec{{NodeID: 1, NodeName: "counterNode"}, {NodeID: 3, NodeName: "beginNode"}},
+		Edges: []EdgeSpec{
+			{EdgeID: 1, Destination: "peer123", ProducerNodeID: 1, ProducerPortName: "output1", ConsumerNodeID: 2, ConsumerPortName: "input1"},
+			{EdgeID: 2, Destination: "peer123", ProducerNodeID: 3, ProducerPortName: "output1", ConsumerNodeID: 4, ConsumerPortName: "input1"},
+		},
+	}
+	result, err := runtime.DeployWorkflow(d)
+	if err != nil {
+		t.Fatalf("Unexpected error deploying to a running workflow: %v", err)
+	}
+	if !slices.Equal(result.CreatedNodes, []int{3}) || !slices.Equal(result.CreatedEdges, []int{2}) || len(result.DeletedEdges) != 0 {
+		t.Errorf("Expected node 3 and edge 2 created, got %+v", result)
+	}
+	runtime.TriggerWorkflow(1)
+	expectTargets(t, processChan, 2, 4)
+
+	d.Nodes[0].Timeout = new(time.Duration)
+	*d.Nodes[0].Timeout = time.Second
+	if _, err := runtime.DeployWorkflow(d); !isStateError(err) {
+		t.Errorf("Expected a state error changing the timeout of a running node, got %v", err)
+	}
+}
+
+// isConflict reports whether the error is a conflict on the ID
+func isConflict(err error, kind string, id int) bool {
+	ubikErr, ok := err.(uerr.UbikError)
+	if !ok {
+		return false
+	}
+	var conflictErr *ConflictError
+	return errors.As(ubikErr.MetaError(), &conflictErr) && conflictErr.Kind == kind && conflictErr.ID == id
+}
+
+// TestCreateConflicts tests that an existing workflow, node or edge is not replaced
+func TestCreateConflicts(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode(), "relayNode": newRelayNode()})
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("relayNode", 2, 1)
+	runtime.CreateEdge(1, "peer123", 1, 1, "output1", 2, "input1")
+	wf := runtime.workflows[1]
+	rn := wf.runtimeNodes[1]
+
+	if err := runtime.InitWorkflow(1); !isConflict(err, "workflow", 1) || !isError(err, util.ErrWorkflowExists) {
+		t.Errorf("Expected a workflow conflict, got %v", err)
+	}
+	if err := runtime.CreateRuntimeNode("relayNode", 1, 1); !isConflict(err, "node", 1) || !isError(err, util.ErrNodeExists) {
+		t.Errorf("Expected a node conflict, got %v", err)
+	}
+	if err := runtime.CreateEdge(1, "peer123", 1, 2, "output1", 3, "input1"); !isConflict(err, "edge", 1) || !isError(err, util.ErrEdgeExists) {
+		t.Errorf("Expected an edge conflict, got %v", err)
+	}
+
+	if runtime.workflows[1] != wf || wf.runtimeNodes[1] != rn || wf.edges[1].producerNodeID != 1 {
+		t.Error("Expected the existing workflow, node and edge kept")
+	}
+	if len(wf.runtimeNodes[2].outputEdges) != 0 {
+		t.Error("Expected the conflicting edge not registered on its producer")
+	}
+}
+
+// TestIdempotentCreate tests that a create command retried with the same key succeeds without changing anything
+func TestIdempotentCreate(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode(), "relayNode": newRelayNode()})
+
+	for range 2 {
+		if err := runtime.InitWorkflowWithKey("wf", 1); err != nil {
+			t.Fatalf("Unexpected error creating workflow: %v", err)
+		}
+		if err := runtime.CreateRuntimeNodeWithKey("n1", "counterNode", 1, 1); err != nil {
+			t.Fatalf("Unexpected error creating node: %v", err)
+		}
+		if err := runtime.CreateRuntimeNodeWithKey("n2", "relayNode", 2, 1); err != nil {
+			t.Fatalf("Unexpected error creating node: %v", err)
+		}
+		if err := runtime.CreateEdgeWithKey("e1", 1, "peer123", 1, 1, "output1", 2, "input1"); err != nil {
+			t.Fatalf("Unexpected error creating edge: %v", err)
+		}
+	}
+	wf := runtime.workflows[1]
+	if len(wf.runtimeNodes) != 2 || len(wf.edges) != 1 || len(wf.runtimeNodes[2].inputEdges) != 1 {
+		t.Errorf("Expected the graph created once, got %d nodes and %d edges", len(wf.runtimeNodes), len(wf.edges))
+	}
+
+	// Another key, no key, or the same key for another command is a conflict
+	if err := runtime.InitWorkflowWithKey("other", 1); !isConflict(err, "workflow", 1) {
+		t.Errorf("Expected a workflow conflict with another key, got %v", err)
+	}
+	if err := runtime.CreateRuntimeNode("counterNode", 1, 1); !isConflict(err, "node", 1) {
+		t.Errorf("Expected a node conflict without a key, got %v", err)
+	}
+	if err := runtime.CreateRuntimeNodeWithKey("n1", "relayNode", 1, 1); !isConflict(err, "node", 1) {
+		t.Errorf("Expected a node conflict for another plugin node, got %v", err)
+	}
+	if err := runtime.CreateEdgeWithKey("e1", 1, "peer123", 1, 1, "output1", 3, "input1"); !isConflict(err, "edge", 1) {
+		t.Errorf("Expected an edge conflict for another consumer, got %v", err)
+	}
+}
+
+// newParamRelayNode creates a relay node with a param, whose firings read it
+func newParamRelayNode() *mockNode {
+	node := newRelayNode()
+	node.params = map[string]hainish.Port{"threshold": &mockPort{name: "threshold", portType: "int", channel: make(chan any)}}
+	node.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		output["output1"] <- inputs["threshold"]
+		return nil, nil
+	}
+	return node
+}
+
+// TestConcurrentCommands sends the commands of several stream handlers at once
+// to a few workflows, run it with -race. Every command may fail, as another one
+// may have changed the workflow first, but none may corrupt the runtime.
+func TestConcurrentCommands(t *testing.T) {
+	// The begin node is fired by the leader, so the runs take data from the start
+	beginNode := newCounterNode()
+	beginNode.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	beginNode.action = func(inputs map[string]any, output map[string]chan any) (result any, err error) {
+		output["output1"] <- 1
+		return nil, nil
+	}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": beginNode, "relayNode": newParamRelayNode()})
+	const workflows, workers, rounds = 3, 8, 200
+	var started atomic.Int64
+
+	// Workflow 1 is never deleted, so some runs are sure to start
+	build := func(workflowID int) {
+		runtime.InitWorkflow(workflowID)
+		runtime.CreateRuntimeNode("counterNode", 1, workflowID)
+		runtime.CreateRuntimeNode("relayNode", 2, workflowID)
+		runtime.CreateEdge(1, "self", workflowID, 1, "output1", 2, "input1")
+		runtime.CreateEdge(2, "peer123", workflowID, 2, "output1", 3, "input1")
+	}
+	for workflowID := 1; workflowID <= workflows; workflowID++ {
+		build(workflowID)
+	}
+
+	// Plays Ansible for every run
+	processChan := make(chan hainish.Edge, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for data := range processChan {
+			runtime.AckOutput(data.TargetWorkflowID)
+		}
+	}()
+
+	// The commands are bounded in time as well, a slow run may hold some of them
+	deadline := time.Now().Add(5 * time.Second)
+	var wg sync.WaitGroup
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := range rounds {
+				if time.Now().After(deadline) {
+					return
+				}
+				workflowID := (worker+round)%workflows + 1
+				switch (worker*7 + round) % 10 {
+				case 0, 1, 2:
+					build(workflowID)
+				case 3:
+					runtime.SetParam(workflowID, 2, "threshold", round)
+					runtime.SetTimeout(workflowID, 2, time.Second)
+				case 4:
+					if _, err := runtime.RunWorkflow(workflowID, make(chan any, rounds), make(chan error, rounds), processChan); err == nil {
+						started.Add(1)
+					}
+				case 5:
+					runtime.TriggerWorkflow(workflowID)
+				case 6:
+					runtime.StopWorkflow(workflowID)
+				case 7:
+					if workflowID != 1 {
+						runtime.DeleteEdge(workflowID, 1+round%2)
+						runtime.DeleteNode(workflowID, 1+round%2)
+					}
+				case 8:
+					runtime.ValidateWorkflow(workflowID)
+					runtime.NodeIDs(workflowID)
+					runtime.WorkflowState(workflowID)
+				default:
+					if workflowID != 1 {
+						runtime.DeleteWorkflow(workflowID)
+					}
+				}
+			}
+		}()
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out running the commands")
+	}
+	if started.Load() == 0 {
+		t.Error("Expected some runs to start")
+	}
+
+	// Every workflow can still be stopped and deleted.
+	// A workflow whose graph was emptied may have completed, or failed, by itself.
+	for workflowID := 1; workflowID <= workflows; workflowID++ {
+		err := runtime.StopWorkflow(workflowID)
+		switch {
+		case err == nil:
+			waitForState(t, runtime, workflowID, Stopped)
+		case isError(err, util.ErrWorkflowNotFound):
+			continue
+		case !isStateError(err):
+			t.Fatalf("Unexpected error stopping workflow %d: %v", workflowID, err)
+		}
+		waitForStates(t, runtime, workflowID, Created, Stopped, Failed, Completed)
+		if err := runtime.DeleteWorkflow(workflowID); err != nil && !isError(err, util.ErrWorkflowNotFound) {
+			t.Errorf("Unexpected error deleting workflow %d: %v", workflowID, err)
+		}
+	}
+	if len(runtime.workflows) != 0 {
+		t.Errorf("Expected every workflow deleted, got %d", len(runtime.workflows))
+	}
+	close(processChan)
+	<-done
+}
+
+// TestConcurrentDeploy tests that deployments and deletions of the same workflow don't interleave,
+// each deployment leaves the whole graph
+func TestConcurrentDeploy(t *testing.T) {
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": newCounterNode(), "relayNode": newRelayNode()})
+
+	var wg sync.WaitGroup
+	for worker := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := range 100 {
+				d := newDeployment()
+				if (worker+round)%2 == 0 {
+					d.Nodes = d.Nodes[:1]
+					d.Edges = d.Edges[:1]
+				}
+				runtime.DeployWorkflow(d)
+				if round%10 == worker {
+					runtime.DeleteWorkflow(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	d := newDeployment()
+	if _, err := runtime.DeployWorkflow(d); err != nil {
+		t.Fatalf("Unexpected error deploying: %v", err)
+	}
+	nodeIDs, _ := runtime.NodeIDs(1)
+	wf := runtime.workflows[1]
+	if !slices.Equal(nodeIDs, []int{1, 2}) || len(wf.edges) != 2 || len(wf.runtimeNodes[2].inputEdges) != 1 {
+		t.Errorf("Expected the deployed graph, got nodes %v and %d edges", nodeIDs, len(wf.edges))
+	}
+}
+
+// TestDeployWhileRunning tests that a run doesn't start in the middle of a deployment,
+// so the nodes a deployment creates are started with the run
+func TestDeployWhileRunning(t *testing.T) {
+	counterNode := newCounterNode()
+	counterNode.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": counterNode, "relayNode": newRelayNode()})
+	runtime.DeployWorkflow(newDeployment())
+	wf, _ := runtime.getWorkflow(1)
+
+	// Between deployments, every node of a running workflow has been started
+	var started atomic.Int64
+	check := func() {
+		runtime.deployMu.Lock()
+		defer runtime.deployMu.Unlock()
+		wf.graphMu.RLock()
+		defer wf.graphMu.RUnlock()
+		if !wf.isRunning() {
+			return
+		}
+		started.Add(1)
+		for nodeID, rn := range wf.runtimeNodes {
+			if rn.done == nil {
+				t.Errorf("Expected node %d started in the running workflow", nodeID)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for worker := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := range 200 {
+				switch (worker + round) % 4 {
+				case 0:
+					d := newDeployment()
+					d.Nodes, d.Edges = d.Nodes[:1], nil
+					runtime.DeployWorkflow(d)
+				case 1:
+					runtime.DeployWorkflow(newDeployment())
+				case 2:
+					runtime.ForceRunWorkflow(1, make(chan any, 1), make(chan error, 1), make(chan hainish.Edge, 1))
+				default:
+					runtime.StopWorkflow(1)
+				}
+				check()
+			}
+		}()
+	}
+	wg.Wait()
+	if started.Load() == 0 {
+		t.Error("Expected the workflow to run between some deployments")
+	}
+	runtime.StopWorkflow(1)
+}
+
+// TestLocalEdge tests that the values along an edge to a node on this follower
+// are delivered in memory, in order, and counted like those sent to other followers
+func TestLocalEdge(t *testing.T) {
+	counterNode := newCounterNode()
+	counterNode.trigger = hainish.Trigger{Kind: hainish.TriggerManual}
+	runtime := InitRuntime(map[string]hainish.Node{"counterNode": counterNode, "relayNode": newRelayNode()})
+	runtime.SetLocalPeer("self")
+	runtime.InitWorkflow(1)
+	runtime.CreateRuntimeNode("counterNode", 1, 1)
+	runtime.CreateRuntimeNode("relayNode", 2, 1)
+	runtime.CreateEdge(1, "self", 1, 1, "output1", 2, "input1")
+	runtime.CreateEdge(2, "peer123", 1, 2, "output1", 3, "input1")
+	var activities atomic.Int64
+	runtime.SetActivityHandler(func(workflowID int) {
+		if workflowID == 1 {
+			activities.Add(1)
+		}
+	})
+
+	processChan := make(chan hainish.Edge, 16)
+	if _, err := runtime.RunWorkflow(1, make(chan any, 16), make(chan error, 16), processChan); err != nil {
+		t.Fatalf("Unexpected error running workflow: %v", err)
+	}
+	defer runtime.StopWorkflow(1)
+
+	for i := 1; i <= 3; i++ {
+		if err := runtime.TriggerWorkflow(1); err != nil {
+			t.Fatalf("Unexpected error triggering workflow: %v", err)
+		}
+		data := receiveEdge(t, processChan)
+		if data.SourceEdgeID != 2 || data.Value != i {
+			t.Errorf("Expected %d along edge 2, got %v along edge %d", i, data.Value, data.SourceEdgeID)
+		}
+		runtime.AckOutput(1)
+	}
+
+	// Ansible is told about the values it doesn't see
+	if got := activities.Load(); got != 3 {
+		t.Errorf("Expected 3 local deliveries reported, got %d", got)
+	}
+
+	summary := runtime.workflows[1].summary(time.Now())
+	if summary.Nodes[0].Outputs != 3 || summary.Nodes[1].Firings != 3 || summary.Nodes[1].Outputs != 3 {
+		t.Errorf("Expected 3 outputs of each node and 3 firings of the relay, got %+v", summary.Nodes)
+	}
+	deadline := time.Now().Add(time.Second)
+	for quiet, _, _ := runtime.Activity(1); !quiet; quiet, _, _ = runtime.Activity(1) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the workflow to go quiet")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,163 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	goruntime "runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// How many firings may wait for a worker before the nodes hold their intake
+const jobQueueSize = 1024
+
+// The size of the worker pool when the runtime is created
+var defaultWorkers = 4 * goruntime.GOMAXPROCS(0)
+
+// SchedulerStats tells how the worker pool executing the node firings is doing,
+// and how many goroutines run beside it.
+type SchedulerStats struct {
+	Workers    int           `json:"Workers"`    // The size of the pool
+	Busy       int           `json:"Busy"`       // Workers executing a firing
+	Queued     int           `json:"Queued"`     // Firings waiting for a worker
+	Dispatched uint64        `json:"Dispatched"` // Firings handed to a worker
+	Completed  uint64        `json:"Completed"`  // Firings a worker has finished
+	Waited     time.Duration `json:"Waited"`     // Total time the firings waited for a worker
+
+	NodeGoroutines    int `json:"NodeGoroutines"`    // Two for each running node, taking and publishing its firings
+	FiringGoroutines  int `json:"FiringGoroutines"`  // Collecting the outputs of the firings, and executing those with a timeout
+	EdgeGoroutines    int `json:"EdgeGoroutines"`    // One for each output edge of a running node, sending its values
+	WatcherGoroutines int `json:"WatcherGoroutines"` // One for each run, waiting for it to complete or its goroutines to exit
+}
+
+// scheduler executes the firings of every workflow of the runtime on a bounded pool of workers.
+//
+// The workers never wait for the graph: what an action writes is collected,
+// and sent on by its node. So the pool can't be starved by nodes waiting for each other.
+// Only a streaming node's firing waits for the node to send on what it writes.
+//
+// That is also why each running node keeps two goroutines of its own beside the pool.
+// One takes the firings, waiting for the node's trigger and inputs, and the other
+// publishes them, waiting for the edges to take the outputs. Both may wait as long as
+// the graph is idle, and would hold the workers from the firings meanwhile.
+// An attempt has a goroutine collecting its outputs while the action runs, since the action
+// writes to channels nothing else would read until it returns. With a timeout, the action
+// runs in a goroutine of its own, so the worker can give it up.
+// Each output edge of a running node has a listener, waiting for the consumer port or
+// Ansible to take its values, and each run has a watcher, waiting for the run to complete,
+// or for its goroutines to exit once it is stopped.
+type scheduler struct {
+	clock clock.Clock
+	jobs  chan job
+
+	mu      sync.Mutex
+	workers int
+
+	busy       atomic.Int64
+	dispatched atomic.Uint64
+	completed  atomic.Uint64
+	waited     atomic.Int64
+
+	nodeGoroutines    atomic.Int64
+	firingGoroutines  atomic.Int64
+	edgeGoroutines    atomic.Int64
+	watcherGoroutines atomic.Int64
+}
+
+// A firing waiting for a worker. A nil run stops the worker taking it.
+type job struct {
+	run    func()
+	queued time.Time
+}
+
+func newScheduler(clk clock.Clock, workers int) *scheduler {
+	s := &scheduler{
+		clock: clk,
+		jobs:  make(chan job, jobQueueSize),
+	}
+	s.resize(workers)
+	return s
+}
+
+// Start or stop workers to make the pool the given size.
+// The stop jobs are queued once the lock is released, as they wait while the queue is full.
+func (s *scheduler) resize(workers int) {
+	s.mu.Lock()
+	for ; s.workers < workers; s.workers++ {
+		go s.work()
+	}
+	stops := max(s.workers-workers, 0)
+	s.workers -= stops
+	s.mu.Unlock()
+
+	for range stops {
+		s.jobs <- job{} // Taken by a worker after the firings queued before it
+	}
+}
+
+func (s *scheduler) work() {
+	for j := range s.jobs {
+		if j.run == nil {
+			return
+		}
+
+		s.dispatched.Add(1)
+		s.waited.Add(int64(s.clock.Since(j.queued)))
+		s.busy.Add(1)
+		j.run()
+		s.busy.Add(-1)
+		s.completed.Add(1)
+	}
+}
+
+// Queue the firing for a worker.
+// Return false if the workflow has been stopped.
+func (s *scheduler) submit(c context.Context, run func()) bool {
+	select {
+	case s.jobs <- job{run: run, queued: s.clock.Now()}:
+		return true
+	case <-c.Done():
+		return false
+	}
+}
+
+func (s *scheduler) stats() SchedulerStats {
+	s.mu.Lock()
+	workers := s.workers
+	s.mu.Unlock()
+
+	return SchedulerStats{
+		Workers:    workers,
+		Busy:       int(s.busy.Load()),
+		Queued:     len(s.jobs),
+		Dispatched: s.dispatched.Load(),
+		Completed:  s.completed.Load(),
+		Waited:     time.Duration(s.waited.Load()),
+
+		NodeGoroutines:    int(s.nodeGoroutines.Load()),
+		FiringGoroutines:  int(s.firingGoroutines.Load()),
+		EdgeGoroutines:    int(s.edgeGoroutines.Load()),
+		WatcherGoroutines: int(s.watcherGoroutines.Load()),
+	}
+}
+
+// SetWorkers sets the size of the worker pool executing the node firings.
+// A smaller pool takes effect after the firings already queued.
+func (r *Runtime) SetWorkers(workers int) error {
+	if workers < 1 {
+		return uerr.NewError(fmt.Errorf("%w: %d workers", util.ErrInvalidWorkers, workers))
+	}
+
+	r.scheduler.resize(workers)
+	return nil
+}
+
+// SchedulerStats returns how the worker pool executing the node firings is doing.
+func (r *Runtime) SchedulerStats() SchedulerStats {
+	return r.scheduler.stats()
+}
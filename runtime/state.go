@@ -0,0 +1,129 @@
+package runtime
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+type WorkflowState int
+
+const (
+	Created   WorkflowState = iota // Initialized, the graph can be edited
+	Running                        // Nodes are firing
+	Paused                         // Nodes are held, the data is kept
+	Stopping                       // Cancelled, waiting for the goroutines to exit
+	Stopped                        // All goroutines have exited
+	Failed                         // Stopped because of an error
+	Completed                      // All nodes have run out of data, and their values have left
+)
+
+func (s WorkflowState) String() string {
+	switch s {
+	case Created:
+		return "created"
+	case Running:
+		return "running"
+	case Paused:
+		return "paused"
+	case Stopping:
+		return "stopping"
+	case Stopped:
+		return "stopped"
+	case Failed:
+		return "failed"
+	case Completed:
+		return "completed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// The legal transitions of a workflow. The key is the current state.
+var transitions = map[WorkflowState][]WorkflowState{
+	Created:   {Running},
+	Running:   {Paused, Stopping, Failed, Completed},
+	Paused:    {Running, Stopping, Failed},
+	Stopping:  {Stopped, Failed},
+	Stopped:   {Running},
+	Failed:    {Running},
+	Completed: {Running},
+}
+
+// The states in which the graph of a workflow can be edited
+var editableStates = []WorkflowState{Created, Stopped, Failed, Completed}
+
+// The states in which the params and the graph of a workflow can be edited.
+// A running workflow takes the edit at once.
+var liveStates = []WorkflowState{Created, Running, Paused, Stopped, Failed, Completed}
+
+// StateError is returned when an operation is not allowed in the workflow's current state.
+type StateError struct {
+	WorkflowID int
+	State      WorkflowState
+	Operation  string
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s: workflow %d: cannot %s while %s", util.ErrIllegalWorkflowState, e.WorkflowID, e.Operation, e.State)
+}
+
+func (e *StateError) Unwrap() error {
+	return util.ErrIllegalWorkflowState
+}
+
+// WorkflowState returns the current state of the workflow.
+func (r *Runtime) WorkflowState(workflowID int) (WorkflowState, error) {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return 0, uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	return wf.getState(), nil
+}
+
+func (wf *workflow) getState() WorkflowState {
+	wf.stateMu.Lock()
+	defer wf.stateMu.Unlock()
+	return wf.state
+}
+
+// Move the workflow to another state if the transition is legal
+func (wf *workflow) transition(to WorkflowState, operation string) error {
+	wf.stateMu.Lock()
+	defer wf.stateMu.Unlock()
+
+	if !slices.Contains(transitions[wf.state], to) {
+		return uerr.NewError(&StateError{WorkflowID: wf.id, State: wf.state, Operation: operation})
+	}
+
+	// Hold the nodes when paused, and release them when leaving
+	if to == Paused {
+		wf.resume = make(chan struct{})
+	} else if wf.state == Paused {
+		close(wf.resume)
+	}
+
+	wf.state = to
+	return nil
+}
+
+// Get a channel which is closed while the workflow is not paused
+func (wf *workflow) resumed() chan struct{} {
+	wf.stateMu.Lock()
+	defer wf.stateMu.Unlock()
+	return wf.resume
+}
+
+// Check the operation is allowed in the workflow's current state
+func (wf *workflow) require(operation string, states ...WorkflowState) error {
+	wf.stateMu.Lock()
+	defer wf.stateMu.Unlock()
+
+	if !slices.Contains(states, wf.state) {
+		return uerr.NewError(&StateError{WorkflowID: wf.id, State: wf.state, Operation: operation})
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package runtime
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// ErrorRestart is decided by the supervisor when a node panicked and goes on after a backoff.
+// It is not an error policy.
+const ErrorRestart ErrorAction = "restart"
+
+// RestartMode is what the supervisor does when a node panics.
+type RestartMode string
+
+const (
+	RestartAlways RestartMode = ""      // Go on after the backoff (default)
+	RestartNever  RestartMode = "never" // Fail the workflow
+)
+
+// RestartPolicy decides whether a node goes on after a panic.
+type RestartPolicy struct {
+	Mode        RestartMode   `json:"Mode"`
+	MaxRestarts int           `json:"MaxRestarts"` // The workflow fails after this many restarts in a run. 0 means no limit
+	Backoff     time.Duration `json:"Backoff"`     // Wait before restarting. 0 means the default
+}
+
+func (p RestartPolicy) check() error {
+	switch p.Mode {
+	case RestartAlways, RestartNever:
+	default:
+		return fmt.Errorf("unknown mode %q", p.Mode)
+	}
+
+	if p.MaxRestarts < 0 || p.Backoff < 0 {
+		return fmt.Errorf("max restarts and backoff must not be negative")
+	}
+	return nil
+}
+
+// Decide what to do after the node crashed the given times in the run
+func (p RestartPolicy) decide(crashes uint64) ErrorAction {
+	if p.Mode == RestartNever {
+		return ErrorFailWorkflow
+	}
+	if p.MaxRestarts > 0 && crashes > uint64(p.MaxRestarts) {
+		return ErrorFailWorkflow
+	}
+	return ErrorRestart
+}
+
+func (p RestartPolicy) backoff() time.Duration {
+	if p.Backoff == 0 {
+		return defaultInitialBackoff
+	}
+	return p.Backoff
+}
+
+// PanicError is a panic recovered from a node, with the stack it happened on.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", e.Value, e.Stack)
+}
+
+// SetRestartPolicy sets what the supervisor does when the node panics.
+func (r *Runtime) SetRestartPolicy(workflowID, nodeID int, policy RestartPolicy) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+	wf.graphMu.Lock()
+	defer wf.graphMu.Unlock()
+
+	err := wf.require("set restart policy", editableStates...)
+	if err != nil {
+		return err
+	}
+
+	node, exist := wf.runtimeNodes[nodeID]
+	if !exist {
+		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+	}
+
+	err = policy.check()
+	if err != nil {
+		return uerr.NewError(fmt.Errorf("%w: %v", util.ErrInvalidRestartPolicy, err))
+	}
+
+	node.restartPolicy = policy
+	return nil
+}
+
+// Run the node's intake, and restart it by the node's restart policy when it panics.
+// A firing panicking on a worker is dealt with by the same policy.
+// Return true if the node has run out of data.
+func (w *workflow) superviseNode(rn *runtimeNode, t *trigger) bool {
+	for {
+		var exhausted bool
+		crash := recovered(func() { exhausted = w.intake(rn, t) })
+		if crash == nil {
+			return exhausted
+		}
+
+		if !w.crashed(rn, "", crash) || !w.sleep(rn.c, rn.restartPolicy.backoff()) {
+			return false
+		}
+	}
+}
+
+// Count the crash of the node, and tell Ansible what the restart policy decided.
+// Return false if the workflow has failed or been stopped.
+func (w *workflow) crashed(rn *runtimeNode, runID string, crash *PanicError) bool {
+	crashes := rn.stats.crashes.Add(1)
+	decision := rn.restartPolicy.decide(crashes)
+	if !w.report(&RunError{WorkflowID: w.id, NodeID: rn.id, RunID: runID, Decision: decision, Err: crash}) {
+		return false
+	}
+	if decision == ErrorFailWorkflow {
+		w.fail()
+		return false
+	}
+	return true
+}
+
+// Run the function, turning a panic into a crash
+func recovered(f func()) (crash *PanicError) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		// Recovered already when the action has a timeout
+		var ok bool
+		if crash, ok = v.(*PanicError); !ok {
+			crash = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	f()
+	return nil
+}
+
+// NodeCrashes returns how many times the node has panicked in the current run.
+func (r *Runtime) NodeCrashes(workflowID, nodeID int) (uint64, error) {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return 0, uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	node, exist := wf.node(nodeID)
+	if !exist {
+		return 0, uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+	}
+
+	return node.stats.crashes.Load(), nil
+}
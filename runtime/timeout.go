@@ -0,0 +1,121 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// TimeoutError is recorded when an execution of a node's action runs out of time.
+type TimeoutError struct {
+	NodeID  int
+	RunID   string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("node %d: run %s: action timed out after %v", e.NodeID, e.RunID, e.Timeout)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// SetTimeout sets how long an execution of the node's action may take, overriding
+// what the node declares. 0 means no limit.
+func (r *Runtime) SetTimeout(workflowID, nodeID int, timeout time.Duration) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+	wf.graphMu.Lock()
+	defer wf.graphMu.Unlock()
+
+	err := wf.require("set timeout", editableStates...)
+	if err != nil {
+		return err
+	}
+
+	node, exist := wf.runtimeNodes[nodeID]
+	if !exist {
+		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+	}
+
+	if timeout < 0 {
+		return uerr.NewError(fmt.Errorf("%w: %v", util.ErrInvalidTimeout, timeout))
+	}
+
+	node.timeout = timeout
+	return nil
+}
+
+// Get the timeout the node declares
+func declaredTimeout(node hainish.Node) time.Duration {
+	if node, ok := node.(hainish.TimeoutNode); ok {
+		return node.Timeout()
+	}
+	return 0
+}
+
+// Execute the node's action once.
+// With a timeout, the action runs in its own goroutine, and is abandoned when the time is up
+// or the workflow stops. Its context is cancelled then, but an action which ignores the context
+// keeps running in the background. What it writes to the output ports from then on is
+// thrown away, so it is never blocked on them, and its goroutine ends when it returns.
+func (w *workflow) act(rn *runtimeNode, in map[string]any, a *attempt) (any, error) {
+	c := hainish.WithRunID(w.c, a.runID)
+	if rn.timeout <= 0 {
+		defer close(a.returned)
+		return call(*rn.node, c, in, a.out)
+	}
+
+	c, cancel := w.clock.WithTimeout(c, rn.timeout)
+	defer cancel()
+
+	type outcome struct {
+		result any
+		err    error
+		crash  *PanicError
+	}
+	done := make(chan outcome, 1)
+	w.scheduler.firingGoroutines.Add(1)
+	go func() {
+		defer w.scheduler.firingGoroutines.Add(-1)
+		var o outcome
+		defer func() {
+			// The supervisor lives in the node's goroutine
+			if v := recover(); v != nil {
+				o.crash = &PanicError{Value: v, Stack: debug.Stack()}
+			}
+			close(a.returned)
+			done <- o
+		}()
+		o.result, o.err = call(*rn.node, c, in, a.out)
+	}()
+
+	select {
+	case o := <-done:
+		if o.crash != nil {
+			panic(o.crash)
+		}
+		return o.result, o.err
+	case <-c.Done():
+		close(a.abandoned)
+		if w.c.Err() != nil {
+			return nil, w.c.Err() // Stopped rather than timed out
+		}
+		return nil, &TimeoutError{NodeID: rn.id, RunID: a.runID, Timeout: rn.timeout}
+	}
+}
+
+func call(node hainish.Node, c context.Context, in map[string]any, out map[string]chan any) (any, error) {
+	if node, ok := node.(hainish.ContextNode); ok {
+		return node.ActionContext(c, in, out)
+	}
+	return node.Action(in, out)
+}
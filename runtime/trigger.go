@@ -0,0 +1,175 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/benbjohnson/clock"
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// How many manual triggers a begin node keeps before it fires them
+const manualTriggerBuffer = 64
+
+// trigger tells a begin node when to fire in a run.
+type trigger struct {
+	policy   hainish.Trigger
+	clock    clock.Clock
+	schedule *cronSchedule // For TriggerCron
+	ticker   *clock.Ticker // For TriggerInterval
+	manual   chan struct{} // For TriggerManual
+}
+
+// Check the trigger can be used by a begin node
+func checkTrigger(t hainish.Trigger) error {
+	switch t.Kind {
+	case hainish.TriggerLoop, hainish.TriggerOnce, hainish.TriggerManual:
+		return nil
+	case hainish.TriggerInterval:
+		if t.Interval <= 0 {
+			return fmt.Errorf("interval must be positive, got %s", t.Interval)
+		}
+		return nil
+	case hainish.TriggerCron:
+		_, err := parseCron(t.Cron)
+		return err
+	default:
+		return fmt.Errorf("unknown trigger kind %d", t.Kind)
+	}
+}
+
+// Create the trigger of a begin node for a new run.
+// The ticker is started here, so the first tick is counted from the start of the run.
+func (w *workflow) newTrigger(rn *runtimeNode) (*trigger, error) {
+	err := checkTrigger(rn.trigger)
+	if err != nil {
+		return nil, uerr.NewError(fmt.Errorf("%w: %v", util.ErrInvalidTrigger, err))
+	}
+
+	t := &trigger{policy: rn.trigger, clock: w.clock, manual: rn.triggers}
+	switch t.policy.Kind {
+	case hainish.TriggerInterval:
+		t.ticker = w.clock.Ticker(t.policy.Interval)
+	case hainish.TriggerCron:
+		t.schedule, _ = parseCron(t.policy.Cron)
+	}
+	return t, nil
+}
+
+// Block until the begin node should fire for the epoch.
+// Return false if the node won't fire any more in this run.
+func (t *trigger) wait(c context.Context, epoch int) bool {
+	switch t.policy.Kind {
+	case hainish.TriggerOnce:
+		return epoch == 0
+	case hainish.TriggerInterval:
+		if epoch == 0 {
+			return true
+		}
+		select {
+		case <-t.ticker.C:
+			return true
+		case <-c.Done():
+			return false
+		}
+	case hainish.TriggerCron:
+		next := t.schedule.next(t.clock.Now())
+		if next.IsZero() {
+			return false // The time never comes
+		}
+		timer := t.clock.Timer(t.clock.Until(next))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-c.Done():
+			return false
+		}
+	case hainish.TriggerManual:
+		select {
+		case <-t.manual:
+			return true
+		case <-c.Done():
+			return false
+		}
+	default:
+		return true
+	}
+}
+
+func (t *trigger) stop() {
+	if t.ticker != nil {
+		t.ticker.Stop()
+	}
+}
+
+// SetTrigger overrides the trigger a begin node declares.
+func (r *Runtime) SetTrigger(workflowID, nodeID int, t hainish.Trigger) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+	wf.graphMu.Lock()
+	defer wf.graphMu.Unlock()
+
+	err := wf.require("set trigger", editableStates...)
+	if err != nil {
+		return err
+	}
+
+	node, exist := wf.runtimeNodes[nodeID]
+	if !exist {
+		return uerr.NewError(util.ErrNodeNotFoundInWorkflow)
+	}
+	if !(*node.node).IsBegin() {
+		return uerr.NewError(util.ErrNodeNotBegin)
+	}
+
+	err = checkTrigger(t)
+	if err != nil {
+		return uerr.NewError(fmt.Errorf("%w: %v", util.ErrInvalidTrigger, err))
+	}
+
+	node.trigger = t
+	return nil
+}
+
+// TriggerWorkflow fires every manually triggered begin node of the workflow once.
+// A paused workflow keeps the triggers until it is resumed.
+func (r *Runtime) TriggerWorkflow(workflowID int) error {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	err := wf.require("trigger", Running, Paused)
+	if err != nil {
+		return err
+	}
+
+	wf.graphMu.RLock()
+	defer wf.graphMu.RUnlock()
+	triggered, full := false, false
+	for _, rn := range wf.runtimeNodes {
+		if !(*rn.node).IsBegin() || rn.trigger.Kind != hainish.TriggerManual {
+			continue
+		}
+		triggered = true
+
+		select {
+		case rn.triggers <- struct{}{}:
+		default:
+			full = true
+		}
+	}
+
+	if !triggered {
+		return uerr.NewError(util.ErrNoManualTrigger)
+	}
+	if full {
+		return uerr.NewError(util.ErrTriggerQueueFull)
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package runtime
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/lvyonghuan/Ubik-Util/uerr"
+	"github.com/lvyonghuan/mobiles/hainish"
+	"github.com/lvyonghuan/mobiles/util"
+)
+
+// NoID is used in a Problem when it is not about a node or an edge.
+const NoID = -1
+
+type ProblemKind string
+
+const (
+	ProblemDanglingEdge      ProblemKind = "dangling_edge"        // The edge's producer or consumer node doesn't exist
+	ProblemPortNotFound      ProblemKind = "port_not_found"       // The edge refers to a port the node doesn't have
+	ProblemMissingProducer   ProblemKind = "missing_producer"     // An input port of a non-begin node has no edge
+	ProblemMultipleEdges     ProblemKind = "multiple_edges"       // A single input port has more than one edge
+	ProblemCycleWithoutBegin ProblemKind = "cycle_without_begin"  // The nodes wait for each other forever
+	ProblemInvalidTrigger    ProblemKind = "invalid_trigger"      // A begin node's trigger can't fire
+	ProblemEndNodeHasOutputs ProblemKind = "end_node_has_outputs" // An end node feeds other nodes
+	ProblemMissingParam      ProblemKind = "missing_param"        // A required param has no value
+)
+
+// Problem is something wrong with a workflow graph that keeps it from running.
+type Problem struct {
+	Kind    ProblemKind `json:"Kind"`
+	NodeID  int         `json:"NodeID"`
+	EdgeID  int         `json:"EdgeID"`
+	Port    string      `json:"Port"`
+	Message string      `json:"Message"`
+}
+
+// ValidationError is returned when running an invalid workflow.
+type ValidationError struct {
+	WorkflowID int
+	Problems   []Problem
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		messages[i] = problem.Message
+	}
+	return fmt.Sprintf("%s: workflow %d: %s", util.ErrInvalidWorkflow, e.WorkflowID, strings.Join(messages, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return util.ErrInvalidWorkflow
+}
+
+// ValidateWorkflow checks the part of the workflow graph on this follower,
+// and returns every problem found. An empty list means the workflow can run.
+func (r *Runtime) ValidateWorkflow(workflowID int) ([]Problem, error) {
+	wf, exist := r.getWorkflow(workflowID)
+	if !exist {
+		return nil, uerr.NewError(util.ErrWorkflowNotFound)
+	}
+
+	wf.graphMu.RLock()
+	defer wf.graphMu.RUnlock()
+	problems := r.checkEdges(wf)
+	problems = append(problems, checkInputs(wf)...)
+	problems = append(problems, checkCycles(wf)...)
+	problems = append(problems, checkTriggers(wf)...)
+	problems = append(problems, checkEndNodes(wf)...)
+	problems = append(problems, checkParams(wf)...)
+	return problems, nil
+}
+
+// Check every edge's nodes and ports exist
+func (r *Runtime) checkEdges(wf *workflow) []Problem {
+	var problems []Problem
+
+	for _, edgeID := range slices.Sorted(maps.Keys(wf.edges)) {
+		e := wf.edges[edgeID]
+
+		if e.isOutput {
+			producer, exist := wf.runtimeNodes[e.producerNodeID]
+			if !exist {
+				problems = append(problems, Problem{
+					Kind:    ProblemDanglingEdge,
+					NodeID:  e.producerNodeID,
+					EdgeID:  edgeID,
+					Message: fmt.Sprintf("edge %d: producer node %d not found", edgeID, e.producerNodeID),
+				})
+			} else if _, exist = producer.outputs[e.producerPortName]; !exist {
+				problems = append(problems, Problem{
+					Kind:    ProblemPortNotFound,
+					NodeID:  e.producerNodeID,
+					EdgeID:  edgeID,
+					Port:    e.producerPortName,
+					Message: fmt.Sprintf("edge %d: node %d has no output port %q", edgeID, e.producerNodeID, e.producerPortName),
+				})
+			}
+		}
+
+		// The consumer must be here if the edge is delivered to this follower
+		if !e.isInput && !(r.localPeer != "" && e.e.Destination == r.localPeer) {
+			continue
+		}
+		consumer, exist := wf.runtimeNodes[e.e.TargetNodeID]
+		if !exist {
+			problems = append(problems, Problem{
+				Kind:    ProblemDanglingEdge,
+				NodeID:  e.e.TargetNodeID,
+				EdgeID:  edgeID,
+				Message: fmt.Sprintf("edge %d: consumer node %d not found", edgeID, e.e.TargetNodeID),
+			})
+		} else if _, exist = (*consumer.node).Inputs()[e.e.TargetPort]; !exist {
+			problems = append(problems, Problem{
+				Kind:    ProblemPortNotFound,
+				NodeID:  e.e.TargetNodeID,
+				EdgeID:  edgeID,
+				Port:    e.e.TargetPort,
+				Message: fmt.Sprintf("edge %d: node %d has no input port %q", edgeID, e.e.TargetNodeID, e.e.TargetPort),
+			})
+		}
+	}
+
+	return problems
+}
+
+// Check every input port has as many producers as it needs
+func checkInputs(wf *workflow) []Problem {
+	var problems []Problem
+
+	for _, nodeID := range slices.Sorted(maps.Keys(wf.runtimeNodes)) {
+		rn := wf.runtimeNodes[nodeID]
+		node := *rn.node
+
+		for _, portName := range slices.Sorted(maps.Keys(node.Inputs())) {
+			count := 0
+			for _, e := range rn.inputEdges {
+				if e.e.TargetPort == portName {
+					count++
+				}
+			}
+
+			// A begin node starts without inputs
+			if count == 0 && !node.IsBegin() {
+				problems = append(problems, Problem{
+					Kind:    ProblemMissingProducer,
+					NodeID:  nodeID,
+					EdgeID:  NoID,
+					Port:    portName,
+					Message: fmt.Sprintf("node %d: input port %q has no producer", nodeID, portName),
+				})
+			}
+			if count > 1 && hainish.PortMerge(node.Inputs()[portName]) == hainish.MergeSingle {
+				problems = append(problems, Problem{
+					Kind:    ProblemMultipleEdges,
+					NodeID:  nodeID,
+					EdgeID:  NoID,
+					Port:    portName,
+					Message: fmt.Sprintf("node %d: input port %q accepts one edge, but has %d", nodeID, portName, count),
+				})
+			}
+		}
+	}
+
+	return problems
+}
+
+// Check the trigger of every begin node
+func checkTriggers(wf *workflow) []Problem {
+	var problems []Problem
+
+	for _, nodeID := range slices.Sorted(maps.Keys(wf.runtimeNodes)) {
+		rn := wf.runtimeNodes[nodeID]
+		if !(*rn.node).IsBegin() {
+			continue
+		}
+
+		err := checkTrigger(rn.trigger)
+		if err != nil {
+			problems = append(problems, Problem{
+				Kind:    ProblemInvalidTrigger,
+				NodeID:  nodeID,
+				EdgeID:  NoID,
+				Message: fmt.Sprintf("node %d: %v", nodeID, err),
+			})
+		}
+	}
+
+	return problems
+}
+
+// Check no end node feeds other nodes
+func checkEndNodes(wf *workflow) []Problem {
+	var problems []Problem
+
+	for _, nodeID := range slices.Sorted(maps.Keys(wf.runtimeNodes)) {
+		rn := wf.runtimeNodes[nodeID]
+		if !hainish.NodeIsEnd(*rn.node) {
+			continue
+		}
+
+		for _, edgeID := range slices.Sorted(maps.Keys(rn.outputEdges)) {
+			problems = append(problems, Problem{
+				Kind:    ProblemEndNodeHasOutputs,
+				NodeID:  nodeID,
+				EdgeID:  edgeID,
+				Port:    rn.outputEdges[edgeID].producerPortName,
+				Message: fmt.Sprintf("end node %d: feeds edge %d", nodeID, edgeID),
+			})
+		}
+	}
+
+	return problems
+}
+
+// Check every required param has a value
+func checkParams(wf *workflow) []Problem {
+	var problems []Problem
+
+	for _, nodeID := range slices.Sorted(maps.Keys(wf.runtimeNodes)) {
+		rn := wf.runtimeNodes[nodeID]
+		params := rn.paramValues()
+
+		ports := (*rn.node).Params()
+		for _, portName := range slices.Sorted(maps.Keys(ports)) {
+			if _, set := params[portName]; set || !hainish.PortSchema(ports[portName]).Required {
+				continue
+			}
+			problems = append(problems, Problem{
+				Kind:    ProblemMissingParam,
+				NodeID:  nodeID,
+				EdgeID:  NoID,
+				Port:    portName,
+				Message: fmt.Sprintf("node %d: required param %s is not set", nodeID, portName),
+			})
+		}
+	}
+
+	return problems
+}
+
+// Find the cycles among the nodes on this follower that no begin node can start.
+// Every node in such a cycle waits for the others, so none of them will ever fire.
+func checkCycles(wf *workflow) []Problem {
+	var problems []Problem
+
+	for _, component := range stronglyConnectedComponents(wf) {
+		hasBegin := false
+		for _, nodeID := range component {
+			if (*wf.runtimeNodes[nodeID].node).IsBegin() {
+				hasBegin = true
+				break
+			}
+		}
+		if hasBegin {
+			continue
+		}
+
+		problems = append(problems, Problem{
+			Kind:    ProblemCycleWithoutBegin,
+			NodeID:  component[0],
+			EdgeID:  NoID,
+			Message: fmt.Sprintf("nodes %v form a cycle without a begin node", component),
+		})
+	}
+
+	return problems
+}
+
+// Tarjan's algorithm over the edges whose both ends are on this follower.
+// Only the components which are cycles are returned, each sorted by node ID.
+func stronglyConnectedComponents(wf *workflow) [][]int {
+	next := make(map[int][]int)
+	selfLoop := make(map[int]bool)
+	for _, e := range wf.edges {
+		if !e.isOutput || !e.isInput {
+			continue
+		}
+		next[e.producerNodeID] = append(next[e.producerNodeID], e.e.TargetNodeID)
+		if e.producerNodeID == e.e.TargetNodeID {
+			selfLoop[e.producerNodeID] = true
+		}
+	}
+
+	index := make(map[int]int)
+	lowLink := make(map[int]int)
+	onStack := make(map[int]bool)
+	var stack []int
+	var components [][]int
+
+	var visit func(nodeID int)
+	visit = func(nodeID int) {
+		index[nodeID] = len(index)
+		lowLink[nodeID] = index[nodeID]
+		stack = append(stack, nodeID)
+		onStack[nodeID] = true
+
+		for _, to := range next[nodeID] {
+			if _, visited := index[to]; !visited {
+				visit(to)
+				lowLink[nodeID] = min(lowLink[nodeID], lowLink[to])
+			} else if onStack[to] {
+				lowLink[nodeID] = min(lowLink[nodeID], index[to])
+			}
+		}
+
+		if lowLink[nodeID] != index[nodeID] {
+			return
+		}
+
+		var component []int
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == nodeID {
+				break
+			}
+		}
+		if len(component) > 1 || selfLoop[nodeID] {
+			slices.Sort(component)
+			components = append(components, component)
+		}
+	}
+
+	for _, nodeID := range slices.Sorted(maps.Keys(wf.runtimeNodes)) {
+		if _, visited := index[nodeID]; !visited {
+			visit(nodeID)
+		}
+	}
+
+	return components
+}
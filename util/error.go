@@ -18,8 +18,31 @@ var (
 	ErrPortNotFoundInNode     = errors.New("port not found in node")
 	ErrDeletingNodeHasEdges   = errors.New("cannot delete node with existing edges")
 	ErrPortNotExist           = errors.New("port not exist")
+	ErrInvalidOutputMode      = errors.New("invalid output mode")
+	ErrPortMultipleEdges      = errors.New("port does not accept multiple incoming edges")
+	ErrInvalidWorkflow        = errors.New("invalid workflow")
+	ErrIllegalWorkflowState   = errors.New("illegal operation in current workflow state")
+	ErrEdgeNotFoundInWorkflow = errors.New("edge not found")
+	ErrNodeNotBegin           = errors.New("node is not a begin node")
+	ErrInvalidTrigger         = errors.New("invalid trigger")
+	ErrNoManualTrigger        = errors.New("workflow has no manually triggered begin node")
+	ErrTriggerQueueFull       = errors.New("too many pending triggers")
+	ErrInvalidErrorPolicy     = errors.New("invalid error policy")
+	ErrInvalidRestartPolicy   = errors.New("invalid restart policy")
+	ErrInvalidTimeout         = errors.New("invalid timeout")
+	ErrInvalidConcurrency     = errors.New("invalid concurrency")
+	ErrNodeNotConcurrent      = errors.New("node is not safe to run concurrently")
+	ErrInvalidWorkers         = errors.New("invalid number of workers")
+	ErrTooManyOutputs         = errors.New("too many outputs held")
+	ErrInvalidParam           = errors.New("invalid param value")
+	ErrInvalidEdgeRemoval     = errors.New("invalid edge removal")
+	ErrInvalidDeployment      = errors.New("invalid deployment")
+	ErrWorkflowExists         = errors.New("workflow already exists")
+	ErrNodeExists             = errors.New("node already exists")
+	ErrEdgeExists             = errors.New("edge already exists")
 )
 
 var (
-	ErrPeerNotExist = errors.New("peer not exist")
+	ErrPeerNotExist  = errors.New("peer not exist")
+	ErrQuotaExceeded = errors.New("leader quota exceeded")
 )